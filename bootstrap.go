@@ -0,0 +1,267 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	ctrldnet "github.com/Control-D-Inc/ctrld/internal/net"
+)
+
+// Control D bootstrap DNS servers, used when there's no bootstrap servers configured.
+const (
+	defaultBootstrapDNS   = "76.76.2.0"
+	defaultBootstrapDNSv6 = "2606:1a40::"
+)
+
+var errInvalidBootstrapServer = errors.New("invalid bootstrap server")
+
+// bootstrapServers are the servers used for resolving upstreams domain, and other
+// domains that ctrld needs before the upstreams are usable, like Control D API.
+type bootstrapServers struct {
+	// nameservers are plain DNS servers, in "ip:port" form.
+	nameservers []string
+	// resolvers are encrypted DNS servers, which do not need bootstrapping themselves.
+	resolvers []Resolver
+	// addrs are the addresses of all servers, in "ip:port" form.
+	addrs []string
+}
+
+var defaultBootstrapServers = &bootstrapServers{
+	nameservers: []string{net.JoinHostPort(defaultBootstrapDNS, "53"), net.JoinHostPort(defaultBootstrapDNSv6, "53")},
+	addrs:       []string{net.JoinHostPort(defaultBootstrapDNS, "53"), net.JoinHostPort(defaultBootstrapDNSv6, "53")},
+}
+
+func init() {
+	setNetBootstrapServers(defaultBootstrapServers)
+}
+
+// globalBootstrapServers is the bootstrap servers set by SetBootstrapServers.
+var globalBootstrapServers atomic.Pointer[bootstrapServers]
+
+// currentBootstrapServers returns the bootstrap servers currently in use.
+func currentBootstrapServers() *bootstrapServers {
+	if bs := globalBootstrapServers.Load(); bs != nil {
+		return bs
+	}
+	return defaultBootstrapServers
+}
+
+// SetBootstrapServers sets the bootstrap servers used by ctrld. If servers is empty,
+// the default Control D bootstrap DNS server is used.
+func SetBootstrapServers(servers []string) error {
+	bs, err := newBootstrapServers(servers)
+	if err != nil {
+		return err
+	}
+	if bs == nil {
+		bs = defaultBootstrapServers
+	}
+	globalBootstrapServers.Store(bs)
+	or.Store(newOSResolver(bs))
+	setNetBootstrapServers(bs)
+	return nil
+}
+
+// setNetBootstrapServers makes ctrldnet.Dialer and network checking use given bootstrap servers.
+func setNetBootstrapServers(bs *bootstrapServers) {
+	ctrldnet.SetBootstrapDNS(newDialer(bs).Resolver.Dial, bs.addrs)
+}
+
+// BootstrapDialer returns a dialer which resolves domain names using the bootstrap servers.
+func BootstrapDialer() *net.Dialer {
+	return newDialer(currentBootstrapServers())
+}
+
+// newBootstrapServers parses the given servers, returning nil if servers is empty.
+func newBootstrapServers(servers []string) (*bootstrapServers, error) {
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	bs := &bootstrapServers{}
+	for _, server := range servers {
+		ns, r, err := parseBootstrapServer(server)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			bs.resolvers = append(bs.resolvers, r)
+			// The server is validated by parseBootstrapServer already.
+			u, _ := url.Parse(server)
+			port := u.Port()
+			if port == "" {
+				port = "443"
+			}
+			bs.addrs = append(bs.addrs, net.JoinHostPort(u.Hostname(), port))
+			continue
+		}
+		bs.nameservers = append(bs.nameservers, ns)
+		bs.addrs = append(bs.addrs, ns)
+	}
+	return bs, nil
+}
+
+// parseBootstrapServer parses a bootstrap server, which is either:
+//
+//   - A plain DNS server IP address, with optional port, e.g: "1.1.1.1", "[2606:4700:4700::1111]:53".
+//   - A DoH endpoint using IP address as host, e.g: "https://1.1.1.1/dns-query".
+//
+// For plain DNS server, the nameserver address is returned, otherwise the DoH resolver.
+func parseBootstrapServer(server string) (string, Resolver, error) {
+	if ip := net.ParseIP(server); ip != nil {
+		return net.JoinHostPort(server, "53"), nil, nil
+	}
+	if !strings.Contains(server, "://") {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			return "", nil, fmt.Errorf("%w: %q: host must be an IP address", errInvalidBootstrapServer, server)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", nil, fmt.Errorf("%w: %q: invalid port", errInvalidBootstrapServer, server)
+		}
+		return server, nil, nil
+	}
+	u, err := url.Parse(server)
+	if err != nil || u.Scheme != "https" {
+		return "", nil, fmt.Errorf("%w: %q", errInvalidBootstrapServer, server)
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) == nil {
+		return "", nil, fmt.Errorf("%w: %q: host must be an IP address", errInvalidBootstrapServer, server)
+	}
+	uc := &UpstreamConfig{
+		Name:        "bootstrap",
+		Type:        ResolverTypeDOH,
+		Endpoint:    server,
+		BootstrapIP: host,
+	}
+	uc.Init()
+	return "", newDohResolver(uc), nil
+}
+
+// newOSResolver returns an OS resolver, which uses OS nameservers plus given bootstrap servers.
+func newOSResolver(bs *bootstrapServers) *osResolver {
+	ns := nameservers()
+	ns = append(ns, bs.nameservers...)
+	return &osResolver{nameservers: ns, resolvers: bs.resolvers}
+}
+
+// newDialer returns a dialer which resolves domain names using given bootstrap servers.
+func newDialer(bs *bootstrapServers) *net.Dialer {
+	r := &osResolver{nameservers: bs.nameservers, resolvers: bs.resolvers}
+	return &net.Dialer{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return &resolverConn{r: r}, nil
+			},
+		},
+	}
+}
+
+// resolverConn is a fake packet connection, answering DNS queries written to it
+// using a Resolver. It allows the Go resolver to use encrypted bootstrap servers.
+type resolverConn struct {
+	r Resolver
+
+	mu       sync.Mutex
+	deadline time.Time
+	answers  [][]byte
+	closed   bool
+}
+
+func (c *resolverConn) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	answer, err := c.r.Resolve(ctx, msg)
+	if err != nil {
+		return 0, err
+	}
+	answer.Id = msg.Id
+	buf, err := answer.Pack()
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.answers = append(c.answers, buf)
+	return len(b), nil
+}
+
+func (c *resolverConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if len(c.answers) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.answers[0])
+	c.answers = c.answers[1:]
+	return n, nil
+}
+
+func (c *resolverConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *resolverConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *resolverConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.answers = nil
+	return nil
+}
+
+func (c *resolverConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *resolverConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *resolverConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *resolverConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *resolverConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
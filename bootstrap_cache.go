@@ -0,0 +1,116 @@
+package ctrld
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// bootstrapIPCacheVersion is the current version of bootstrap IPs cache file format.
+const bootstrapIPCacheVersion = 1
+
+// DefaultBootstrapIPsMaxAge is the default age after which cached bootstrap IPs are expired.
+const DefaultBootstrapIPsMaxAge = 7 * 24 * time.Hour
+
+// BootstrapIPCache persists upstreams bootstrap IPs to a state file, so ctrld could
+// start serving using the cached IPs when bootstrap DNS is not reachable yet.
+//
+// A nil *BootstrapIPCache is valid, and caches nothing.
+type BootstrapIPCache struct {
+	path   string
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	entries map[string]bootstrapIPCacheEntry
+}
+
+type bootstrapIPCacheFile struct {
+	Version   int                              `json:"version"`
+	Upstreams map[string]bootstrapIPCacheEntry `json:"upstreams"`
+}
+
+type bootstrapIPCacheEntry struct {
+	IPs       []string  `json:"ips"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NewBootstrapIPCache returns a BootstrapIPCache backed by given file. Entries older
+// than maxAge are ignored, a non-positive maxAge means entries never expire.
+func NewBootstrapIPCache(path string, maxAge time.Duration) *BootstrapIPCache {
+	c := &BootstrapIPCache{
+		path:    path,
+		maxAge:  maxAge,
+		entries: make(map[string]bootstrapIPCacheEntry),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			ProxyLogger.Load().Warn().Err(err).Msg("could not read bootstrap IPs cache file")
+		}
+		return c
+	}
+	var f bootstrapIPCacheFile
+	if err := json.Unmarshal(data, &f); err != nil || f.Version != bootstrapIPCacheVersion {
+		ProxyLogger.Load().Warn().Err(err).Msgf("ignoring invalid bootstrap IPs cache file: %s", path)
+		return c
+	}
+	for domain, e := range f.Upstreams {
+		if !c.expired(e) {
+			c.entries[domain] = e
+		}
+	}
+	return c
+}
+
+// get returns the cached bootstrap IPs of given domain, or nil if there's no fresh entry.
+func (c *BootstrapIPCache) get(domain string) []string {
+	if c == nil || domain == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[domain]
+	if !ok || c.expired(e) {
+		return nil
+	}
+	return e.IPs
+}
+
+// set updates the bootstrap IPs of given domain, and saves the cache to disk.
+func (c *BootstrapIPCache) set(domain string, ips []string) {
+	if c == nil || domain == "" || len(ips) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[domain] = bootstrapIPCacheEntry{IPs: ips, UpdatedAt: time.Now()}
+	for d, e := range c.entries {
+		if c.expired(e) {
+			delete(c.entries, d)
+		}
+	}
+	if err := c.save(); err != nil {
+		ProxyLogger.Load().Warn().Err(err).Msg("could not save bootstrap IPs cache file")
+	}
+}
+
+func (c *BootstrapIPCache) expired(e bootstrapIPCacheEntry) bool {
+	return c.maxAge > 0 && time.Since(e.UpdatedAt) > c.maxAge
+}
+
+// save writes the cache to disk. The caller must hold c.mu.
+func (c *BootstrapIPCache) save() error {
+	data, err := json.Marshal(&bootstrapIPCacheFile{Version: bootstrapIPCacheVersion, Upstreams: c.entries})
+	if err != nil {
+		return err
+	}
+	// Writing to a temporary file then renaming, so the cache file is never partially written.
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,114 @@
+package ctrld
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBootstrapIPCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bootstrap_ips.json")
+	c := NewBootstrapIPCache(path, time.Hour)
+	if ips := c.get("dns.example.com"); ips != nil {
+		t.Fatalf("unexpected cached IPs: %v", ips)
+	}
+	want := []string{"192.0.2.1", "2001:db8::1"}
+	c.set("dns.example.com", want)
+
+	c = NewBootstrapIPCache(path, time.Hour)
+	if got := c.get("dns.example.com"); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected cached IPs, want: %v, got: %v", want, got)
+	}
+	if ips := c.get("other.example.com"); ips != nil {
+		t.Errorf("unexpected cached IPs: %v", ips)
+	}
+}
+
+func TestBootstrapIPCache_expired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bootstrap_ips.json")
+	writeBootstrapIPCacheFile(t, path, bootstrapIPCacheFile{
+		Version: bootstrapIPCacheVersion,
+		Upstreams: map[string]bootstrapIPCacheEntry{
+			"fresh.example.com": {IPs: []string{"192.0.2.1"}, UpdatedAt: time.Now()},
+			"stale.example.com": {IPs: []string{"192.0.2.2"}, UpdatedAt: time.Now().Add(-2 * time.Hour)},
+		},
+	})
+
+	c := NewBootstrapIPCache(path, time.Hour)
+	if ips := c.get("fresh.example.com"); len(ips) != 1 {
+		t.Errorf("fresh entry must be used, got: %v", ips)
+	}
+	if ips := c.get("stale.example.com"); ips != nil {
+		t.Errorf("stale entry must be expired, got: %v", ips)
+	}
+
+	c = NewBootstrapIPCache(path, 0)
+	if ips := c.get("stale.example.com"); len(ips) != 1 {
+		t.Errorf("entry must not be expired without max age, got: %v", ips)
+	}
+}
+
+func TestBootstrapIPCache_invalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bootstrap_ips.json")
+	writeBootstrapIPCacheFile(t, path, bootstrapIPCacheFile{
+		Version: bootstrapIPCacheVersion + 1,
+		Upstreams: map[string]bootstrapIPCacheEntry{
+			"dns.example.com": {IPs: []string{"192.0.2.1"}, UpdatedAt: time.Now()},
+		},
+	})
+	if ips := NewBootstrapIPCache(path, time.Hour).get("dns.example.com"); ips != nil {
+		t.Errorf("unknown version must be ignored, got: %v", ips)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := NewBootstrapIPCache(path, time.Hour)
+	c.set("dns.example.com", []string{"192.0.2.1"})
+	if ips := NewBootstrapIPCache(path, time.Hour).get("dns.example.com"); len(ips) != 1 {
+		t.Errorf("corrupted cache file must be overwritten, got: %v", ips)
+	}
+}
+
+func TestUpstreamConfig_SetupBootstrapIPWithCache(t *testing.T) {
+	var c *BootstrapIPCache
+	if ips := c.get("dns.example.com"); ips != nil {
+		t.Fatalf("nil cache must not return IPs, got: %v", ips)
+	}
+
+	c = NewBootstrapIPCache(filepath.Join(t.TempDir(), "bootstrap_ips.json"), time.Hour)
+	want := []string{"192.0.2.1", "2001:db8::1"}
+	// The domain could never be resolved, so cached IPs must be kept.
+	c.set("dns.invalid", want)
+	uc := &UpstreamConfig{Name: "test", Type: ResolverTypeDOT, Endpoint: "dns.invalid", Timeout: 100}
+	uc.Init()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		uc.SetupBootstrapIPWithCache(c)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("setup bootstrap IP must not block when cached IPs are available")
+	}
+	ips, ips4, ips6 := uc.bootstrapIPsByStack()
+	if !reflect.DeepEqual(ips, want) || len(ips4) != 1 || len(ips6) != 1 {
+		t.Errorf("unexpected bootstrap IPs: %v, %v, %v", ips, ips4, ips6)
+	}
+}
+
+func writeBootstrapIPCacheFile(t *testing.T, path string, f bootstrapIPCacheFile) {
+	t.Helper()
+	data, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,175 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	ctrldnet "github.com/Control-D-Inc/ctrld/internal/net"
+)
+
+func Test_parseBootstrapServer(t *testing.T) {
+	tests := []struct {
+		name       string
+		server     string
+		nameserver string
+		doh        bool
+		wantErr    bool
+	}{
+		{"ipv4", "1.1.1.1", "1.1.1.1:53", false, false},
+		{"ipv6", "2606:4700:4700::1111", "[2606:4700:4700::1111]:53", false, false},
+		{"ipv4 with port", "1.1.1.1:5353", "1.1.1.1:5353", false, false},
+		{"ipv6 with port", "[2606:4700:4700::1111]:53", "[2606:4700:4700::1111]:53", false, false},
+		{"doh with ip", "https://1.1.1.1/dns-query", "", true, false},
+		{"doh with ip and port", "https://[2606:4700:4700::1111]:443/dns-query", "", true, false},
+		{"domain", "dns.google", "", false, true},
+		{"domain with port", "dns.google:53", "", false, true},
+		{"invalid port", "1.1.1.1:dns", "", false, true},
+		{"doh with domain", "https://dns.google/dns-query", "", false, true},
+		{"dot", "tls://1.1.1.1", "", false, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ns, r, err := parseBootstrapServer(tc.server)
+			if tc.wantErr {
+				if !errors.Is(err, errInvalidBootstrapServer) {
+					t.Fatalf("expected invalid bootstrap server error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ns != tc.nameserver {
+				t.Errorf("unexpected nameserver, want: %q, got: %q", tc.nameserver, ns)
+			}
+			if _, isDoH := r.(*dohResolver); isDoH != tc.doh {
+				t.Errorf("unexpected resolver: %T", r)
+			}
+		})
+	}
+}
+
+func TestSetBootstrapServers(t *testing.T) {
+	t.Cleanup(func() { _ = SetBootstrapServers(nil) })
+
+	if err := SetBootstrapServers([]string{"dns.google"}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if currentBootstrapServers() != defaultBootstrapServers {
+		t.Fatal("invalid bootstrap servers must not be used")
+	}
+	if err := SetBootstrapServers([]string{"1.1.1.1", "https://1.1.1.1/dns-query"}); err != nil {
+		t.Fatal(err)
+	}
+	bs := currentBootstrapServers()
+	if len(bs.nameservers) != 1 || bs.nameservers[0] != "1.1.1.1:53" || len(bs.resolvers) != 1 {
+		t.Errorf("unexpected bootstrap servers: %+v", bs)
+	}
+	if !sliceContains(or.Load().nameservers, "1.1.1.1:53") {
+		t.Errorf("os resolver does not use bootstrap servers: %v", or.Load().nameservers)
+	}
+	if want := []string{"1.1.1.1:53", "1.1.1.1:443"}; !reflect.DeepEqual(bs.addrs, want) {
+		t.Errorf("unexpected bootstrap addresses, want: %v, got: %v", want, bs.addrs)
+	}
+
+	uc := &UpstreamConfig{Name: "test", Type: ResolverTypeDOT, Endpoint: "dns.example.com", BootstrapServers: []string{"9.9.9.9"}}
+	uc.Init()
+	if ns := uc.bootstrapServers().nameservers; len(ns) != 1 || ns[0] != "9.9.9.9:53" {
+		t.Errorf("upstream bootstrap servers is not used: %v", ns)
+	}
+	uc = &UpstreamConfig{Name: "test", Type: ResolverTypeDOT, Endpoint: "dns.example.com"}
+	uc.Init()
+	if uc.bootstrapServers() != bs {
+		t.Error("upstream without bootstrap servers must use global ones")
+	}
+}
+
+func TestSetBootstrapServers_netDialer(t *testing.T) {
+	t.Cleanup(func() { _ = SetBootstrapServers(nil) })
+
+	addr := newTestBootstrapServer(t, "127.0.0.2")
+	if err := SetBootstrapServers([]string{addr}); err != nil {
+		t.Fatal(err)
+	}
+	ips, err := ctrldnet.Dialer.Resolver.LookupHost(context.Background(), "upstream.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || ips[0] != "127.0.0.2" {
+		t.Errorf("network dialer does not use bootstrap servers, got: %v", ips)
+	}
+}
+
+func Test_defaultBootstrapServers(t *testing.T) {
+	if !sliceContains(defaultBootstrapServers.nameservers, net.JoinHostPort(defaultBootstrapDNSv6, "53")) {
+		t.Errorf("missing IPv6 bootstrap DNS: %v", defaultBootstrapServers.nameservers)
+	}
+}
+
+func Test_newDialer(t *testing.T) {
+	addr := newTestBootstrapServer(t, "127.0.0.2")
+	tests := []struct {
+		name string
+		bs   *bootstrapServers
+		want string
+	}{
+		{"plain", &bootstrapServers{nameservers: []string{addr}}, "127.0.0.2"},
+		{"resolver", &bootstrapServers{resolvers: []Resolver{staticResolver("127.0.0.3")}}, "127.0.0.3"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			d := newDialer(tc.bs)
+			ips, err := d.Resolver.LookupHost(context.Background(), "upstream.test.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != 1 || ips[0] != tc.want {
+				t.Errorf("unexpected result, want: %s, got: %v", tc.want, ips)
+			}
+		})
+	}
+}
+
+// staticResolver is a Resolver answering A queries with a fixed IP address.
+type staticResolver string
+
+func (s staticResolver) Resolve(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	if msg.Question[0].Qtype == dns.TypeA {
+		rr, err := dns.NewRR(msg.Question[0].Name + " 300 IN A " + string(s))
+		if err != nil {
+			return nil, err
+		}
+		answer.Answer = append(answer.Answer, rr)
+	}
+	return answer, nil
+}
+
+// newTestBootstrapServer starts a plain DNS server answering A queries with given IP address.
+func newTestBootstrapServer(t *testing.T, ip string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			answer, _ := staticResolver(ip).Resolve(context.Background(), m)
+			_ = w.WriteMsg(answer)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
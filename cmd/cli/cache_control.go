@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+// cacheStatsResponse is the response of cacheStatsPath.
+type cacheStatsResponse struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	StaleHits uint64 `json:"stale_hits"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	// MaxBytes is the memory limit of the cache, zero if the cache is not bounded by memory.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// cacheRequest is the request of cacheDumpPath and cacheFlushPath, selecting cache entries.
+// An empty field matches all entries.
+type cacheRequest struct {
+	// Domain is the domain name of entries, "*" could be used for wildcard matching, e.g: "*.example.com".
+	Domain string `json:"domain,omitempty"`
+	// Upstream is the upstream of entries, e.g: "upstream.0" or "0".
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// cacheEntry is an entry in the response of cacheDumpPath.
+type cacheEntry struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Upstream string `json:"upstream"`
+	ECS      string `json:"ecs,omitempty"`
+	// TTL is the remaining TTL in seconds, negative for stale entries.
+	TTL    int64  `json:"ttl"`
+	Rcode  string `json:"rcode"`
+	Hits   uint64 `json:"hits"`
+	DNSSEC string `json:"dnssec,omitempty"`
+}
+
+// cacheFlushResponse is the response of cacheFlushPath.
+type cacheFlushResponse struct {
+	Removed int `json:"removed"`
+}
+
+// match reports whether the cache entry of given key is selected by the request.
+func (r *cacheRequest) match(key dnscache.Key) bool {
+	if r.Upstream != "" && key.Upstream != normalizeUpstream(r.Upstream) {
+		return false
+	}
+	if r.Domain == "" {
+		return true
+	}
+	domain := canonicalName(r.Domain)
+	name := canonicalName(key.Name)
+	if strings.Contains(domain, "*") {
+		return wildcardMatches(domain, name)
+	}
+	return name == domain
+}
+
+// normalizeUpstream returns the upstream name used in cache keys, e.g: "0" => "upstream.0".
+// Full names are returned as-is, including client group names used by per_client_group cache scope.
+func normalizeUpstream(upstream string) string {
+	if strings.Contains(upstream, ".") {
+		return upstream
+	}
+	return upstreamPrefix + upstream
+}
+
+// decodeCacheRequest decodes the cache request in body of r, an empty body selects all entries.
+func (p *prog) decodeCacheRequest(r *http.Request) (*cacheRequest, error) {
+	req := &cacheRequest{}
+	if r.Body == nil {
+		return req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	// Cached answers are not keyed by upstream in shared cache scope.
+	if req.Upstream != "" && p.cfg.Service.CacheScope == ctrld.CacheScopeShared {
+		return nil, errors.New("upstream filter is not supported with shared cache scope")
+	}
+	return req, nil
+}
+
+func (p *prog) cacheStatsHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.cache == nil {
+		http.Error(w, "cache is disabled", http.StatusNotFound)
+		return
+	}
+	stats := &cacheStatsResponse{
+		Hits:      p.cacheStats.hits.Load(),
+		Misses:    p.cacheStats.misses.Load(),
+		StaleHits: p.cacheStats.staleHits.Load(),
+		Entries:   p.cache.Len(),
+		Bytes:     p.cache.Bytes(),
+		MaxBytes:  int64(p.cfg.Service.CacheMaxBytes),
+	}
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (p *prog) cacheDumpHandler(w http.ResponseWriter, r *http.Request) {
+	if p.cache == nil {
+		http.Error(w, "cache is disabled", http.StatusNotFound)
+		return
+	}
+	req, err := p.decodeCacheRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	entries := make([]*cacheEntry, 0)
+	p.cache.Range(func(k dnscache.Key, v *dnscache.Value) bool {
+		if !req.match(k) {
+			return true
+		}
+		e := &cacheEntry{
+			Name:     k.Name,
+			Type:     dns.TypeToString[k.Qtype],
+			Upstream: k.Upstream,
+			ECS:      k.ECS,
+			TTL:      int64(v.Expire.Sub(now) / time.Second),
+			Hits:     v.Hits(),
+			DNSSEC:   v.DNSSEC,
+		}
+		if v.Msg != nil {
+			e.Rcode = dns.RcodeToString[v.Msg.Rcode]
+		}
+		entries = append(entries, e)
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		if entries[i].Type != entries[j].Type {
+			return entries[i].Type < entries[j].Type
+		}
+		return entries[i].Upstream < entries[j].Upstream
+	})
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (p *prog) cacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if p.cache == nil {
+		http.Error(w, "cache is disabled", http.StatusNotFound)
+		return
+	}
+	req, err := p.decodeCacheRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := &cacheFlushResponse{}
+	if req.Domain == "" && req.Upstream == "" {
+		resp.Removed = p.cache.Len()
+		p.cache.Purge()
+	} else {
+		resp.Removed = p.cache.Remove(req.match)
+	}
+	mainLog.Load().Info().Msgf("flushed %d cached responses", resp.Removed)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+func Test_cacheRequest_match(t *testing.T) {
+	key := dnscache.Key{Name: "www.example.com.", Qtype: dns.TypeA, Upstream: "upstream.0"}
+	tests := []struct {
+		name  string
+		req   cacheRequest
+		match bool
+	}{
+		{"all", cacheRequest{}, true},
+		{"domain", cacheRequest{Domain: "www.example.com"}, true},
+		{"domain case insensitive", cacheRequest{Domain: "WWW.Example.com."}, true},
+		{"other domain", cacheRequest{Domain: "example.com"}, false},
+		{"wildcard", cacheRequest{Domain: "*.example.com"}, true},
+		{"other wildcard", cacheRequest{Domain: "*.example.org"}, false},
+		{"upstream", cacheRequest{Upstream: "0"}, true},
+		{"upstream with prefix", cacheRequest{Upstream: "upstream.0"}, true},
+		{"other upstream", cacheRequest{Upstream: "1"}, false},
+		{"domain and other upstream", cacheRequest{Domain: "www.example.com", Upstream: "1"}, false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.match, tc.req.match(key))
+		})
+	}
+}
+
+func Test_prog_cacheHandlers(t *testing.T) {
+	cacher, err := dnscache.NewLRUCache(16)
+	require.NoError(t, err)
+	p := &prog{cfg: &ctrld.Config{}, cache: cacher}
+	for _, name := range []string{"www.example.com.", "api.example.com.", "example.org."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		answer := new(dns.Msg)
+		answer.SetReply(msg)
+		cacher.Add(dnscache.NewKey(msg, "upstream.0"), dnscache.NewValue(answer, time.Now().Add(time.Minute)))
+	}
+	p.cacheStats.hits.Add(3)
+	p.cacheStats.staleHits.Add(1)
+
+	do := func(handler http.HandlerFunc, req *cacheRequest, v any) {
+		t.Helper()
+		buf, err := json.Marshal(req)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(buf)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.NewDecoder(w.Body).Decode(v))
+	}
+
+	var stats cacheStatsResponse
+	do(p.cacheStatsHandler, nil, &stats)
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(1), stats.StaleHits)
+	assert.Equal(t, 3, stats.Entries)
+	assert.Positive(t, stats.Bytes)
+
+	var entries []*cacheEntry
+	do(p.cacheDumpHandler, &cacheRequest{Domain: "*.example.com"}, &entries)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "api.example.com.", entries[0].Name)
+	assert.Equal(t, "A", entries[0].Type)
+	assert.InDelta(t, 60, entries[0].TTL, 1)
+
+	var flushed cacheFlushResponse
+	do(p.cacheFlushHandler, &cacheRequest{Domain: "www.example.com"}, &flushed)
+	assert.Equal(t, 1, flushed.Removed)
+	do(p.cacheFlushHandler, &cacheRequest{}, &flushed)
+	assert.Equal(t, 2, flushed.Removed)
+	assert.Zero(t, cacher.Len())
+}
+
+func Test_prog_cacheHandlers_sharedScope(t *testing.T) {
+	cacher, err := dnscache.NewLRUCache(16)
+	require.NoError(t, err)
+	p := &prog{cfg: &ctrld.Config{Service: ctrld.ServiceConfig{CacheScope: ctrld.CacheScopeShared}}, cache: cacher}
+	for _, handler := range []http.HandlerFunc{p.cacheDumpHandler, p.cacheFlushHandler} {
+		buf, err := json.Marshal(&cacheRequest{Upstream: "upstream.0"})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(buf)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
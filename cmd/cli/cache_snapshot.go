@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+const (
+	ctrldCacheSnapshotFile = "ctrld_cache.json"
+	// defaultCachePersistInterval is how often the cache snapshot is saved if not configured.
+	defaultCachePersistInterval = time.Hour
+)
+
+// cacheSnapshotPath returns the path of cache snapshot file, or empty string if the cache
+// snapshot is not enabled.
+func (p *prog) cacheSnapshotPath() string {
+	if !p.cfg.Service.CachePersist || homedir == "" || p.cache == nil {
+		return ""
+	}
+	return filepath.Join(homedir, ctrldCacheSnapshotFile)
+}
+
+// cacheSnapshotUpstreams returns the identity of upstreams config, so cached answers of
+// upstreams which were changed between restarts are not loaded. With a cache scope other
+// than per_upstream, the identity of the scope covers all upstreams, since their answers
+// are mixed in the cache.
+//
+// The identity also covers settings which change cached answers, like DNSSEC validation
+// and TTL clamping, so answers cached with other settings are not loaded.
+func (p *prog) cacheSnapshotUpstreams() map[string]string {
+	sc := p.cfg.Service
+	settings := fmt.Sprintf("dnssec=%t min_ttl=%d max_ttl=%d negative_max_ttl=%d ttl_override=%d",
+		sc.DNSSEC, sc.CacheMinTTL, sc.CacheMaxTTL, sc.CacheNegativeMaxTTL, sc.CacheTTLOverride)
+	upstreams := map[string]string{upstreamOS: osUpstreamConfig.Type + " " + settings}
+	for n, uc := range p.cfg.Upstream {
+		upstreams[upstreamPrefix+n] = fmt.Sprintf("%s %s ecs=%s/%s %s", uc.Type, uc.Endpoint, uc.ECS, uc.ECSSubnet, settings)
+	}
+	scope := p.cfg.Service.CacheScope
+	if scope == "" || scope == ctrld.CacheScopePerUpstream {
+		return upstreams
+	}
+	ids := make([]string, 0, len(upstreams))
+	for n, id := range upstreams {
+		ids = append(ids, n+"="+id)
+	}
+	sort.Strings(ids)
+	id := scope + " " + strings.Join(ids, ",")
+	if scope != ctrld.CacheScopePerClientGroup {
+		return map[string]string{"": id}
+	}
+	scoped := make(map[string]string)
+	for n, lc := range p.cfg.Listener {
+		if lc.Policy == nil {
+			scoped[clientGroupName(n, "")] = id
+			continue
+		}
+		// Client groups of the listener are routed by its policy.
+		policy := fmt.Sprintf("%v %v", lc.Policy.Networks, lc.Policy.Rules)
+		scoped[clientGroupName(n, "")] = id + " " + policy
+		for _, rule := range lc.Policy.Networks {
+			for network := range rule {
+				var cidrs []string
+				if nc := p.cfg.Network[strings.TrimPrefix(network, "network.")]; nc != nil {
+					cidrs = nc.Cidrs
+				}
+				scoped[clientGroupName(n, network)] = id + " " + policy + " " + strings.Join(cidrs, ",")
+			}
+		}
+	}
+	return scoped
+}
+
+// loadCacheSnapshot loads the cache snapshot saved by previous run, if any.
+func (p *prog) loadCacheSnapshot() {
+	path := p.cacheSnapshotPath()
+	if path == "" {
+		return
+	}
+	n, err := dnscache.LoadSnapshot(p.cache, path, p.cacheSnapshotUpstreams())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			mainLog.Load().Warn().Err(err).Msgf("ignoring invalid cache snapshot file: %s", path)
+		}
+		return
+	}
+	mainLog.Load().Info().Msgf("loaded %d cached responses from snapshot", n)
+}
+
+// saveCacheSnapshot saves the cache to snapshot file.
+func (p *prog) saveCacheSnapshot() {
+	path := p.cacheSnapshotPath()
+	if path == "" {
+		return
+	}
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+	if err := dnscache.SaveSnapshot(p.cache, path, p.cacheSnapshotUpstreams()); err != nil {
+		mainLog.Load().Warn().Err(err).Msg("could not save cache snapshot")
+		return
+	}
+	mainLog.Load().Debug().Msgf("saved cache snapshot: %s", path)
+}
+
+// cacheSnapshotTicker saves the cache snapshot periodically, until the program is stopped.
+func (p *prog) cacheSnapshotTicker() {
+	if p.cacheSnapshotPath() == "" {
+		return
+	}
+	interval := defaultCachePersistInterval
+	if n := p.cfg.Service.CachePersistInterval; n > 0 {
+		interval = time.Duration(n) * time.Second
+	}
+	timer := time.NewTicker(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-timer.C:
+			p.saveCacheSnapshot()
+		}
+	}
+}
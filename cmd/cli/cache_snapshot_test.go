@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_prog_cacheSnapshotUpstreams(t *testing.T) {
+	newProg := func(update func(cfg *ctrld.Config)) *prog {
+		cfg := &ctrld.Config{
+			Upstream: map[string]*ctrld.UpstreamConfig{
+				"0": {Type: ctrld.ResolverTypeDOH, Endpoint: "https://dns.example.com/dns-query"},
+			},
+		}
+		if update != nil {
+			update(cfg)
+		}
+		return &prog{cfg: cfg}
+	}
+	want := newProg(nil).cacheSnapshotUpstreams()
+	assert.Equal(t, want, newProg(nil).cacheSnapshotUpstreams())
+
+	tests := []struct {
+		name   string
+		update func(cfg *ctrld.Config)
+	}{
+		{"dnssec", func(cfg *ctrld.Config) { cfg.Service.DNSSEC = true }},
+		{"ecs", func(cfg *ctrld.Config) { cfg.Upstream["0"].ECS = ctrld.ECSStrip }},
+		{"ecs subnet", func(cfg *ctrld.Config) { cfg.Upstream["0"].ECSSubnet = "203.0.113.0/24" }},
+		{"min ttl", func(cfg *ctrld.Config) { cfg.Service.CacheMinTTL = 60 }},
+		{"max ttl", func(cfg *ctrld.Config) { cfg.Service.CacheMaxTTL = 3600 }},
+		{"negative max ttl", func(cfg *ctrld.Config) { cfg.Service.CacheNegativeMaxTTL = 60 }},
+		{"ttl override", func(cfg *ctrld.Config) { cfg.Service.CacheTTLOverride = 300 }},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got := newProg(tc.update).cacheSnapshotUpstreams()
+			assert.NotEqual(t, want[upstreamPrefix+"0"], got[upstreamPrefix+"0"])
+		})
+	}
+}
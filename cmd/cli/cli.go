@@ -663,6 +663,163 @@ NOTE: Uninstalling will set DNS to values provided by DHCP.`,
 	}
 	clientsCmd.AddCommand(listClientsCmd)
 	rootCmd.AddCommand(clientsCmd)
+
+	cacheStatsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show DNS cache statistics",
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			resp := postCacheRequest(cacheStatsPath, nil)
+			defer resp.Body.Close()
+
+			var stats cacheStatsResponse
+			if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to decode cache stats result")
+			}
+			memory := formatBytes(stats.Bytes)
+			if stats.MaxBytes > 0 {
+				memory += " / " + formatBytes(stats.MaxBytes)
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Hits", "Misses", "Stale hits", "Entries", "Memory"})
+			table.SetAutoFormatHeaders(false)
+			table.Append([]string{
+				strconv.FormatUint(stats.Hits, 10),
+				strconv.FormatUint(stats.Misses, 10),
+				strconv.FormatUint(stats.StaleHits, 10),
+				strconv.Itoa(stats.Entries),
+				memory,
+			})
+			table.Render()
+		},
+	}
+	cacheDumpCmd := &cobra.Command{
+		Use:   "dump [domain]",
+		Short: "List cached DNS responses",
+		Long: `List cached DNS responses, optionally of given domain only.
+
+The domain could contain "*" for wildcard matching, e.g: "*.example.com".`,
+		Args: cobra.MaximumNArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			resp := postCacheRequest(cacheDumpPath, newCacheRequest(args))
+			defer resp.Body.Close()
+
+			var entries []*cacheEntry
+			if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to decode cache dump result")
+			}
+			data := make([][]string, len(entries))
+			for i, e := range entries {
+				ttl := strconv.FormatInt(e.TTL, 10)
+				if e.TTL <= 0 {
+					ttl = "stale"
+				}
+				data[i] = []string{e.Name, e.Type, e.Upstream, e.ECS, ttl, e.Rcode, strconv.FormatUint(e.Hits, 10)}
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Name", "Type", "Upstream", "ECS", "TTL", "Rcode", "Hits"})
+			table.SetAutoFormatHeaders(false)
+			table.AppendBulk(data)
+			table.Render()
+		},
+	}
+	cacheDumpCmd.Flags().StringVarP(&cacheUpstream, "upstream", "", "", `Only list responses of given upstream, e.g: "0" or "upstream.0", or client group with per_client_group cache scope, e.g: "listener.0/network.1"`)
+	cacheFlushCmd := &cobra.Command{
+		Use:   "flush [domain]",
+		Short: "Remove cached DNS responses",
+		Long: `Remove cached DNS responses, optionally of given domain or upstream only.
+
+The domain could contain "*" for wildcard matching, e.g: "*.example.com".
+Without domain and upstream, the whole cache is flushed.`,
+		Args: cobra.MaximumNArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			resp := postCacheRequest(cacheFlushPath, newCacheRequest(args))
+			defer resp.Body.Close()
+
+			var res cacheFlushResponse
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to decode cache flush result")
+			}
+			mainLog.Load().Notice().Msgf("removed %d cached responses", res.Removed)
+		},
+	}
+	cacheFlushCmd.Flags().StringVarP(&cacheUpstream, "upstream", "", "", `Only remove responses of given upstream, e.g: "0" or "upstream.0", or client group with per_client_group cache scope, e.g: "listener.0/network.1"`)
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage DNS cache",
+		Args:  cobra.OnlyValidArgs,
+		ValidArgs: []string{
+			cacheStatsCmd.Use,
+			cacheDumpCmd.Use,
+			cacheFlushCmd.Use,
+		},
+	}
+	cacheCmd.AddCommand(cacheStatsCmd)
+	cacheCmd.AddCommand(cacheDumpCmd)
+	cacheCmd.AddCommand(cacheFlushCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
+
+// newCacheRequest returns the cache request of cache commands arguments and flags.
+func newCacheRequest(args []string) *cacheRequest {
+	req := &cacheRequest{Upstream: cacheUpstream}
+	if len(args) > 0 {
+		req.Domain = args[0]
+	}
+	return req
+}
+
+// postCacheRequest sends the cache request to given control server path, exiting on failure.
+func postCacheRequest(path string, req *cacheRequest) *http.Response {
+	dir, err := userHomeDir()
+	if err != nil {
+		mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+	}
+	var body io.Reader
+	if req != nil {
+		buf, err := json.Marshal(req)
+		if err != nil {
+			mainLog.Load().Fatal().Err(err).Msg("failed to encode cache request")
+		}
+		body = bytes.NewReader(buf)
+	}
+	cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+	resp, err := cc.post(path, body)
+	if err != nil {
+		mainLog.Load().Fatal().Err(err).Msg("failed to send cache request")
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		mainLog.Load().Fatal().Msgf("cache request failed: %s", strings.TrimSpace(string(msg)))
+	}
+	return resp
+}
+
+// formatBytes returns n bytes in human readable form.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 // isMobile reports whether the current OS is a mobile platform.
@@ -749,6 +906,7 @@ func run(appCallback *AppCallback, stopCh chan struct{}) {
 	// Log config do not have thing to validate, so it's safe to init log here,
 	// so it's able to log information in processCDFlags.
 	initLogging()
+	setBootstrapServers()
 
 	mainLog.Load().Info().Msgf("starting ctrld %s", curVersion())
 	mainLog.Load().Info().Msgf("os: %s", osVersion())
@@ -788,6 +946,7 @@ func run(appCallback *AppCallback, stopCh chan struct{}) {
 
 	if cdUID != "" {
 		processLogAndCacheFlags()
+		setBootstrapServers()
 	}
 
 	if updated {
@@ -1146,6 +1305,14 @@ func processLogAndCacheFlags() {
 	v.Set("service", cfg.Service)
 }
 
+// setBootstrapServers configures the bootstrap servers used for resolving upstreams
+// and Control D API domain. The default bootstrap DNS is kept if the config is invalid.
+func setBootstrapServers() {
+	if err := ctrld.SetBootstrapServers(cfg.Service.BootstrapServers); err != nil {
+		mainLog.Load().Error().Err(err).Msg("invalid bootstrap servers, using default bootstrap DNS")
+	}
+}
+
 func netInterface(ifaceName string) (*net.Interface, error) {
 	if ifaceName == "auto" {
 		ifaceName = defaultIfaceName()
@@ -1432,10 +1599,16 @@ func fieldErrorMsg(fe validator.FieldError) string {
 		return fmt.Sprintf("minimum len: %q", fe.Param())
 	case "gte":
 		return fmt.Sprintf("must be greater than or equal to: %s", fe.Param())
+	case "lte":
+		return fmt.Sprintf("must be less than or equal to: %s", fe.Param())
+	case "gtefield":
+		return fmt.Sprintf("must be greater than or equal to: %s", fe.Param())
 	case "cidr":
 		return fmt.Sprintf("invalid value: %s", fe.Value())
 	case "required_unless", "required":
 		return "value is required"
+	case "required_with":
+		return fmt.Sprintf("value is required with: %s", fe.Param())
 	case "dnsrcode":
 		return fmt.Sprintf("invalid DNS rcode value: %s", fe.Value())
 	case "ipstack":
@@ -1447,6 +1620,28 @@ func fieldErrorMsg(fe validator.FieldError) string {
 		return fmt.Sprintf("filed does not exist: %s", fe.Value())
 	case "http_url":
 		return fmt.Sprintf("invalid http/https url: %s", fe.Value())
+	case "bootstrapserver":
+		return fmt.Sprintf("invalid bootstrap server, must be an IP address or a DoH endpoint with IP address: %s", fe.Value())
+	case "upstreamproxy":
+		return fmt.Sprintf("invalid proxy, must be a socks5, socks5h or http URL: %s", fe.Value())
+	case "proxy_type":
+		return fmt.Sprintf("proxy is not supported for upstream type: %s", fe.Param())
+	case "ecssubnet":
+		return fmt.Sprintf("invalid ECS subnet, must be an IP address or CIDR: %s", fe.Value())
+	case "dnssectrustanchor":
+		return fmt.Sprintf("invalid DNSSEC trust anchor, must be a DS record: %s", fe.Value())
+	case "dnsname":
+		return fmt.Sprintf("invalid domain name: %s", fe.Value())
+	case "hostname_port":
+		return fmt.Sprintf("invalid address, must be in host:port format: %s", fe.Value())
+	case "protocol_type":
+		return fmt.Sprintf("protocol is not supported for upstream type: %s", fe.Param())
+	case "sdns_stamp":
+		return fmt.Sprintf("invalid DNS stamp for upstream type %s: %s", fe.Param(), fe.Value())
+	case "spkipin":
+		return fmt.Sprintf("invalid SPKI pin, must be base64 encoded SHA-256 hash: %s", fe.Value())
+	case "client_info_header":
+		return fmt.Sprintf("header %q is controlled by send_client_info", fe.Param())
 	}
 	return ""
 }
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+// coalesceKey returns the key of in-flight queries to given upstream, so identical queries
+// share a single upstream query. Queries are identical if they have the same cache key,
+// the same DNSSEC related flags, and the same client info when it is sent to the upstream.
+func coalesceKey(upstream string, msg *dns.Msg, ci *ctrld.ClientInfo) string {
+	k := dnscache.NewKey(msg, upstream)
+	var b strings.Builder
+	b.WriteString(k.Upstream)
+	b.WriteByte('|')
+	b.WriteString(k.Name)
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(k.Qtype)))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(k.Qclass)))
+	b.WriteByte('|')
+	b.WriteString(k.ECS)
+	b.WriteByte('|')
+	b.WriteString(strconv.FormatBool(msg.CheckingDisabled))
+	b.WriteByte('|')
+	b.WriteString(strconv.FormatBool(msg.RecursionDesired))
+	b.WriteByte('|')
+	opt := msg.IsEdns0()
+	b.WriteString(strconv.FormatBool(opt != nil && opt.Do()))
+	if ci != nil {
+		b.WriteByte('|')
+		b.WriteString(ci.Mac)
+		b.WriteByte('|')
+		b.WriteString(ci.IP)
+		b.WriteByte('|')
+		b.WriteString(ci.Hostname)
+		b.WriteByte('|')
+		b.WriteString(strconv.FormatBool(ci.Self))
+	}
+	return b.String()
+}
+
+// sharedAnswer returns a copy of answer shared by coalesced queries, adjusted for msg.
+func sharedAnswer(answer, msg *dns.Msg) *dns.Msg {
+	answer = answer.Copy()
+	answer.Id = msg.Id
+	// The question name case may differ between coalesced queries.
+	answer.Question = append([]dns.Question(nil), msg.Question...)
+	return answer
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_coalesceKey(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	upper := msg.Copy()
+	upper.Id = msg.Id + 1
+	upper.Question[0].Name = "EXAMPLE.com."
+	do := msg.Copy()
+	do.SetEdns0(dns.DefaultMsgSize, true)
+	ci := &ctrld.ClientInfo{Mac: "4c:20:b8:ab:87:1b", IP: "192.168.1.10", Hostname: "tv"}
+
+	key := coalesceKey("upstream.0", msg, nil)
+	assert.Equal(t, key, coalesceKey("upstream.0", upper, nil))
+	assert.NotEqual(t, key, coalesceKey("upstream.1", msg, nil))
+	assert.NotEqual(t, key, coalesceKey("upstream.0", do, nil))
+	assert.NotEqual(t, key, coalesceKey("upstream.0", msg, ci))
+	assert.NotEqual(t, coalesceKey("upstream.0", msg, ci), coalesceKey("upstream.0", msg, &ctrld.ClientInfo{Mac: ci.Mac, IP: "192.168.1.11"}))
+}
+
+func Test_prog_proxyCoalesce(t *testing.T) {
+	var queries atomic.Int32
+	seen := make(chan struct{})
+	release := make(chan struct{})
+	uc := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		// Hold the first query until the other callers have joined it.
+		if queries.Add(1) == 1 {
+			close(seen)
+		}
+		<-release
+		_ = w.WriteMsg(testAnswer(req))
+	})
+	// The cache is disabled, coalescing must still work.
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{"0": uc}}
+	p := &prog{cfg: cfg, um: newUpstreamMonitor(cfg)}
+
+	const n = 20
+	var wg sync.WaitGroup
+	query := func(i int) {
+		defer wg.Done()
+		msg := new(dns.Msg)
+		name := "example.com."
+		if i%2 == 0 {
+			name = strings.ToUpper(name)
+		}
+		msg.SetQuestion(name, dns.TypeA)
+		answer := p.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil, "").answer
+		assert.Equal(t, msg.Id, answer.Id)
+		assert.Equal(t, name, answer.Question[0].Name)
+		assert.Len(t, answer.Answer, 1)
+	}
+	wg.Add(n)
+	go query(0)
+	<-seen
+	for i := 1; i < n; i++ {
+		go query(i)
+	}
+	waitInflight(t, n)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), queries.Load())
+}
+
+// waitInflight waits until n goroutines are inside singleflight.Group.Do, either running
+// or waiting on the in-flight call.
+func waitInflight(t *testing.T, n int) {
+	t.Helper()
+	buf := make([]byte, 1<<20)
+	assert.Eventually(t, func() bool {
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return strings.Count(stacks, "singleflight.(*Group).Do(") >= n
+	}, 5*time.Second, time.Millisecond)
+}
@@ -14,6 +14,9 @@ const (
 	contentTypeJson = "application/json"
 	listClientsPath = "/clients"
 	startedPath     = "/started"
+	cacheStatsPath  = "/cache/stats"
+	cacheDumpPath   = "/cache/dump"
+	cacheFlushPath  = "/cache/flush"
 )
 
 type controlServer struct {
@@ -75,6 +78,9 @@ func (p *prog) registerControlServerHandler() {
 			w.WriteHeader(http.StatusRequestTimeout)
 		}
 	}))
+	p.cs.register(cacheStatsPath, http.HandlerFunc(p.cacheStatsHandler))
+	p.cs.register(cacheDumpPath, http.HandlerFunc(p.cacheDumpHandler))
+	p.cs.register(cacheFlushPath, http.HandlerFunc(p.cacheFlushHandler))
 }
 
 func jsonResponse(next http.Handler) http.Handler {
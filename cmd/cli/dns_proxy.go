@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -24,7 +25,16 @@ import (
 )
 
 const (
-	staleTTL = 60 * time.Second
+	// staleTTL is the TTL of stale answers, as recommended by RFC 8767.
+	staleTTL = 30 * time.Second
+	// defaultCacheMaxStale is the default period after expiration, in seconds, during which
+	// cached answers could be served stale.
+	defaultCacheMaxStale = 3 * 24 * 3600
+	// defaultCacheStaleAnswerTimeout is the default client response timer of serve-stale,
+	// in milliseconds, as recommended by RFC 8767.
+	defaultCacheStaleAnswerTimeout = 1800
+	// defaultCacheNegativeMaxTTL is the default maximum TTL of cached negative answers, in seconds.
+	defaultCacheNegativeMaxTTL = 3600
 	// EDNS0_OPTION_MAC is dnsmasq EDNS0 code for adding mac option.
 	// https://thekelleys.org.uk/gitweb/?p=dnsmasq.git;a=blob;f=src/dns-protocol.h;h=76ac66a8c28317e9c121a74ab5fd0e20f6237dc8;hb=HEAD#l81
 	// This is also dns.EDNS0LOCALSTART, but define our own constant here for clarification.
@@ -37,6 +47,14 @@ var osUpstreamConfig = &ctrld.UpstreamConfig{
 	Timeout: 2000,
 }
 
+// cacheStats counts cache lookups of queries. Stale hits are lookups without fresh entry
+// answered with stale data, so they are counted as misses too.
+type cacheStats struct {
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	staleHits atomic.Uint64
+}
+
 func (p *prog) serveDNS(listenerNum string) error {
 	listenerConfig := p.cfg.Listener[listenerNum]
 	// make sure ip is allocated
@@ -62,19 +80,39 @@ func (p *prog) serveDNS(listenerNum string) error {
 		t := time.Now()
 		ctx := context.WithValue(context.Background(), ctrld.ReqIdCtxKey{}, reqId)
 		ctrld.Log(ctx, mainLog.Load().Debug(), "%s received query: %s %s", fmtSrcToDest, dns.TypeToString[q.Qtype], domain)
-		upstreams, matched := p.upstreamFor(ctx, listenerNum, listenerConfig, remoteAddr, domain)
+		ufr := p.upstreamFor(ctx, listenerNum, listenerConfig, remoteAddr, domain)
 		var answer *dns.Msg
-		if !matched && listenerConfig.Restricted {
+		pr := &proxyResponse{}
+		if !ufr.matched && listenerConfig.Restricted {
 			answer = new(dns.Msg)
 			answer.SetRcode(m, dns.RcodeRefused)
 		} else {
-			answer = p.proxy(ctx, upstreams, failoverRcodes, m, ci)
+			pr = p.proxy(ctx, ufr.upstreams, failoverRcodes, m, ci, p.clientGroup(listenerNum, listenerConfig, remoteAddr))
+			answer = pr.answer
 			rtt := time.Since(t)
 			ctrld.Log(ctx, mainLog.Load().Debug(), "received response of %d bytes in %s", answer.Len(), rtt)
 		}
 		if err := w.WriteMsg(answer); err != nil {
 			ctrld.Log(ctx, mainLog.Load().Error().Err(err), "serveUDP: failed to send DNS response to client")
 		}
+		p.metrics.observeQuery(listenerNum, q.Qtype, answer.Rcode)
+		if p.queryLog != nil {
+			p.queryLog.log(&queryLogEntry{
+				Time:           t,
+				ClientIP:       ci.IP,
+				ClientMac:      ci.Mac,
+				ClientHostname: ci.Hostname,
+				Listener:       listenerNum,
+				Qname:          domain,
+				Qtype:          dns.Type(q.Qtype).String(),
+				Policy:         ufr.policy,
+				Network:        ufr.network,
+				Rule:           ufr.rule,
+				Upstream:       pr.upstream,
+				LatencyMs:      float64(time.Since(t).Microseconds()) / 1000,
+				Cache:          pr.cache,
+			}, answer)
+		}
 	})
 
 	g, ctx := errgroup.WithContext(context.Background())
@@ -139,41 +177,107 @@ func (p *prog) serveDNS(listenerNum string) error {
 	return g.Wait()
 }
 
+// upstreamForResult is the result of matching a query against the listener policy.
+type upstreamForResult struct {
+	upstreams []string
+	// matched reports whether the query matches the policy.
+	matched bool
+	// policy, network and rule are the matched policy name, network and rule, if any.
+	policy  string
+	network string
+	rule    string
+}
+
 // upstreamFor returns the list of upstreams for resolving the given domain,
-// matching by policies defined in the listener config. The second return value
-// reports whether the domain matches the policy.
+// matching by policies defined in the listener config.
 //
 // Though domain policy has higher priority than network policy, it is still
 // processed later, because policy logging want to know whether a network rule
 // is disregarded in favor of the domain level rule.
-func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *ctrld.ListenerConfig, addr net.Addr, domain string) ([]string, bool) {
-	upstreams := []string{upstreamPrefix + defaultUpstreamNum}
+func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *ctrld.ListenerConfig, addr net.Addr, domain string) *upstreamForResult {
+	res := &upstreamForResult{upstreams: []string{upstreamPrefix + defaultUpstreamNum}}
 	matchedPolicy := "no policy"
 	matchedNetwork := "no network"
 	matchedRule := "no rule"
-	matched := false
 
 	defer func() {
-		if !matched && lc.Restricted {
+		if !res.matched && lc.Restricted {
 			ctrld.Log(ctx, mainLog.Load().Info(), "query refused, %s does not match any network policy", addr.String())
 			return
 		}
-		if matched {
-			ctrld.Log(ctx, mainLog.Load().Info(), "%s, %s, %s -> %v", matchedPolicy, matchedNetwork, matchedRule, upstreams)
+		if res.matched {
+			ctrld.Log(ctx, mainLog.Load().Info(), "%s, %s, %s -> %v", matchedPolicy, matchedNetwork, matchedRule, res.upstreams)
 		} else {
-			ctrld.Log(ctx, mainLog.Load().Info(), "no explicit policy matched, using default routing -> %v", upstreams)
+			ctrld.Log(ctx, mainLog.Load().Info(), "no explicit policy matched, using default routing -> %v", res.upstreams)
 		}
 	}()
 
 	if lc.Policy == nil {
-		return upstreams, false
+		return res
 	}
 
 	do := func(policyUpstreams []string) {
-		upstreams = append([]string(nil), policyUpstreams...)
+		res.upstreams = append([]string(nil), policyUpstreams...)
 	}
 
-	var networkTargets []string
+	network, networkTargets := p.networkFor(lc, addr)
+	if network != "" {
+		matchedPolicy = lc.Policy.Name
+		matchedNetwork = network
+		res.policy = lc.Policy.Name
+		res.network = network
+		res.matched = true
+	}
+
+	for _, rule := range lc.Policy.Rules {
+		// There's only one entry per rule, config validation ensures this.
+		for source, targets := range rule {
+			if source == domain || wildcardMatches(source, domain) {
+				matchedPolicy = lc.Policy.Name
+				if len(networkTargets) > 0 {
+					matchedNetwork += " (unenforced)"
+				}
+				matchedRule = source
+				res.policy = lc.Policy.Name
+				res.rule = source
+				do(targets)
+				res.matched = true
+				return res
+			}
+		}
+	}
+
+	if res.matched {
+		do(networkTargets)
+	}
+
+	return res
+}
+
+// clientGroup returns the client group of addr, used as the cache scope. Clients of different
+// listeners are in different groups, since listeners could route the same network differently.
+func (p *prog) clientGroup(listenerNum string, lc *ctrld.ListenerConfig, addr net.Addr) string {
+	if p.cache == nil || p.cfg.Service.CacheScope != ctrld.CacheScopePerClientGroup {
+		return ""
+	}
+	network, _ := p.networkFor(lc, addr)
+	return clientGroupName(listenerNum, network)
+}
+
+// clientGroupName returns the name of the client group of given listener and network, e.g:
+// "listener.0/network.1", or "listener.0" for clients outside any network of the listener policy.
+func clientGroupName(listenerNum, network string) string {
+	if network == "" {
+		return "listener." + listenerNum
+	}
+	return "listener." + listenerNum + "/" + network
+}
+
+// networkFor returns the first network in the policy of lc which contains addr, and its upstreams.
+func (p *prog) networkFor(lc *ctrld.ListenerConfig, addr net.Addr) (string, []string) {
+	if lc.Policy == nil {
+		return "", nil
+	}
 	var sourceIP net.IP
 	switch addr := addr.(type) {
 	case *net.UDPAddr:
@@ -181,8 +285,6 @@ func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *c
 	case *net.TCPAddr:
 		sourceIP = addr.IP
 	}
-
-networkRules:
 	for _, rule := range lc.Policy.Networks {
 		for source, targets := range rule {
 			networkNum := strings.TrimPrefix(source, "network.")
@@ -192,64 +294,81 @@ networkRules:
 			}
 			for _, ipNet := range nc.IPNets {
 				if ipNet.Contains(sourceIP) {
-					matchedPolicy = lc.Policy.Name
-					matchedNetwork = source
-					networkTargets = targets
-					matched = true
-					break networkRules
-				}
-			}
-		}
-	}
-
-	for _, rule := range lc.Policy.Rules {
-		// There's only one entry per rule, config validation ensures this.
-		for source, targets := range rule {
-			if source == domain || wildcardMatches(source, domain) {
-				matchedPolicy = lc.Policy.Name
-				if len(networkTargets) > 0 {
-					matchedNetwork += " (unenforced)"
+					return source, targets
 				}
-				matchedRule = source
-				do(targets)
-				matched = true
-				return upstreams, matched
 			}
 		}
 	}
+	return "", nil
+}
 
-	if matched {
-		do(networkTargets)
-	}
+// Cache status of answers, see proxyResponse.
+const (
+	cacheStatusHit   = "hit"
+	cacheStatusStale = "stale"
+	cacheStatusMiss  = "miss"
+)
 
-	return upstreams, matched
+// proxyResponse is the result of proxying a query.
+type proxyResponse struct {
+	answer *dns.Msg
+	// upstream is the upstream which answered, or empty if all upstreams failed.
+	upstream string
+	// cache is the cache status of the answer, or empty if the query is not cacheable.
+	cache string
 }
 
-func (p *prog) proxy(ctx context.Context, upstreams []string, failoverRcodes []int, msg *dns.Msg, ci *ctrld.ClientInfo) *dns.Msg {
+// proxy resolves msg using upstreams. The clientGroup is the network of the client, used
+// as the cache scope with per_client_group cache scope.
+func (p *prog) proxy(ctx context.Context, upstreams []string, failoverRcodes []int, msg *dns.Msg, ci *ctrld.ClientInfo, clientGroup string) *proxyResponse {
 	var staleAnswer *dns.Msg
+	var staleUpstream string
+	cacheStatus := ""
 	serveStaleCache := p.cache != nil && p.cfg.Service.CacheServeStale
+	// Inverse query should not be cached: https://www.rfc-editor.org/rfc/rfc1035#section-7.4
+	cacheable := p.cache != nil && msg.Question[0].Qtype != dns.TypePTR
 	upstreamConfigs := p.upstreamConfigsFromUpstreamNumbers(upstreams)
 	if len(upstreamConfigs) == 0 {
 		upstreamConfigs = []*ctrld.UpstreamConfig{osUpstreamConfig}
 		upstreams = []string{upstreamOS}
 	}
-	// Inverse query should not be cached: https://www.rfc-editor.org/rfc/rfc1035#section-7.4
-	if p.cache != nil && msg.Question[0].Qtype != dns.TypePTR {
-		for _, upstream := range upstreams {
-			cachedValue := p.cache.Get(dnscache.NewKey(msg, upstream))
+	if cacheable {
+		for n, upstream := range upstreams {
+			upstreamMsg := p.upstreamQuery(upstreamConfigs[n], msg)
+			key := p.cacheKey(upstreamMsg, upstream, clientGroup)
+			cachedKey, cachedValue := p.cacheLookup(key)
 			if cachedValue == nil {
 				continue
 			}
-			answer := cachedValue.Msg.Copy()
+			answer := p.clientAnswer(cachedValue.Msg.Copy(), msg, upstreamMsg, cachedValue.DNSSEC)
+			if cachedKey.ECS != key.ECS {
+				// The answer was cached for another client within its scope.
+				ctrld.RestoreECS(answer, msg)
+			}
 			answer.SetRcode(msg, answer.Rcode)
+			// The answer may come from another upstream with cache scopes shared by upstreams.
+			source, sourceConfig := p.cacheSource(cachedValue, upstream, upstreamConfigs[n])
 			now := time.Now()
 			if cachedValue.Expire.After(now) {
 				ctrld.Log(ctx, mainLog.Load().Debug(), "hit cached response")
+				p.cacheStats.hits.Add(1)
 				setCachedAnswerTTL(answer, now, cachedValue.Expire)
-				return answer
+				sourceKey, sourceMsg := key, upstreamMsg
+				if source != upstream {
+					sourceMsg = p.upstreamQuery(sourceConfig, msg)
+					sourceKey = p.cacheKey(sourceMsg, source, clientGroup)
+				}
+				p.prefetch(ctx, sourceConfig, source, cachedKey, sourceKey, sourceMsg, cachedValue, now)
+				return &proxyResponse{answer: answer, upstream: source, cache: cacheStatusHit}
+			}
+			// Prefer the stale answer of the first upstream, like fresh answers.
+			if serveStaleCache && staleAnswer == nil && p.withinMaxStale(cachedValue, now) {
+				staleAnswer = answer
+				staleUpstream = source
 			}
-			staleAnswer = answer
 		}
+		p.cacheStats.misses.Add(1)
+		cacheStatus = cacheStatusMiss
 	}
 	resolve1 := func(n int, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) (*dns.Msg, error) {
 		ctrld.Log(ctx, mainLog.Load().Debug(), "sending query to %s: %s", upstreams[n], upstreamConfig.Name)
@@ -265,75 +384,253 @@ func (p *prog) proxy(ctx context.Context, upstreams []string, failoverRcodes []i
 			defer cancel()
 			resolveCtx = timeoutCtx
 		}
-		return dnsResolver.Resolve(resolveCtx, msg)
+		start := time.Now()
+		answer, err := dnsResolver.Resolve(resolveCtx, msg)
+		p.metrics.observeUpstream(upstreams[n], time.Since(start), err)
+		return answer, err
 	}
 	resolve := func(n int, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) *dns.Msg {
+		var sentCi *ctrld.ClientInfo
 		if upstreamConfig.UpstreamSendClientInfo() && ci != nil {
 			ctrld.Log(ctx, mainLog.Load().Debug(), "including client info with the request")
 			ctx = context.WithValue(ctx, ctrld.ClientInfoCtxKey{}, ci)
+			sentCi = ci
 		}
-		answer, err := resolve1(n, upstreamConfig, msg)
-		if err != nil {
-			ctrld.Log(ctx, mainLog.Load().Error().Err(err), "failed to resolve query")
-			if errNetworkError(err) {
-				p.um.increaseFailureCount(upstreams[n])
-				if p.um.isDown(upstreams[n]) {
-					go p.um.checkUpstream(upstreams[n], upstreamConfig)
+		// Identical in-flight queries share a single upstream query.
+		v, _, shared := p.inflight.Do(coalesceKey(upstreams[n], msg, sentCi), func() (any, error) {
+			answer, err := resolve1(n, upstreamConfig, msg)
+			if err != nil {
+				ctrld.Log(ctx, mainLog.Load().Error().Err(err), "failed to resolve query")
+				if errNetworkError(err) {
+					p.um.increaseFailureCount(upstreams[n])
+					if p.um.isDown(upstreams[n]) {
+						go p.um.checkUpstream(upstreams[n], upstreamConfig)
+					}
 				}
+				return nil, err
 			}
+			return answer, nil
+		})
+		answer, _ := v.(*dns.Msg)
+		if answer == nil {
 			return nil
 		}
+		if shared {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "sharing answer of in-flight query")
+			answer = sharedAnswer(answer, msg)
+		}
 		return answer
 	}
-	for n, upstreamConfig := range upstreamConfigs {
+	// resolveUpstream resolves msg using the upstream at index n, returning nil if it fails.
+	resolveUpstream := func(n int, upstreamConfig *ctrld.UpstreamConfig) *dns.Msg {
 		if upstreamConfig == nil {
-			continue
+			return nil
 		}
 		if p.isLoop(upstreamConfig) {
 			mainLog.Load().Warn().Msgf("dns loop detected, upstream: %q, endpoint: %q", upstreamConfig.Name, upstreamConfig.Endpoint)
-			continue
+			return nil
 		}
 		if p.um.isDown(upstreams[n]) {
 			ctrld.Log(ctx, mainLog.Load().Warn(), "%s is down", upstreams[n])
-			continue
+			return nil
 		}
-		answer := resolve(n, upstreamConfig, msg)
+		upstreamMsg := p.upstreamQuery(upstreamConfig, msg)
+		answer := resolve(n, upstreamConfig, upstreamMsg)
 		if answer == nil {
-			if serveStaleCache && staleAnswer != nil {
-				ctrld.Log(ctx, mainLog.Load().Debug(), "serving stale cached response")
-				now := time.Now()
-				setCachedAnswerTTL(staleAnswer, now, now.Add(staleTTL))
-				return staleAnswer
-			}
-			continue
+			return nil
 		}
 		if answer.Rcode != dns.RcodeSuccess && len(upstreamConfigs) > 1 && containRcode(failoverRcodes, answer.Rcode) {
 			ctrld.Log(ctx, mainLog.Load().Debug(), "failover rcode matched, process to next upstream")
-			continue
+			return nil
 		}
 
 		// set compression, as it is not set by default when unpacking
 		answer.Compress = true
 
-		if p.cache != nil {
-			ttl := ttlFromMsg(answer)
-			now := time.Now()
-			expired := now.Add(time.Duration(ttl) * time.Second)
-			if cachedTTL := p.cfg.Service.CacheTTLOverride; cachedTTL > 0 {
-				expired = now.Add(time.Duration(cachedTTL) * time.Second)
+		dnssecResult := ""
+		if p.dnssec != nil {
+			dnssecResult = p.validateDNSSEC(ctx, upstreamConfig, upstreamMsg, answer)
+		}
+		p.cacheAnswer(ctx, p.cacheKey(upstreamMsg, upstreams[n], clientGroup), upstreams[n], answer, dnssecResult)
+		if upstreamMsg != msg {
+			// The cached answer is shared by clients, adjust it on a copy.
+			answer = p.clientAnswer(answer.Copy(), msg, upstreamMsg, dnssecResult)
+		}
+		return answer
+	}
+	resolveUpstreams := func() *proxyResponse {
+		for n, upstreamConfig := range upstreamConfigs {
+			if answer := resolveUpstream(n, upstreamConfig); answer != nil {
+				return &proxyResponse{answer: answer, upstream: upstreams[n], cache: cacheStatus}
 			}
-			setCachedAnswerTTL(answer, now, expired)
-			p.cache.Add(dnscache.NewKey(msg, upstreams[n]), dnscache.NewValue(answer, expired))
-			ctrld.Log(ctx, mainLog.Load().Debug(), "add cached response")
 		}
+		ctrld.Log(ctx, mainLog.Load().Error(), "all %v endpoints failed", upstreams)
+		return nil
+	}
+	if staleAnswer == nil {
+		if res := resolveUpstreams(); res != nil {
+			return res
+		}
+		answer := new(dns.Msg)
+		answer.SetRcode(msg, dns.RcodeServerFailure)
+		return &proxyResponse{answer: answer, cache: cacheStatus}
+	}
+	// Serve-stale: https://www.rfc-editor.org/rfc/rfc8767
+	//
+	// The stale answer is served if upstreams fail, or do not answer within the client response
+	// timer. In the latter case, upstreams resolution continues in background, refreshing the cache.
+	staleCtx := ctx // ctx may be updated by resolveUpstreams.
+	answerCh := make(chan *proxyResponse, 1)
+	go func() { answerCh <- resolveUpstreams() }()
+	timer := time.NewTimer(p.staleAnswerTimeout())
+	defer timer.Stop()
+	select {
+	case res := <-answerCh:
+		if res != nil {
+			return res
+		}
+		ctrld.Log(staleCtx, mainLog.Load().Debug(), "serving stale cached response")
+	case <-timer.C:
+		ctrld.Log(staleCtx, mainLog.Load().Debug(), "upstreams are slow, serving stale cached response")
+	}
+	p.cacheStats.staleHits.Add(1)
+	now := time.Now()
+	setCachedAnswerTTL(staleAnswer, now, now.Add(staleTTL))
+	return &proxyResponse{answer: staleAnswer, upstream: staleUpstream, cache: cacheStatusStale}
+}
+
+// withinMaxStale reports whether the expired cache value could still be served stale at now.
+func (p *prog) withinMaxStale(value *dnscache.Value, now time.Time) bool {
+	maxStale := defaultCacheMaxStale
+	if n := p.cfg.Service.CacheMaxStale; n > 0 {
+		maxStale = n
+	}
+	return now.Before(value.Expire.Add(time.Duration(maxStale) * time.Second))
+}
+
+// staleAnswerTimeout returns how long to wait for upstreams before answering with stale data.
+func (p *prog) staleAnswerTimeout() time.Duration {
+	timeout := defaultCacheStaleAnswerTimeout
+	if n := p.cfg.Service.CacheStaleAnswerTimeout; n > 0 {
+		timeout = n
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// cacheKey returns the cache key of msg, sent to given upstream for a client in given group,
+// according to the cache scope.
+func (p *prog) cacheKey(msg *dns.Msg, upstream, clientGroup string) dnscache.Key {
+	switch p.cfg.Service.CacheScope {
+	case ctrld.CacheScopeShared:
+		return dnscache.NewKey(msg, "")
+	case ctrld.CacheScopePerClientGroup:
+		return dnscache.NewKey(msg, clientGroup)
+	}
+	return dnscache.NewKey(msg, upstream)
+}
+
+// cacheLookup returns the cached answer of the query with given key, and the key it was cached with.
+// If the query has EDNS Client Subnet, answers cached for wider scopes are looked up, see dnscache.AnswerKey.
+func (p *prog) cacheLookup(key dnscache.Key) (dnscache.Key, *dnscache.Value) {
+	for _, k := range dnscache.LookupKeys(key) {
+		if v := p.cache.Get(k); v != nil {
+			return k, v
+		}
+	}
+	return key, nil
+}
+
+// cacheSource returns the upstream which answered the cached value, and its config. The upstream
+// the value was looked up for is returned if the value has no source, or it's no longer configured.
+func (p *prog) cacheSource(value *dnscache.Value, upstream string, uc *ctrld.UpstreamConfig) (string, *ctrld.UpstreamConfig) {
+	if value.Upstream == "" || value.Upstream == upstream {
+		return upstream, uc
+	}
+	if value.Upstream == upstreamOS {
+		return upstreamOS, osUpstreamConfig
+	}
+	if sourceConfig := p.cfg.Upstream[strings.TrimPrefix(value.Upstream, upstreamPrefix)]; sourceConfig != nil {
+		return value.Upstream, sourceConfig
+	}
+	return upstream, uc
+}
+
+// cacheAnswer adds answer of the query with given key, from given upstream, to the cache.
+func (p *prog) cacheAnswer(ctx context.Context, key dnscache.Key, upstream string, answer *dns.Msg, dnssecResult string) {
+	// Bogus answers are not cached, so they are re-validated on next query.
+	if p.cache == nil || dnssecResult == ctrld.DNSSECBogus {
+		return
+	}
+	ttl, ok := p.cacheTTL(answer)
+	if !ok {
+		ctrld.Log(ctx, mainLog.Load().Debug(), "response is not cacheable")
+		return
+	}
+	now := time.Now()
+	expired := now.Add(time.Duration(ttl) * time.Second)
+	setCachedAnswerTTL(answer, now, expired)
+	value := dnscache.NewValue(answer, expired)
+	value.DNSSEC = dnssecResult
+	value.Upstream = upstream
+	p.cache.Add(dnscache.AnswerKey(key, answer), value)
+	ctrld.Log(ctx, mainLog.Load().Debug(), "add cached response")
+}
+
+// upstreamQuery returns the query sent to upstream, according to its ECS policy and DNSSEC validation.
+func (p *prog) upstreamQuery(uc *ctrld.UpstreamConfig, msg *dns.Msg) *dns.Msg {
+	upstreamMsg := msg
+	if uc != nil {
+		upstreamMsg = uc.ECSQuery(msg)
+	}
+	if p.dnssec != nil {
+		upstreamMsg = ctrld.DNSSECQuery(upstreamMsg)
+	}
+	return upstreamMsg
+}
+
+// clientAnswer adjusts answer of upstreamMsg, so it could be sent to the client which sent msg.
+func (p *prog) clientAnswer(answer, msg, upstreamMsg *dns.Msg, dnssecResult string) *dns.Msg {
+	if upstreamMsg == msg {
 		return answer
 	}
-	ctrld.Log(ctx, mainLog.Load().Error(), "all %v endpoints failed", upstreams)
-	answer := new(dns.Msg)
-	answer.SetRcode(msg, dns.RcodeServerFailure)
+	ctrld.RestoreECS(answer, msg)
+	if p.dnssec == nil {
+		return answer
+	}
+	if dnssecResult == ctrld.DNSSECBogus && !msg.CheckingDisabled {
+		servfail := new(dns.Msg)
+		servfail.SetRcode(msg, dns.RcodeServerFailure)
+		return servfail
+	}
+	ctrld.DNSSECAnswer(answer, msg, dnssecResult)
 	return answer
 }
 
+// validateDNSSEC validates answer of msg, fetching DNSSEC records from the upstream.
+func (p *prog) validateDNSSEC(ctx context.Context, uc *ctrld.UpstreamConfig, msg, answer *dns.Msg) string {
+	lookup := func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		dnsResolver, err := ctrld.NewResolver(uc)
+		if err != nil {
+			return nil, err
+		}
+		if uc.Timeout > 0 {
+			timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(uc.Timeout))
+			defer cancel()
+			ctx = timeoutCtx
+		}
+		return dnsResolver.Resolve(ctx, ctrld.DNSSECQuery(m))
+	}
+	result, err := p.dnssec.Validate(ctx, msg, answer, lookup)
+	if err != nil {
+		ctrld.Log(ctx, mainLog.Load().Warn().Err(err), "dnssec validation failed")
+		return result
+	}
+	ctrld.Log(ctx, mainLog.Load().Debug(), "dnssec validation result: %s", result)
+	return result
+}
+
 func (p *prog) upstreamConfigsFromUpstreamNumbers(upstreams []string) []*ctrld.UpstreamConfig {
 	upstreamConfigs := make([]*ctrld.UpstreamConfig, 0, len(upstreams))
 	for _, upstream := range upstreams {
@@ -418,14 +715,101 @@ func setCachedAnswerTTL(answer *dns.Msg, now, expiredTime time.Time) {
 	}
 }
 
-func ttlFromMsg(msg *dns.Msg) uint32 {
+// cacheTTL returns the TTL used for caching answer, and whether answer could be cached.
+//
+// cache_ttl_override replaces the TTL of the answer, then the TTL is clamped to cache_min_ttl
+// and cache_max_ttl, and to cache_negative_max_ttl for negative answers.
+func (p *prog) cacheTTL(answer *dns.Msg) (uint32, bool) {
+	negative := isNegativeAnswer(answer)
+	switch {
+	case negative:
+		// Negative answers without SOA record should not be cached.
+		// https://www.rfc-editor.org/rfc/rfc2308#section-5
+		if !hasSOA(answer) {
+			return 0, false
+		}
+	case answer.Rcode != dns.RcodeSuccess:
+		return 0, false
+	}
+	ttl := ttlFromMsg(answer, negative)
+	sc := p.cfg.Service
+	// Negative answers keep the SOA negative caching TTL, the override is for records only.
+	if sc.CacheTTLOverride > 0 && !negative {
+		ttl = uint32(sc.CacheTTLOverride)
+	}
+	if sc.CacheMinTTL > 0 && ttl < uint32(sc.CacheMinTTL) {
+		ttl = uint32(sc.CacheMinTTL)
+	}
+	if sc.CacheMaxTTL > 0 && ttl > uint32(sc.CacheMaxTTL) {
+		ttl = uint32(sc.CacheMaxTTL)
+	}
+	if negative {
+		maxTTL := uint32(defaultCacheNegativeMaxTTL)
+		if sc.CacheNegativeMaxTTL > 0 {
+			maxTTL = uint32(sc.CacheNegativeMaxTTL)
+		}
+		if ttl > maxTTL {
+			ttl = maxTTL
+		}
+	}
+	return ttl, true
+}
+
+// ttlFromMsg returns the minimum TTL of the records in the answer section of msg. For negative
+// answers, it's the TTL of the SOA record in the authority section, capped to its MINIMUM field.
+// https://www.rfc-editor.org/rfc/rfc2308#section-5
+func ttlFromMsg(msg *dns.Msg, negative bool) uint32 {
+	section := msg.Answer
+	if negative {
+		section = msg.Ns
+	}
+	var ttl uint32
+	found := false
+	for _, rr := range section {
+		rrTTL := rr.Header().Ttl
+		if negative {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				continue
+			}
+			if soa.Minttl < rrTTL {
+				rrTTL = soa.Minttl
+			}
+		}
+		if !found || rrTTL < ttl {
+			ttl = rrTTL
+			found = true
+		}
+	}
+	return ttl
+}
+
+// isNegativeAnswer reports whether msg is a NXDOMAIN or NODATA answer.
+func isNegativeAnswer(msg *dns.Msg) bool {
+	if msg.Rcode == dns.RcodeNameError {
+		return true
+	}
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Question) == 0 {
+		return false
+	}
+	// NODATA, possibly at the end of a CNAME chain.
+	qtype := msg.Question[0].Qtype
 	for _, rr := range msg.Answer {
-		return rr.Header().Ttl
+		if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			return false
+		}
 	}
+	return true
+}
+
+// hasSOA reports whether the authority section of msg contains a SOA record.
+func hasSOA(msg *dns.Msg) bool {
 	for _, rr := range msg.Ns {
-		return rr.Header().Ttl
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
 	}
-	return 0
+	return false
 }
 
 func needLocalIPv6Listener() bool {
@@ -3,6 +3,8 @@ package cli
 import (
 	"context"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -111,9 +113,9 @@ func Test_prog_upstreamFor(t *testing.T) {
 				require.NoError(t, err)
 				require.NotNil(t, addr)
 				ctx := context.WithValue(context.Background(), ctrld.ReqIdCtxKey{}, requestID())
-				upstreams, matched := prog.upstreamFor(ctx, tc.defaultUpstreamNum, tc.lc, addr, tc.domain)
-				assert.Equal(t, tc.matched, matched)
-				assert.Equal(t, tc.upstreams, upstreams)
+				res := prog.upstreamFor(ctx, tc.defaultUpstreamNum, tc.lc, addr, tc.domain)
+				assert.Equal(t, tc.matched, res.matched)
+				assert.Equal(t, tc.upstreams, res.upstreams)
 				if tc.testLogMsg != "" {
 					assert.Contains(t, logOutput.String(), tc.testLogMsg)
 				}
@@ -149,11 +151,68 @@ func TestCache(t *testing.T) {
 	answer2.SetRcode(msg, dns.RcodeRefused)
 	prog.cache.Add(dnscache.NewKey(msg, "upstream.0"), dnscache.NewValue(answer2, time.Now().Add(time.Minute)))
 
-	got1 := prog.proxy(context.Background(), []string{"upstream.1"}, nil, msg, nil)
-	got2 := prog.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil)
+	got1 := prog.proxy(context.Background(), []string{"upstream.1"}, nil, msg, nil, "").answer
+	got2 := prog.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil, "").answer
 	assert.NotSame(t, got1, got2)
 	assert.Equal(t, answer1.Rcode, got1.Rcode)
 	assert.Equal(t, answer2.Rcode, got2.Rcode)
+
+	// Queries with different ECS scope must not share cached answers.
+	ecsMsg := msg.Copy()
+	ecsMsg.SetEdns0(dns.DefaultMsgSize, false)
+	opt := ecsMsg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()})
+	assert.NotEqual(t, dnscache.NewKey(msg, "upstream.1"), dnscache.NewKey(ecsMsg, "upstream.1"))
+	answer3 := new(dns.Msg)
+	answer3.SetRcode(ecsMsg, dns.RcodeNameError)
+	prog.cache.Add(dnscache.NewKey(ecsMsg, "upstream.1"), dnscache.NewValue(answer3, time.Now().Add(time.Minute)))
+	got3 := prog.proxy(context.Background(), []string{"upstream.1"}, nil, ecsMsg, nil, "").answer
+	assert.Equal(t, answer3.Rcode, got3.Rcode)
+}
+
+func Test_prog_proxyECSScope(t *testing.T) {
+	var queries atomic.Int32
+	uc := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		answer := testAnswer(req)
+		// The answer is suitable for the whole /16 of the client subnet.
+		if opt := req.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+					ae := *e
+					ae.SourceScope = 16
+					answer.SetEdns0(opt.UDPSize(), false)
+					answer.IsEdns0().Option = append(answer.IsEdns0().Option, &ae)
+				}
+			}
+		}
+		_ = w.WriteMsg(answer)
+	})
+	cacher, err := dnscache.NewLRUCache(16)
+	require.NoError(t, err)
+	cfg := &ctrld.Config{
+		Service:  ctrld.ServiceConfig{CacheEnable: true},
+		Upstream: map[string]*ctrld.UpstreamConfig{"0": uc},
+	}
+	p := &prog{cfg: cfg, cache: cacher, um: newUpstreamMonitor(cfg)}
+	query := func(subnet string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet).To4()})
+		answer := p.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil, "").answer
+		require.Equal(t, dns.RcodeSuccess, answer.Rcode)
+		return answer
+	}
+
+	query("192.0.2.0")
+	answer := query("192.0.3.0")
+	assert.Equal(t, int32(1), queries.Load(), "answer of the same scope must be served from cache")
+	if opt := answer.IsEdns0(); assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+		assert.Equal(t, "192.0.3.0", opt.Option[0].(*dns.EDNS0_SUBNET).Address.String())
+	}
+	query("198.51.100.0")
+	assert.Equal(t, int32(2), queries.Load(), "answer of other scope must not be served from cache")
 }
 
 func Test_ipAndMacFromMsg(t *testing.T) {
@@ -234,3 +293,287 @@ func Test_remoteAddrFromMsg(t *testing.T) {
 		})
 	}
 }
+
+func Test_prog_clientAnswer(t *testing.T) {
+	v, err := ctrld.NewDNSSECValidator(nil, nil)
+	require.NoError(t, err)
+	prog := &prog{dnssec: v}
+	tests := []struct {
+		name      string
+		result    string
+		cd        bool
+		wantRcode int
+		wantAD    bool
+	}{
+		{"secure", ctrld.DNSSECSecure, false, dns.RcodeSuccess, true},
+		{"insecure", ctrld.DNSSECInsecure, false, dns.RcodeSuccess, false},
+		{"bogus", ctrld.DNSSECBogus, false, dns.RcodeServerFailure, false},
+		{"bogus with checking disabled", ctrld.DNSSECBogus, true, dns.RcodeSuccess, false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			msg.AuthenticatedData = true
+			msg.CheckingDisabled = tc.cd
+			upstreamMsg := prog.upstreamQuery(nil, msg)
+			require.NotSame(t, msg, upstreamMsg)
+			opt := upstreamMsg.IsEdns0()
+			require.True(t, opt != nil && opt.Do() && upstreamMsg.CheckingDisabled)
+
+			answer := new(dns.Msg)
+			answer.SetReply(upstreamMsg)
+			answer.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+			got := prog.clientAnswer(answer, msg, upstreamMsg, tc.result)
+			assert.Equal(t, tc.wantRcode, got.Rcode)
+			assert.Equal(t, tc.wantAD, got.AuthenticatedData)
+			assert.Nil(t, got.IsEdns0())
+		})
+	}
+}
+
+func Test_prog_cacheTTL(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	soa := rr("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")
+	answer := func(rcode int, answer, ns []dns.RR) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		m := new(dns.Msg)
+		m.SetRcode(msg, rcode)
+		m.Answer = answer
+		m.Ns = ns
+		return m
+	}
+	positive := answer(dns.RcodeSuccess, []dns.RR{
+		rr("www.example.com. 600 IN CNAME web.example.com."),
+		rr("web.example.com. 120 IN A 192.0.2.1"),
+	}, nil)
+	withAuthority := answer(dns.RcodeSuccess, []dns.RR{rr("www.example.com. 600 IN A 192.0.2.1")}, []dns.RR{rr("example.com. 60 IN NS ns.example.com.")})
+	nxdomain := answer(dns.RcodeNameError, nil, []dns.RR{soa})
+
+	tests := []struct {
+		name    string
+		sc      ctrld.ServiceConfig
+		answer  *dns.Msg
+		wantTTL uint32
+		wantOk  bool
+	}{
+		{"minimum ttl of answer records", ctrld.ServiceConfig{}, positive, 120, true},
+		{"authority records ignored", ctrld.ServiceConfig{}, withAuthority, 600, true},
+		{"nxdomain uses soa minimum", ctrld.ServiceConfig{}, nxdomain, 300, true},
+		{"nxdomain with authority ns", ctrld.ServiceConfig{}, answer(dns.RcodeNameError, nil, []dns.RR{rr("example.com. 60 IN NS ns.example.com."), soa}), 300, true},
+		{"nodata after cname", ctrld.ServiceConfig{}, answer(dns.RcodeSuccess, []dns.RR{rr("www.example.com. 600 IN CNAME web.example.com.")}, []dns.RR{soa}), 300, true},
+		{"nodata without soa", ctrld.ServiceConfig{}, answer(dns.RcodeSuccess, nil, nil), 0, false},
+		{"servfail", ctrld.ServiceConfig{}, answer(dns.RcodeServerFailure, nil, nil), 0, false},
+		{"min ttl", ctrld.ServiceConfig{CacheMinTTL: 300}, positive, 300, true},
+		{"max ttl", ctrld.ServiceConfig{CacheMaxTTL: 60}, positive, 60, true},
+		{"ttl override clamped by max ttl", ctrld.ServiceConfig{CacheTTLOverride: 3600, CacheMaxTTL: 600}, positive, 600, true},
+		{"negative max ttl", ctrld.ServiceConfig{CacheNegativeMaxTTL: 30}, nxdomain, 30, true},
+		{"default negative max ttl", ctrld.ServiceConfig{}, answer(dns.RcodeNameError, nil, []dns.RR{rr("example.com. 86400 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 86400")}), defaultCacheNegativeMaxTTL, true},
+		{"ttl override not applied to nxdomain", ctrld.ServiceConfig{CacheTTLOverride: 1800}, nxdomain, 300, true},
+		{"ttl override not applied to nodata", ctrld.ServiceConfig{CacheTTLOverride: 1800}, answer(dns.RcodeSuccess, nil, []dns.RR{soa}), 300, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := &prog{cfg: &ctrld.Config{Service: tc.sc}}
+			ttl, ok := p.cacheTTL(tc.answer)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantTTL, ttl)
+		})
+	}
+}
+
+func Test_prog_serveStale(t *testing.T) {
+	slow := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		_ = w.WriteMsg(testAnswer(req))
+	})
+	failing := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {})
+	failing.Timeout = 100
+
+	tests := []struct {
+		name        string
+		uc          *ctrld.UpstreamConfig
+		sc          ctrld.ServiceConfig
+		expired     time.Duration
+		wantStale   bool
+		wantRefresh bool
+	}{
+		{"slow upstream", slow, ctrld.ServiceConfig{CacheServeStale: true, CacheStaleAnswerTimeout: 50}, time.Minute, true, true},
+		{"failing upstream", failing, ctrld.ServiceConfig{CacheServeStale: true}, time.Minute, true, false},
+		{"beyond max stale", failing, ctrld.ServiceConfig{CacheServeStale: true, CacheMaxStale: 30}, time.Minute, false, false},
+		{"serve stale disabled", failing, ctrld.ServiceConfig{}, time.Minute, false, false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cacher, err := dnscache.NewLRUCache(16)
+			require.NoError(t, err)
+			tc.sc.CacheEnable = true
+			cfg := &ctrld.Config{Service: tc.sc, Upstream: map[string]*ctrld.UpstreamConfig{"0": tc.uc}}
+			p := &prog{cfg: cfg, cache: cacher, um: newUpstreamMonitor(cfg)}
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			stale := new(dns.Msg)
+			stale.SetReply(msg)
+			rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.9")
+			stale.Answer = append(stale.Answer, rr)
+			key := dnscache.NewKey(msg, "upstream.0")
+			cacher.Add(key, dnscache.NewValue(stale, time.Now().Add(-tc.expired)))
+
+			res := p.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil, "")
+			answer := res.answer
+			if !tc.wantStale {
+				assert.Equal(t, dns.RcodeServerFailure, answer.Rcode)
+				assert.Equal(t, cacheStatusMiss, res.cache)
+				assert.Zero(t, p.cacheStats.staleHits.Load())
+				return
+			}
+			assert.Equal(t, cacheStatusStale, res.cache)
+			assert.Equal(t, "upstream.0", res.upstream)
+			require.Len(t, answer.Answer, 1)
+			assert.Equal(t, "192.0.2.9", answer.Answer[0].(*dns.A).A.String())
+			assert.Equal(t, uint32(staleTTL.Seconds()), answer.Answer[0].Header().Ttl)
+			assert.Equal(t, uint64(1), p.cacheStats.staleHits.Load())
+			if !tc.wantRefresh {
+				return
+			}
+			assert.Eventually(t, func() bool {
+				v := cacher.Get(key)
+				return v != nil && v.Expire.After(time.Now()) && v.Msg.Answer[0].(*dns.A).A.String() == "192.0.2.1"
+			}, 5*time.Second, 10*time.Millisecond, "stale entry was not refreshed")
+		})
+	}
+}
+
+func Test_prog_cacheScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scope  string
+		groups []string
+		// want is the number of queries sent to each upstream.
+		want []int32
+	}{
+		{"per upstream", "", []string{"", ""}, []int32{1, 1}},
+		{"shared", ctrld.CacheScopeShared, []string{"", ""}, []int32{1, 0}},
+		{"per client group", ctrld.CacheScopePerClientGroup, []string{"listener.0/network.0", "listener.0/network.1"}, []int32{1, 1}},
+		{"same network of other listener", ctrld.CacheScopePerClientGroup, []string{"listener.0/network.0", "listener.1/network.0"}, []int32{1, 1}},
+		{"same client group", ctrld.CacheScopePerClientGroup, []string{"listener.0/network.0", "listener.0/network.0"}, []int32{1, 0}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var queries [2]atomic.Int32
+			upstreams := make(map[string]*ctrld.UpstreamConfig)
+			for i := range queries {
+				i := i
+				upstreams[strconv.Itoa(i)] = newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+					queries[i].Add(1)
+					_ = w.WriteMsg(testAnswer(req))
+				})
+			}
+			cacher, err := dnscache.NewLRUCache(16)
+			require.NoError(t, err)
+			cfg := &ctrld.Config{
+				Service:  ctrld.ServiceConfig{CacheEnable: true, CacheScope: tc.scope},
+				Upstream: upstreams,
+			}
+			p := &prog{cfg: cfg, cache: cacher, um: newUpstreamMonitor(cfg)}
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			for i := range queries {
+				answer := p.proxy(context.Background(), []string{"upstream." + strconv.Itoa(i)}, nil, msg, nil, tc.groups[i]).answer
+				require.Equal(t, dns.RcodeSuccess, answer.Rcode)
+			}
+			for i := range queries {
+				assert.Equal(t, tc.want[i], queries[i].Load(), "unexpected queries to upstream.%d", i)
+			}
+		})
+	}
+}
+
+func Test_prog_cacheSource(t *testing.T) {
+	var queries [2]atomic.Int32
+	upstreams := make(map[string]*ctrld.UpstreamConfig)
+	for i := range queries {
+		i := i
+		upstreams[strconv.Itoa(i)] = newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			queries[i].Add(1)
+			_ = w.WriteMsg(testAnswer(req))
+		})
+	}
+	cacher, err := dnscache.NewLRUCache(16)
+	require.NoError(t, err)
+	cfg := &ctrld.Config{
+		Service:  ctrld.ServiceConfig{CacheEnable: true, CacheScope: ctrld.CacheScopeShared},
+		Upstream: upstreams,
+	}
+	p := &prog{cfg: cfg, cache: cacher, prefetcher: newPrefetcher(cfg.Service), um: newUpstreamMonitor(cfg)}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	resp := p.proxy(context.Background(), []string{"upstream.1"}, nil, msg, nil, "")
+	require.Equal(t, cacheStatusMiss, resp.cache)
+	key := dnscache.NewKey(msg, "")
+	value := cacher.Get(key)
+	require.NotNil(t, value)
+	assert.Equal(t, "upstream.1", value.Upstream)
+
+	// The answer cached from upstream.1 is reported and prefetched as such.
+	now := time.Now()
+	value.Stored, value.Expire = now.Add(-95*time.Second), now.Add(5*time.Second)
+	for i := 0; i < 2; i++ {
+		resp = p.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil, "")
+		assert.Equal(t, cacheStatusHit, resp.cache)
+		assert.Equal(t, "upstream.1", resp.upstream)
+	}
+	assert.Eventually(t, func() bool { return queries[1].Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(0), queries[0].Load())
+}
+
+func Test_prog_clientGroup(t *testing.T) {
+	cfg := testhelper.SampleConfig(t)
+	cfg.Service.CacheScope = ctrld.CacheScopePerClientGroup
+	cacher, err := dnscache.NewLRUCache(16)
+	require.NoError(t, err)
+	p := &prog{cfg: cfg, cache: cacher}
+	for _, nc := range p.cfg.Network {
+		for _, cidr := range nc.Cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			require.NoError(t, err)
+			nc.IPNets = append(nc.IPNets, ipNet)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		ip          string
+		listenerNum string
+		group       string
+	}{
+		{"network of listener policy", "192.168.0.1:0", "0", "listener.0/network.0"},
+		{"other network of listener policy", "192.168.1.2:0", "0", "listener.0/network.1"},
+		{"outside networks", "10.0.0.1:0", "0", "listener.0"},
+		{"listener without policy", "192.168.0.1:0", "1", "listener.1"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			addr, err := net.ResolveUDPAddr("udp", tc.ip)
+			require.NoError(t, err)
+			assert.Equal(t, tc.group, p.clientGroup(tc.listenerNum, p.cfg.Listener[tc.listenerNum], addr))
+		})
+	}
+}
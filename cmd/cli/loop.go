@@ -40,6 +40,7 @@ func (p *prog) detectLoop(msg *dns.Msg) {
 	p.loopMu.Lock()
 	if _, loop := p.loop[uid]; loop {
 		p.loop[uid] = loop
+		p.metrics.observeLoop()
 	}
 	p.loopMu.Unlock()
 }
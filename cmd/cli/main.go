@@ -32,6 +32,7 @@ var (
 	cdDev             bool
 	iface             string
 	ifaceStartStop    string
+	cacheUpstream     string
 
 	mainLog       atomic.Pointer[zerolog.Logger]
 	consoleWriter zerolog.ConsoleWriter
@@ -162,7 +163,8 @@ func initCache() {
 	if !cfg.Service.CacheEnable {
 		return
 	}
-	if cfg.Service.CacheSize == 0 {
+	// With cache_max_bytes, the cache could be bounded by memory only.
+	if cfg.Service.CacheSize == 0 && cfg.Service.CacheMaxBytes == 0 {
 		cfg.Service.CacheSize = 4096
 	}
 }
@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "ctrld"
+	metricsPath      = "/metrics"
+)
+
+// Types of upstream errors.
+const (
+	upstreamErrorTimeout = "timeout"
+	upstreamErrorNetwork = "network"
+	upstreamErrorOther   = "other"
+)
+
+// metrics holds the Prometheus metrics updated while serving queries. Metrics which
+// reflect the state of prog are collected on scraping by metricsCollector instead.
+type metrics struct {
+	registry        *prometheus.Registry
+	queries         *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	upstreamErrors  *prometheus.CounterVec
+	loopDetections  prometheus.Counter
+}
+
+// newMetrics returns the metrics of p, registered to a new registry.
+func newMetrics(p *prog) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_total",
+			Help:      "Number of DNS queries answered, by listener, query type and response code.",
+		}, []string{"listener", "qtype", "rcode"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Duration of successful queries to upstreams.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"upstream"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_errors_total",
+			Help:      "Number of failed queries to upstreams, by error type.",
+		}, []string{"upstream", "type"}),
+		loopDetections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "loop_detections_total",
+			Help:      "Number of DNS loop test queries received back from upstreams.",
+		}),
+	}
+	m.registry.MustRegister(m.queries, m.upstreamLatency, m.upstreamErrors, m.loopDetections, &metricsCollector{p: p})
+	return m
+}
+
+// handler returns the HTTP handler serving the metrics.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeQuery records a query of given type received on listener, answered with given rcode.
+func (m *metrics) observeQuery(listener string, qtype uint16, rcode int) {
+	if m == nil {
+		return
+	}
+	m.queries.WithLabelValues(listener, dns.Type(qtype).String(), dns.RcodeToString[rcode]).Inc()
+}
+
+// observeUpstream records the result of a query sent to upstream, which took given duration.
+func (m *metrics) observeUpstream(upstream string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.upstreamErrors.WithLabelValues(upstream, upstreamErrorType(err)).Inc()
+		return
+	}
+	m.upstreamLatency.WithLabelValues(upstream).Observe(d.Seconds())
+}
+
+// observeLoop records a DNS loop detection.
+func (m *metrics) observeLoop() {
+	if m == nil {
+		return
+	}
+	m.loopDetections.Inc()
+}
+
+// upstreamErrorType returns the type of error returned by upstream resolvers.
+func upstreamErrorType(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return upstreamErrorTimeout
+	case errNetworkError(err):
+		return upstreamErrorNetwork
+	}
+	return upstreamErrorOther
+}
+
+var (
+	upstreamUpDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "upstream_up"),
+		"Whether the upstream is up (1) or marked as down by the upstream monitor (0).", []string{"upstream"}, nil)
+	cacheHitsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cache", "hits_total"),
+		"Number of queries answered from the cache.", nil, nil)
+	cacheMissesDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cache", "misses_total"),
+		"Number of queries without fresh cached answer.", nil, nil)
+	cacheStaleHitsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cache", "stale_hits_total"),
+		"Number of queries answered with stale cached answer.", nil, nil)
+	cacheEntriesDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cache", "entries"),
+		"Number of cached answers.", nil, nil)
+	cacheBytesDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cache", "bytes"),
+		"Estimated memory used by cached answers, in bytes.", nil, nil)
+	semaphoreInUseDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "concurrent_requests"),
+		"Number of queries being processed.", nil, nil)
+	semaphoreCapacityDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "max_concurrent_requests"),
+		"Maximum number of queries processed concurrently, 0 means unlimited.", nil, nil)
+	clientsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "clients"),
+		"Number of clients in the client info table.", nil, nil)
+	queryLogDroppedDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "query_log", "dropped_total"),
+		"Number of query log records dropped because the query log could not keep up.", nil, nil)
+)
+
+// metricsCollector collects metrics from the state of prog on scraping, so serving
+// queries is not slowed down by updating them.
+type metricsCollector struct {
+	p *prog
+}
+
+// Describe implements prometheus.Collector.
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamUpDesc
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheStaleHitsDesc
+	ch <- cacheEntriesDesc
+	ch <- cacheBytesDesc
+	ch <- semaphoreInUseDesc
+	ch <- semaphoreCapacityDesc
+	ch <- clientsDesc
+	ch <- queryLogDroppedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	p := c.p
+	if p.um != nil {
+		for upstream := range p.um.down {
+			up := 1.0
+			if p.um.isDown(upstream) {
+				up = 0
+			}
+			ch <- prometheus.MustNewConstMetric(upstreamUpDesc, prometheus.GaugeValue, up, upstream)
+		}
+	}
+	if p.cache != nil {
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(p.cacheStats.hits.Load()))
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(p.cacheStats.misses.Load()))
+		ch <- prometheus.MustNewConstMetric(cacheStaleHitsDesc, prometheus.CounterValue, float64(p.cacheStats.staleHits.Load()))
+		ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(p.cache.Len()))
+		ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(p.cache.Bytes()))
+	}
+	if p.sema != nil {
+		inUse, capacity := p.sema.usage()
+		ch <- prometheus.MustNewConstMetric(semaphoreInUseDesc, prometheus.GaugeValue, float64(inUse))
+		ch <- prometheus.MustNewConstMetric(semaphoreCapacityDesc, prometheus.GaugeValue, float64(capacity))
+	}
+	if p.ciTable != nil {
+		ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(len(p.ciTable.ListClients())))
+	}
+	if p.queryLog != nil {
+		ch <- prometheus.MustNewConstMetric(queryLogDroppedDesc, prometheus.CounterValue, float64(p.queryLog.dropped.Load()))
+	}
+}
+
+// serveMetrics serves metrics on the metrics listener, until the program is stopped.
+func (p *prog) serveMetrics() {
+	addr := p.cfg.Service.MetricsListener
+	if p.metrics == nil || addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, p.metrics.handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-p.stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+	mainLog.Load().Info().Msgf("starting metrics server on: %s", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		mainLog.Load().Error().Err(err).Msg("could not start metrics server")
+	}
+}
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+func Test_metrics(t *testing.T) {
+	uc := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		_ = w.WriteMsg(testAnswer(req))
+	})
+	cacher, err := dnscache.NewLRUCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{"0": uc}}
+	p := &prog{cfg: cfg, cache: cacher, um: newUpstreamMonitor(cfg), sema: &chanSemaphore{ready: make(chan struct{}, 8)}}
+	p.metrics = newMetrics(p)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		answer := p.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil, "").answer
+		p.metrics.observeQuery("0", dns.TypeA, answer.Rcode)
+	}
+	p.metrics.observeUpstream("upstream.0", 0, context.DeadlineExceeded)
+
+	rec := httptest.NewRecorder()
+	p.metrics.handler().ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`ctrld_queries_total{listener="0",qtype="A",rcode="NOERROR"} 2`,
+		`ctrld_upstream_request_duration_seconds_count{upstream="upstream.0"} 1`,
+		`ctrld_upstream_errors_total{type="timeout",upstream="upstream.0"} 1`,
+		`ctrld_upstream_up{upstream="upstream.0"} 1`,
+		`ctrld_cache_hits_total 1`,
+		`ctrld_cache_misses_total 1`,
+		`ctrld_cache_entries 1`,
+		`ctrld_max_concurrent_requests 8`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing metric %q in:\n%s", want, body)
+		}
+	}
+}
+
+func Test_metrics_disabled(t *testing.T) {
+	var m *metrics
+	m.observeQuery("0", dns.TypeA, dns.RcodeSuccess)
+	m.observeUpstream("upstream.0", 0, nil)
+	m.observeLoop()
+}
+
+func Test_upstreamErrorType(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"timeout", context.DeadlineExceeded, upstreamErrorTimeout},
+		{"other", errors.New("bad response"), upstreamErrorOther},
+	}
+	for _, tc := range tests {
+		if got := upstreamErrorType(tc.err); got != tc.want {
+			t.Errorf("%s: unexpected error type, want: %s, got: %s", tc.name, tc.want, got)
+		}
+	}
+}
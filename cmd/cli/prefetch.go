@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+const (
+	// defaultCachePrefetchThreshold is the default percentage of TTL, at the end of which
+	// cache hits trigger prefetching.
+	defaultCachePrefetchThreshold = 10
+	// defaultCachePrefetchMinHits is the default number of hits an entry needs to be prefetched.
+	defaultCachePrefetchMinHits = 2
+	// maxPrefetchesPerSecond limits the number of prefetches started per second.
+	maxPrefetchesPerSecond = 50
+	// defaultPrefetchTimeout is the timeout of prefetch queries to upstreams without timeout.
+	defaultPrefetchTimeout = 5 * time.Second
+)
+
+// prefetcher refreshes popular cache entries before they expire. Prefetches of the same
+// entry are deduplicated, and the number of prefetches per second is limited.
+type prefetcher struct {
+	threshold int
+	minHits   uint64
+
+	mu          sync.Mutex
+	inflight    map[dnscache.Key]struct{}
+	windowStart time.Time
+	started     int
+}
+
+// newPrefetcher returns the prefetcher of given service config.
+func newPrefetcher(sc ctrld.ServiceConfig) *prefetcher {
+	pf := &prefetcher{
+		threshold: defaultCachePrefetchThreshold,
+		minHits:   defaultCachePrefetchMinHits,
+		inflight:  make(map[dnscache.Key]struct{}),
+	}
+	if sc.CachePrefetchThreshold > 0 {
+		pf.threshold = sc.CachePrefetchThreshold
+	}
+	if sc.CachePrefetchMinHits > 0 {
+		pf.minHits = uint64(sc.CachePrefetchMinHits)
+	}
+	return pf
+}
+
+// shouldPrefetch reports whether a hit of value at now, which is its hits-th hit,
+// happens in the last threshold percent of its TTL.
+func (pf *prefetcher) shouldPrefetch(value *dnscache.Value, hits uint64, now time.Time) bool {
+	if hits < pf.minHits || value.Stored.IsZero() {
+		return false
+	}
+	ttl := value.Expire.Sub(value.Stored)
+	remaining := value.Expire.Sub(now)
+	return ttl > 0 && remaining > 0 && remaining*100 <= ttl*time.Duration(pf.threshold)
+}
+
+// acquire reports whether a prefetch of key could be started, marking it in-flight.
+func (pf *prefetcher) acquire(key dnscache.Key, now time.Time) bool {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if _, ok := pf.inflight[key]; ok {
+		return false
+	}
+	if now.Sub(pf.windowStart) >= time.Second {
+		pf.windowStart = now
+		pf.started = 0
+	}
+	if pf.started >= maxPrefetchesPerSecond {
+		return false
+	}
+	pf.started++
+	pf.inflight[key] = struct{}{}
+	return true
+}
+
+func (pf *prefetcher) release(key dnscache.Key) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	delete(pf.inflight, key)
+}
+
+// prefetch records a cache hit of value, cached with cachedKey, for upstreamMsg from given
+// upstream with given key, and refreshes it in background if it is popular and about to expire.
+// Prefetches are deduplicated by cachedKey, since queries with different keys could hit the
+// same entry, like queries of clients within the ECS scope of the cached answer.
+func (p *prog) prefetch(ctx context.Context, uc *ctrld.UpstreamConfig, upstream string, cachedKey, key dnscache.Key, upstreamMsg *dns.Msg, value *dnscache.Value, now time.Time) {
+	hits := value.Hit()
+	pf := p.prefetcher
+	if pf == nil || uc == nil || !pf.shouldPrefetch(value, hits, now) {
+		return
+	}
+	if !pf.acquire(cachedKey, now) {
+		return
+	}
+	go func() {
+		defer pf.release(cachedKey)
+		ctrld.Log(ctx, mainLog.Load().Debug(), "prefetching cached response from %s: %s", upstream, uc.Name)
+		dnsResolver, err := ctrld.NewResolver(uc)
+		if err != nil {
+			ctrld.Log(ctx, mainLog.Load().Error().Err(err), "failed to create resolver")
+			return
+		}
+		timeout := defaultPrefetchTimeout
+		if uc.Timeout > 0 {
+			timeout = time.Millisecond * time.Duration(uc.Timeout)
+		}
+		resolveCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		msg := upstreamMsg.Copy()
+		answer, err := dnsResolver.Resolve(resolveCtx, msg)
+		if err != nil {
+			ctrld.Log(ctx, mainLog.Load().Debug().Err(err), "failed to prefetch cached response")
+			return
+		}
+		// Keep the cached answer instead of replacing it with a failure.
+		if answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "ignoring prefetched response with rcode: %s", dns.RcodeToString[answer.Rcode])
+			return
+		}
+		answer.Compress = true
+		dnssecResult := ""
+		if p.dnssec != nil {
+			dnssecResult = p.validateDNSSEC(ctx, uc, msg, answer)
+		}
+		p.cacheAnswer(ctx, key, upstream, answer, dnssecResult)
+	}()
+}
@@ -0,0 +1,199 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+func Test_prefetcher_shouldPrefetch(t *testing.T) {
+	pf := newPrefetcher(ctrld.ServiceConfig{})
+	now := time.Now()
+	value := &dnscache.Value{Stored: now.Add(-95 * time.Second), Expire: now.Add(5 * time.Second)}
+	tests := []struct {
+		name  string
+		value *dnscache.Value
+		hits  uint64
+		want  bool
+	}{
+		{"popular near expiry", value, 2, true},
+		{"not popular", value, 1, false},
+		{"not near expiry", &dnscache.Value{Stored: now.Add(-5 * time.Second), Expire: now.Add(95 * time.Second)}, 2, false},
+		{"expired", &dnscache.Value{Stored: now.Add(-100 * time.Second), Expire: now.Add(-time.Second)}, 2, false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := pf.shouldPrefetch(tc.value, tc.hits, now); got != tc.want {
+				t.Errorf("unexpected result, want: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_prefetcher_acquire(t *testing.T) {
+	pf := newPrefetcher(ctrld.ServiceConfig{})
+	now := time.Now()
+	key := dnscache.Key{Name: "example.com.", Qtype: dns.TypeA}
+	if !pf.acquire(key, now) {
+		t.Fatal("first prefetch must be started")
+	}
+	if pf.acquire(key, now) {
+		t.Fatal("in-flight prefetch must be deduplicated")
+	}
+	pf.release(key)
+	for i := 1; i < maxPrefetchesPerSecond; i++ {
+		if !pf.acquire(dnscache.Key{Name: "example.com.", Qtype: uint16(i)}, now) {
+			t.Fatalf("prefetch %d must be started", i)
+		}
+	}
+	if pf.acquire(dnscache.Key{Name: "other.example.com."}, now) {
+		t.Fatal("prefetches must be rate limited")
+	}
+	if !pf.acquire(dnscache.Key{Name: "other.example.com."}, now.Add(time.Second)) {
+		t.Fatal("prefetch must be started in next second")
+	}
+}
+
+func Test_prog_prefetch(t *testing.T) {
+	var queries atomic.Int32
+	uc := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		_ = w.WriteMsg(testAnswer(req))
+	})
+	cacher, err := dnscache.NewLRUCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{"0": uc}}
+	p := &prog{cfg: cfg, cache: cacher, prefetcher: newPrefetcher(cfg.Service), um: newUpstreamMonitor(cfg)}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	key := dnscache.NewKey(msg, "upstream.0")
+	stale := msg.Copy()
+	stale.Response = true
+	now := time.Now()
+	cacher.Add(key, &dnscache.Value{Msg: stale, Stored: now.Add(-95 * time.Second), Expire: now.Add(5 * time.Second)})
+
+	for i := 0; i < 3; i++ {
+		p.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil, "")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if v := cacher.Get(key); v != nil && len(v.Msg.Answer) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	v := cacher.Get(key)
+	if v == nil || len(v.Msg.Answer) == 0 {
+		t.Fatal("cache entry was not prefetched")
+	}
+	if time.Until(v.Expire) <= 5*time.Second {
+		t.Errorf("prefetched entry was not refreshed, expire: %v", v.Expire)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("unexpected number of upstream queries, want: 1, got: %d", n)
+	}
+}
+
+func Test_prog_prefetchECSScope(t *testing.T) {
+	var queries atomic.Int32
+	release := make(chan struct{})
+	uc := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		// Hold prefetches until all clients hit the cached answer.
+		if queries.Add(1) > 1 {
+			<-release
+		}
+		answer := testAnswer(req)
+		// The answer is suitable for the whole /16 of the client subnet.
+		opt := req.IsEdns0()
+		e := *opt.Option[0].(*dns.EDNS0_SUBNET)
+		e.SourceScope = 16
+		answer.SetEdns0(opt.UDPSize(), false)
+		answer.IsEdns0().Option = append(answer.IsEdns0().Option, &e)
+		_ = w.WriteMsg(answer)
+	})
+	cacher, err := dnscache.NewLRUCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{"0": uc}}
+	p := &prog{cfg: cfg, cache: cacher, prefetcher: newPrefetcher(cfg.Service), um: newUpstreamMonitor(cfg)}
+	query := func(subnet string) {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet).To4()})
+		p.proxy(context.Background(), []string{"upstream.0"}, nil, msg, nil, "")
+	}
+
+	query("192.0.2.0")
+	var value *dnscache.Value
+	cacher.Range(func(_ dnscache.Key, v *dnscache.Value) bool {
+		value = v
+		return false
+	})
+	if value == nil {
+		t.Fatal("answer was not cached")
+	}
+	now := time.Now()
+	value.Stored, value.Expire = now.Add(-95*time.Second), now.Add(5*time.Second)
+
+	// Clients of other subnets within the scope hit the same entry, it must be prefetched once.
+	for _, subnet := range []string{"192.0.3.0", "192.0.4.0", "192.0.5.0", "192.0.6.0"} {
+		query(subnet)
+	}
+	close(release)
+	refreshed := func() bool {
+		ok := false
+		cacher.Range(func(_ dnscache.Key, v *dnscache.Value) bool {
+			ok = time.Until(v.Expire) > 5*time.Second
+			return !ok
+		})
+		return ok
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && !refreshed() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !refreshed() {
+		t.Fatal("cache entry was not prefetched")
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("unexpected number of upstream queries, want: 2, got: %d", n)
+	}
+}
+
+// newTestUpstream returns a legacy upstream served by given handler.
+func newTestUpstream(t *testing.T, handler dns.HandlerFunc) *ctrld.UpstreamConfig {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	uc := &ctrld.UpstreamConfig{Name: "test", Type: ctrld.ResolverTypeLegacy, Endpoint: pc.LocalAddr().String(), Timeout: 1000}
+	uc.Init()
+	return uc
+}
+
+// testAnswer returns an answer of req, with a single A record.
+func testAnswer(req *dns.Msg) *dns.Msg {
+	answer := new(dns.Msg)
+	answer.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+	answer.Answer = append(answer.Answer, rr)
+	return answer
+}
@@ -9,13 +9,16 @@ import (
 	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/kardianos/service"
+	"golang.org/x/sync/singleflight"
 	"tailscale.com/net/interfaces"
 
 	"github.com/Control-D-Inc/ctrld"
@@ -25,11 +28,12 @@ import (
 )
 
 const (
-	defaultSemaphoreCap  = 256
-	ctrldLogUnixSock     = "ctrld_start.sock"
-	ctrldControlUnixSock = "ctrld_control.sock"
-	upstreamPrefix       = "upstream."
-	upstreamOS           = upstreamPrefix + "os"
+	defaultSemaphoreCap   = 256
+	ctrldLogUnixSock      = "ctrld_start.sock"
+	ctrldControlUnixSock  = "ctrld_control.sock"
+	ctrldBootstrapIPsFile = "ctrld_bootstrap_ips.json"
+	upstreamPrefix        = "upstream."
+	upstreamOS            = upstreamPrefix + "os"
 )
 
 var logf = func(format string, args ...any) {
@@ -54,6 +58,12 @@ type prog struct {
 	cfg         *ctrld.Config
 	appCallback *AppCallback
 	cache       dnscache.Cacher
+	prefetcher  *prefetcher
+	cacheStats  cacheStats
+	metrics     *metrics
+	queryLog    *queryLogger
+	inflight    singleflight.Group
+	dnssec      *ctrld.DNSSECValidator
 	sema        semaphore
 	ciTable     *clientinfo.Table
 	um          *upstreamMonitor
@@ -62,6 +72,8 @@ type prog struct {
 	loopMu sync.Mutex
 	loop   map[string]bool
 
+	snapshotMu sync.Mutex
+
 	started       chan struct{}
 	onStartedDone chan struct{}
 	onStarted     []func()
@@ -95,12 +107,35 @@ func (p *prog) run() {
 	p.started = make(chan struct{}, numListeners)
 	p.onStartedDone = make(chan struct{})
 	p.loop = make(map[string]bool)
+	if p.cfg.Service.MetricsListener != "" {
+		p.metrics = newMetrics(p)
+	}
+	if path := normalizeLogFilePath(p.cfg.Service.QueryLogPath); path != "" {
+		ql, err := newQueryLogger(p.cfg.Service, path)
+		if err != nil {
+			mainLog.Load().Error().Err(err).Msg("failed to create query log, query logging is disabled")
+		} else {
+			p.queryLog = ql
+		}
+	}
 	if p.cfg.Service.CacheEnable {
-		cacher, err := dnscache.NewLRUCache(p.cfg.Service.CacheSize)
+		cacher, err := p.newCacher()
 		if err != nil {
 			mainLog.Load().Error().Err(err).Msg("failed to create cacher, caching is disabled")
 		} else {
 			p.cache = cacher
+			p.loadCacheSnapshot()
+			if p.cfg.Service.CachePrefetch {
+				p.prefetcher = newPrefetcher(p.cfg.Service)
+			}
+		}
+	}
+	if p.cfg.Service.DNSSEC {
+		v, err := ctrld.NewDNSSECValidator(p.cfg.Service.DNSSECTrustAnchors, p.cfg.Service.DNSSECNegativeTrustAnchors)
+		if err != nil {
+			mainLog.Load().Error().Err(err).Msg("failed to create dnssec validator, dnssec validation is disabled")
+		} else {
+			p.dnssec = v
 		}
 	}
 	p.sema = &chanSemaphore{ready: make(chan struct{}, defaultSemaphoreCap)}
@@ -127,11 +162,12 @@ func (p *prog) run() {
 	}
 
 	p.um = newUpstreamMonitor(p.cfg)
+	bootstrapIPCache := p.newBootstrapIPCache()
 	for n := range p.cfg.Upstream {
 		uc := p.cfg.Upstream[n]
 		uc.Init()
 		if uc.BootstrapIP == "" {
-			uc.SetupBootstrapIP()
+			uc.SetupBootstrapIPWithCache(bootstrapIPCache)
 			mainLog.Load().Info().Msgf("bootstrap IPs for upstream.%s: %q", n, uc.BootstrapIPs())
 		} else {
 			mainLog.Load().Info().Str("bootstrap_ip", uc.BootstrapIP).Msgf("using bootstrap IP for upstream.%s", n)
@@ -184,6 +220,8 @@ func (p *prog) run() {
 
 	// Start check DNS loop ticker.
 	go p.checkDnsLoopTicker()
+	go p.cacheSnapshotTicker()
+	go p.serveMetrics()
 
 	// Stop writing log to unix socket.
 	consoleWriter.Out = os.Stdout
@@ -203,6 +241,8 @@ func (p *prog) run() {
 func (p *prog) Stop(s service.Service) error {
 	mainLog.Load().Info().Msg("Service stopped")
 	close(p.stopCh)
+	p.saveCacheSnapshot()
+	p.queryLog.close()
 	if err := p.deAllocateIP(); err != nil {
 		mainLog.Load().Error().Err(err).Msg("de-allocate ip failed")
 		return err
@@ -462,3 +502,23 @@ func defaultRouteIP() string {
 	mainLog.Load().Debug().Str("ip", ip).Msg("found LAN interface IP")
 	return ip
 }
+
+// newCacher returns the DNS cache, bounded by memory if cache_max_bytes is set.
+func (p *prog) newCacher() (dnscache.Cacher, error) {
+	if n := p.cfg.Service.CacheMaxBytes; n > 0 {
+		return dnscache.NewSizedLRUCache(p.cfg.Service.CacheSize, int64(n))
+	}
+	return dnscache.NewLRUCache(p.cfg.Service.CacheSize)
+}
+
+// newBootstrapIPCache returns the cache of upstreams bootstrap IPs, stored in ctrld home directory.
+func (p *prog) newBootstrapIPCache() *ctrld.BootstrapIPCache {
+	if homedir == "" {
+		return nil
+	}
+	maxAge := ctrld.DefaultBootstrapIPsMaxAge
+	if n := p.cfg.Service.BootstrapIPsMaxAge; n > 0 {
+		maxAge = time.Duration(n) * time.Second
+	}
+	return ctrld.NewBootstrapIPCache(filepath.Join(homedir, ctrldBootstrapIPsFile), maxAge)
+}
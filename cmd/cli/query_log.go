@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// Formats of query log.
+const (
+	queryLogFormatJSON = "json"
+	queryLogFormatCSV  = "csv"
+)
+
+// Privacy modes of client identifiers in query log.
+const (
+	queryLogPrivacyHash = "hash"
+	queryLogPrivacyOmit = "omit"
+)
+
+// defaultQueryLogMaxSize is the size of query log file, in megabytes, which triggers rotation.
+const defaultQueryLogMaxSize = 100
+
+// queryLogBufferSize is the number of records buffered for writing. Records are dropped
+// when the buffer is full, so slow disks do not delay answering queries.
+const queryLogBufferSize = 1024
+
+// queryLogCSVHeader is the header row of CSV query log files.
+var queryLogCSVHeader = []string{
+	"time", "client_ip", "client_mac", "client_hostname", "listener", "qname", "qtype",
+	"policy", "network", "rule", "upstream", "rcode", "answers", "latency_ms", "cache",
+}
+
+// queryLogEntry is a query log record.
+type queryLogEntry struct {
+	Time           time.Time `json:"time"`
+	ClientIP       string    `json:"client_ip,omitempty"`
+	ClientMac      string    `json:"client_mac,omitempty"`
+	ClientHostname string    `json:"client_hostname,omitempty"`
+	Listener       string    `json:"listener"`
+	Qname          string    `json:"qname"`
+	Qtype          string    `json:"qtype"`
+	Policy         string    `json:"policy,omitempty"`
+	Network        string    `json:"network,omitempty"`
+	Rule           string    `json:"rule,omitempty"`
+	Upstream       string    `json:"upstream,omitempty"`
+	Rcode          string    `json:"rcode"`
+	Answers        []string  `json:"answers,omitempty"`
+	// LatencyMs is the time spent answering the query, in milliseconds.
+	LatencyMs float64 `json:"latency_ms"`
+	Cache     string  `json:"cache,omitempty"`
+}
+
+// csvRecord returns the CSV columns of e, in the order documented in docs/config.md.
+func (e *queryLogEntry) csvRecord() []string {
+	return []string{
+		e.Time.Format(time.RFC3339Nano),
+		e.ClientIP,
+		e.ClientMac,
+		e.ClientHostname,
+		e.Listener,
+		e.Qname,
+		e.Qtype,
+		e.Policy,
+		e.Network,
+		e.Rule,
+		e.Upstream,
+		e.Rcode,
+		strings.Join(e.Answers, " "),
+		strconv.FormatFloat(e.LatencyMs, 'f', 3, 64),
+		e.Cache,
+	}
+}
+
+// queryLogger writes query log records to a rotated file. Records are written by
+// a separate goroutine, see queryLogBufferSize.
+type queryLogger struct {
+	format  string
+	privacy string
+	// hashKey is the key for hashing client identifiers. It is generated on start, so hashes
+	// are consistent during a run, but can not be reversed by hashing all possible identifiers.
+	hashKey []byte
+
+	w *lumberjack.Logger
+	// maxBytes is the size of log file which triggers rotation. Rotation is done by queryLogger
+	// instead of lumberjack, so CSV header could be written to new files.
+	maxBytes int64
+	// size is the size of current log file.
+	size int64
+
+	ch      chan *queryLogEntry
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newQueryLogger returns the query logger configured by sc, writing to path.
+func newQueryLogger(sc ctrld.ServiceConfig, path string) (*queryLogger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	maxSize := defaultQueryLogMaxSize
+	if sc.QueryLogMaxSize > 0 {
+		maxSize = sc.QueryLogMaxSize
+	}
+	l := &queryLogger{
+		format:  sc.QueryLogFormat,
+		privacy: sc.QueryLogPrivacy,
+		w: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSize,
+			MaxAge:     sc.QueryLogMaxAge,
+			MaxBackups: sc.QueryLogMaxBackups,
+			Compress:   sc.QueryLogCompress,
+		},
+		maxBytes: int64(maxSize) * 1024 * 1024,
+		ch:       make(chan *queryLogEntry, queryLogBufferSize),
+		done:     make(chan struct{}),
+	}
+	if l.format == "" {
+		l.format = queryLogFormatJSON
+	}
+	if l.privacy == queryLogPrivacyHash {
+		l.hashKey = make([]byte, 32)
+		if _, err := rand.Read(l.hashKey); err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := os.Stat(path); err == nil {
+		l.size = fi.Size()
+	}
+	go l.run()
+	return l, nil
+}
+
+// log queues the record of a query answered with given answer. The record is dropped
+// if the queue is full.
+func (l *queryLogger) log(e *queryLogEntry, answer *dns.Msg) {
+	if l == nil {
+		return
+	}
+	e.Rcode = dns.RcodeToString[answer.Rcode]
+	for _, rr := range answer.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			e.Answers = append(e.Answers, rr.A.String())
+		case *dns.AAAA:
+			e.Answers = append(e.Answers, rr.AAAA.String())
+		}
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.ch <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// run writes queued records, until the logger is closed.
+func (l *queryLogger) run() {
+	defer close(l.done)
+	for e := range l.ch {
+		if err := l.write(e); err != nil {
+			mainLog.Load().Warn().Err(err).Msg("could not write query log")
+		}
+	}
+}
+
+// write writes the record e to the log file, rotating it if needed.
+func (l *queryLogger) write(e *queryLogEntry) error {
+	switch l.privacy {
+	case queryLogPrivacyHash:
+		e.ClientIP = l.hash(e.ClientIP)
+		e.ClientMac = l.hash(e.ClientMac)
+		e.ClientHostname = l.hash(e.ClientHostname)
+	case queryLogPrivacyOmit:
+		e.ClientIP, e.ClientMac, e.ClientHostname = "", "", ""
+	}
+	var buf []byte
+	if l.format == queryLogFormatCSV {
+		buf = csvLine(e.csvRecord())
+	} else {
+		var err error
+		if buf, err = json.Marshal(e); err != nil {
+			return err
+		}
+		buf = append(buf, '\n')
+	}
+
+	if l.size > 0 && l.size+int64(len(buf)) >= l.maxBytes {
+		if err := l.w.Rotate(); err != nil {
+			return err
+		}
+		l.size = 0
+	}
+	if l.size == 0 && l.format == queryLogFormatCSV {
+		n, err := l.w.Write(csvLine(queryLogCSVHeader))
+		l.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.w.Write(buf)
+	l.size += int64(n)
+	return err
+}
+
+// csvLine returns the CSV encoded line of record.
+func csvLine(record []string) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(record)
+	w.Flush()
+	return buf.Bytes()
+}
+
+// hash returns the hash of client identifier s, or empty string if s is empty.
+func (l *queryLogger) hash(s string) string {
+	if s == "" {
+		return ""
+	}
+	h := hmac.New(sha256.New, l.hashKey)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// close writes queued records, then closes the query log file.
+func (l *queryLogger) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.ch)
+	l.mu.Unlock()
+	<-l.done
+	_ = l.w.Close()
+	if dropped := l.dropped.Load(); dropped > 0 {
+		mainLog.Load().Warn().Msgf("%d query log records were dropped, query log could not keep up", dropped)
+	}
+}
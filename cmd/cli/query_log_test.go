@@ -0,0 +1,162 @@
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_queryLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		privacy string
+	}{
+		{"json", "", ""},
+		{"csv", queryLogFormatCSV, ""},
+		{"hash client identifiers", queryLogFormatJSON, queryLogPrivacyHash},
+		{"omit client identifiers", queryLogFormatJSON, queryLogPrivacyOmit},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "query.log")
+			l, err := newQueryLogger(ctrld.ServiceConfig{QueryLogFormat: tc.format, QueryLogPrivacy: tc.privacy}, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			for i := 0; i < 2; i++ {
+				l.log(&queryLogEntry{
+					Time:      time.Now(),
+					ClientIP:  "192.168.1.2",
+					ClientMac: "aa:bb:cc:dd:ee:ff",
+					Listener:  "0",
+					Qname:     "example.com",
+					Qtype:     "A",
+					Upstream:  "upstream.0",
+					LatencyMs: 1.5,
+					Cache:     cacheStatusMiss,
+				}, testAnswer(msg))
+			}
+			l.close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entries []queryLogEntry
+			if tc.format == queryLogFormatCSV {
+				records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(records) == 0 || !reflect.DeepEqual(records[0], queryLogCSVHeader) {
+					t.Fatalf("missing CSV header:\n%s", data)
+				}
+				for _, r := range records[1:] {
+					entries = append(entries, queryLogEntry{ClientIP: r[1], ClientMac: r[2], Qname: r[5], Upstream: r[10], Rcode: r[11], Answers: strings.Fields(r[12]), Cache: r[14]})
+				}
+			} else {
+				dec := json.NewDecoder(strings.NewReader(string(data)))
+				for dec.More() {
+					var e queryLogEntry
+					if err := dec.Decode(&e); err != nil {
+						t.Fatal(err)
+					}
+					entries = append(entries, e)
+				}
+			}
+			if len(entries) != 2 {
+				t.Fatalf("unexpected number of records, want: 2, got: %d\n%s", len(entries), data)
+			}
+			e := entries[0]
+			if e.Qname != "example.com" || e.Upstream != "upstream.0" || e.Rcode != "NOERROR" || e.Cache != cacheStatusMiss {
+				t.Errorf("unexpected record: %+v", e)
+			}
+			if len(e.Answers) != 1 || e.Answers[0] != "192.0.2.1" {
+				t.Errorf("unexpected answers: %v", e.Answers)
+			}
+			switch tc.privacy {
+			case queryLogPrivacyHash:
+				if e.ClientIP == "" || e.ClientIP == "192.168.1.2" || e.ClientMac == "aa:bb:cc:dd:ee:ff" {
+					t.Errorf("client identifiers are not hashed: %+v", e)
+				}
+				if e.ClientIP != entries[1].ClientIP {
+					t.Errorf("hashes of the same client must be the same: %q, %q", e.ClientIP, entries[1].ClientIP)
+				}
+			case queryLogPrivacyOmit:
+				if e.ClientIP != "" || e.ClientMac != "" {
+					t.Errorf("client identifiers are not omitted: %+v", e)
+				}
+			default:
+				if e.ClientIP != "192.168.1.2" || e.ClientMac != "aa:bb:cc:dd:ee:ff" {
+					t.Errorf("unexpected client identifiers: %+v", e)
+				}
+			}
+		})
+	}
+}
+
+func Test_queryLogger_rotateCSV(t *testing.T) {
+	dir := t.TempDir()
+	l, err := newQueryLogger(ctrld.ServiceConfig{QueryLogFormat: queryLogFormatCSV}, filepath.Join(dir, "query.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.maxBytes = 256
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 5; i++ {
+		l.log(&queryLogEntry{Time: time.Now(), Listener: "0", Qname: "example.com", Qtype: "A"}, testAnswer(msg))
+		// Waiting for the record to be written, so rotated files have different names.
+		for len(l.ch) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	l.close()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("query log is not rotated: %v", files)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) < 2 || !reflect.DeepEqual(records[0], queryLogCSVHeader) {
+			t.Errorf("%s: missing CSV header or records:\n%s", f.Name(), data)
+		}
+	}
+}
+
+func Test_queryLogger_drop(t *testing.T) {
+	// Without the writing goroutine, records could not be queued.
+	l := &queryLogger{ch: make(chan *queryLogEntry)}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	l.log(&queryLogEntry{Qname: "example.com"}, testAnswer(msg))
+	if n := l.dropped.Load(); n != 1 {
+		t.Errorf("unexpected dropped records, want: 1, got: %d", n)
+	}
+}
@@ -3,6 +3,8 @@ package cli
 type semaphore interface {
 	acquire()
 	release()
+	// usage returns the number of acquired slots and the capacity, 0 means unlimited.
+	usage() (inUse, capacity int)
 }
 
 type noopSemaphore struct{}
@@ -11,6 +13,8 @@ func (n noopSemaphore) acquire() {}
 
 func (n noopSemaphore) release() {}
 
+func (n noopSemaphore) usage() (int, int) { return 0, 0 }
+
 type chanSemaphore struct {
 	ready chan struct{}
 }
@@ -22,3 +26,7 @@ func (c *chanSemaphore) acquire() {
 func (c *chanSemaphore) release() {
 	<-c.ready
 }
+
+func (c *chanSemaphore) usage() (int, int) {
+	return len(c.ready), cap(c.ready)
+}
@@ -77,6 +77,8 @@ func (um *upstreamMonitor) checkUpstream(upstream string, uc *ctrld.UpstreamConf
 	um.mu.Unlock()
 
 	bo := backoff.NewBackoff("checkUpstream", logf, checkUpstreamMaxBackoff)
+	// Using the upstream resolver, so the check goes through the same interface,
+	// source IP and proxy as normal queries.
 	resolver, err := ctrld.NewResolver(uc)
 	if err != nil {
 		mainLog.Load().Warn().Err(err).Msg("could not check upstream")
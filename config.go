@@ -3,10 +3,12 @@ package ctrld
 import (
 	"context"
 	crand "crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
@@ -44,6 +46,14 @@ const (
 	// depending on the record type of the DNS query.
 	IpStackSplit = "split"
 
+	// CacheScopePerUpstream caches answers separately for each upstream.
+	CacheScopePerUpstream = "per_upstream"
+	// CacheScopeShared shares cached answers between all upstreams.
+	CacheScopeShared = "shared"
+	// CacheScopePerClientGroup caches answers separately for each network of clients,
+	// shared between upstreams.
+	CacheScopePerClientGroup = "per_client_group"
+
 	controlDComDomain = "controld.com"
 	controlDNetDomain = "controld.net"
 	controlDDevDomain = "controld.dev"
@@ -167,22 +177,47 @@ func (c *Config) FirstUpstream() *UpstreamConfig {
 
 // ServiceConfig specifies the general ctrld config.
 type ServiceConfig struct {
-	LogLevel              string `mapstructure:"log_level" toml:"log_level,omitempty"`
-	LogPath               string `mapstructure:"log_path" toml:"log_path,omitempty"`
-	CacheEnable           bool   `mapstructure:"cache_enable" toml:"cache_enable,omitempty"`
-	CacheSize             int    `mapstructure:"cache_size" toml:"cache_size,omitempty"`
-	CacheTTLOverride      int    `mapstructure:"cache_ttl_override" toml:"cache_ttl_override,omitempty"`
-	CacheServeStale       bool   `mapstructure:"cache_serve_stale" toml:"cache_serve_stale,omitempty"`
-	MaxConcurrentRequests *int   `mapstructure:"max_concurrent_requests" toml:"max_concurrent_requests,omitempty" validate:"omitempty,gte=0"`
-	DHCPLeaseFile         string `mapstructure:"dhcp_lease_file_path" toml:"dhcp_lease_file_path" validate:"omitempty,file"`
-	DHCPLeaseFileFormat   string `mapstructure:"dhcp_lease_file_format" toml:"dhcp_lease_file_format" validate:"required_unless=DHCPLeaseFile '',omitempty,oneof=dnsmasq isc-dhcp"`
-	DiscoverMDNS          *bool  `mapstructure:"discover_mdns" toml:"discover_mdns,omitempty"`
-	DiscoverARP           *bool  `mapstructure:"discover_arp" toml:"discover_dhcp,omitempty"`
-	DiscoverDHCP          *bool  `mapstructure:"discover_dhcp" toml:"discover_dhcp,omitempty"`
-	DiscoverPtr           *bool  `mapstructure:"discover_ptr" toml:"discover_ptr,omitempty"`
-	DiscoverHosts         *bool  `mapstructure:"discover_hosts" toml:"discover_hosts,omitempty"`
-	Daemon                bool   `mapstructure:"-" toml:"-"`
-	AllocateIP            bool   `mapstructure:"-" toml:"-"`
+	LogLevel                   string   `mapstructure:"log_level" toml:"log_level,omitempty"`
+	LogPath                    string   `mapstructure:"log_path" toml:"log_path,omitempty"`
+	CacheEnable                bool     `mapstructure:"cache_enable" toml:"cache_enable,omitempty"`
+	CacheSize                  int      `mapstructure:"cache_size" toml:"cache_size,omitempty"`
+	CacheTTLOverride           int      `mapstructure:"cache_ttl_override" toml:"cache_ttl_override,omitempty"`
+	CacheServeStale            bool     `mapstructure:"cache_serve_stale" toml:"cache_serve_stale,omitempty"`
+	MaxConcurrentRequests      *int     `mapstructure:"max_concurrent_requests" toml:"max_concurrent_requests,omitempty" validate:"omitempty,gte=0"`
+	DHCPLeaseFile              string   `mapstructure:"dhcp_lease_file_path" toml:"dhcp_lease_file_path" validate:"omitempty,file"`
+	DHCPLeaseFileFormat        string   `mapstructure:"dhcp_lease_file_format" toml:"dhcp_lease_file_format" validate:"required_unless=DHCPLeaseFile '',omitempty,oneof=dnsmasq isc-dhcp"`
+	DiscoverMDNS               *bool    `mapstructure:"discover_mdns" toml:"discover_mdns,omitempty"`
+	DiscoverARP                *bool    `mapstructure:"discover_arp" toml:"discover_dhcp,omitempty"`
+	DiscoverDHCP               *bool    `mapstructure:"discover_dhcp" toml:"discover_dhcp,omitempty"`
+	DiscoverPtr                *bool    `mapstructure:"discover_ptr" toml:"discover_ptr,omitempty"`
+	DiscoverHosts              *bool    `mapstructure:"discover_hosts" toml:"discover_hosts,omitempty"`
+	BootstrapServers           []string `mapstructure:"bootstrap_servers" toml:"bootstrap_servers,omitempty" validate:"dive,bootstrapserver"`
+	BootstrapIPsMaxAge         int      `mapstructure:"bootstrap_ips_max_age" toml:"bootstrap_ips_max_age,omitempty" validate:"gte=0"`
+	DNSSEC                     bool     `mapstructure:"dnssec" toml:"dnssec,omitempty"`
+	DNSSECTrustAnchors         []string `mapstructure:"dnssec_trust_anchors" toml:"dnssec_trust_anchors,omitempty" validate:"dive,dnssectrustanchor"`
+	DNSSECNegativeTrustAnchors []string `mapstructure:"dnssec_negative_trust_anchors" toml:"dnssec_negative_trust_anchors,omitempty" validate:"dive,dnsname"`
+	CachePersist               bool     `mapstructure:"cache_persist" toml:"cache_persist,omitempty"`
+	CachePersistInterval       int      `mapstructure:"cache_persist_interval" toml:"cache_persist_interval,omitempty" validate:"gte=0"`
+	CachePrefetch              bool     `mapstructure:"cache_prefetch" toml:"cache_prefetch,omitempty"`
+	CachePrefetchThreshold     int      `mapstructure:"cache_prefetch_threshold" toml:"cache_prefetch_threshold,omitempty" validate:"omitempty,gte=1,lte=99"`
+	CachePrefetchMinHits       int      `mapstructure:"cache_prefetch_min_hits" toml:"cache_prefetch_min_hits,omitempty" validate:"gte=0"`
+	CacheMinTTL                int      `mapstructure:"cache_min_ttl" toml:"cache_min_ttl,omitempty" validate:"gte=0"`
+	CacheMaxTTL                int      `mapstructure:"cache_max_ttl" toml:"cache_max_ttl,omitempty" validate:"omitempty,gtefield=CacheMinTTL"`
+	CacheNegativeMaxTTL        int      `mapstructure:"cache_negative_max_ttl" toml:"cache_negative_max_ttl,omitempty" validate:"gte=0"`
+	CacheMaxStale              int      `mapstructure:"cache_max_stale" toml:"cache_max_stale,omitempty" validate:"gte=0"`
+	CacheStaleAnswerTimeout    int      `mapstructure:"cache_stale_answer_timeout" toml:"cache_stale_answer_timeout,omitempty" validate:"gte=0"`
+	CacheMaxBytes              int      `mapstructure:"cache_max_bytes" toml:"cache_max_bytes,omitempty" validate:"omitempty,gte=65536"`
+	CacheScope                 string   `mapstructure:"cache_scope" toml:"cache_scope,omitempty" validate:"omitempty,oneof=per_upstream shared per_client_group"`
+	MetricsListener            string   `mapstructure:"metrics_listener" toml:"metrics_listener,omitempty" validate:"omitempty,hostname_port"`
+	QueryLogPath               string   `mapstructure:"query_log_path" toml:"query_log_path,omitempty"`
+	QueryLogFormat             string   `mapstructure:"query_log_format" toml:"query_log_format,omitempty" validate:"omitempty,oneof=json csv"`
+	QueryLogMaxSize            int      `mapstructure:"query_log_max_size" toml:"query_log_max_size,omitempty" validate:"gte=0"`
+	QueryLogMaxAge             int      `mapstructure:"query_log_max_age" toml:"query_log_max_age,omitempty" validate:"gte=0"`
+	QueryLogMaxBackups         int      `mapstructure:"query_log_max_backups" toml:"query_log_max_backups,omitempty" validate:"gte=0"`
+	QueryLogCompress           bool     `mapstructure:"query_log_compress" toml:"query_log_compress,omitempty"`
+	QueryLogPrivacy            string   `mapstructure:"query_log_privacy" toml:"query_log_privacy,omitempty" validate:"omitempty,oneof=hash omit"`
+	Daemon                     bool     `mapstructure:"-" toml:"-"`
+	AllocateIP                 bool     `mapstructure:"-" toml:"-"`
 }
 
 // NetworkConfig specifies configuration for networks where ctrld will handle requests.
@@ -195,7 +230,7 @@ type NetworkConfig struct {
 // UpstreamConfig specifies configuration for upstreams that ctrld will forward requests to.
 type UpstreamConfig struct {
 	Name        string `mapstructure:"name" toml:"name,omitempty"`
-	Type        string `mapstructure:"type" toml:"type,omitempty" validate:"oneof=doh doh3 dot doq os legacy"`
+	Type        string `mapstructure:"type" toml:"type,omitempty" validate:"oneof=doh doh3 dot doq os legacy dnscrypt odoh recursive"`
 	Endpoint    string `mapstructure:"endpoint" toml:"endpoint,omitempty"`
 	BootstrapIP string `mapstructure:"bootstrap_ip" toml:"bootstrap_ip,omitempty"`
 	Domain      string `mapstructure:"-" toml:"-"`
@@ -204,9 +239,44 @@ type UpstreamConfig struct {
 	// The caller should not access this field directly.
 	// Use UpstreamSendClientInfo instead.
 	SendClientInfo *bool `mapstructure:"send_client_info" toml:"send_client_info,omitempty"`
+	// Method is the HTTP method used for DoH/DoH3 requests.
+	Method string `mapstructure:"method" toml:"method,omitempty" validate:"omitempty,oneof=get post"`
+	// Headers are static HTTP headers sent with DoH/DoH3 requests. A value in form "env:NAME"
+	// is read from environment variable NAME, a value in form "file:/path" is read from file.
+	Headers map[string]string `mapstructure:"headers" toml:"headers,omitempty"`
+	// ClientCert is the path to the TLS client certificate, either a PEM or a PKCS#12 file.
+	ClientCert string `mapstructure:"client_cert" toml:"client_cert,omitempty" validate:"omitempty,file"`
+	// ClientKey is the path to the PEM private key of ClientCert, not used for PKCS#12 file.
+	ClientKey string `mapstructure:"client_key" toml:"client_key,omitempty" validate:"omitempty,file"`
+	// ClientCertPassword is the password of the PKCS#12 file, could be loaded from environment or file like Headers.
+	ClientCertPassword string `mapstructure:"client_cert_password" toml:"client_cert_password,omitempty"`
+	// CAFile is the path to a PEM file of CA certificates, used instead of the default cert pool.
+	CAFile string `mapstructure:"ca_file" toml:"ca_file,omitempty" validate:"omitempty,file"`
+	// SPKIPins is the list of accepted base64 SHA-256 hashes of the upstream certificates SubjectPublicKeyInfo.
+	SPKIPins []string `mapstructure:"spki_pins" toml:"spki_pins,omitempty" validate:"dive,spkipin"`
+	// BootstrapServers overrides service.bootstrap_servers for resolving the upstream domain.
+	BootstrapServers []string `mapstructure:"bootstrap_servers" toml:"bootstrap_servers,omitempty" validate:"dive,bootstrapserver"`
+	// Proxy is the URL of SOCKS5 or HTTP proxy used for connecting to the upstream.
+	Proxy string `mapstructure:"proxy" toml:"proxy,omitempty" validate:"omitempty,upstreamproxy"`
+	// Interface is the network interface which connections to the upstream are bound to.
+	Interface string `mapstructure:"interface" toml:"interface,omitempty"`
+	// SourceIP is the local IP address which connections to the upstream are bound to.
+	SourceIP string `mapstructure:"source_ip" toml:"source_ip,omitempty" validate:"iporempty"`
+	// ODoHProxy is the URL of the proxy which ODoH queries are sent through, the endpoint is the target.
+	ODoHProxy string `mapstructure:"odoh_proxy" toml:"odoh_proxy,omitempty"`
+	// Protocol is the transport protocol of legacy and os upstreams, "udp" (default) or "tcp".
+	Protocol string `mapstructure:"protocol" toml:"protocol,omitempty" validate:"omitempty,oneof=udp tcp"`
+	// ECS is the EDNS Client Subnet policy of the upstream, "pass" (default), "strip" or "replace".
+	ECS string `mapstructure:"ecs" toml:"ecs,omitempty" validate:"omitempty,oneof=pass strip replace"`
+	// ECSSubnet is the IP or CIDR sent as EDNS Client Subnet with "replace" policy,
+	// the public IP is detected if empty.
+	ECSSubnet string `mapstructure:"ecs_subnet" toml:"ecs_subnet,omitempty" validate:"omitempty,ecssubnet"`
+	// ECSDetectServers are the DNS servers queried for detecting the public IP with "replace" policy.
+	ECSDetectServers []string `mapstructure:"ecs_detect_servers" toml:"ecs_detect_servers,omitempty" validate:"dive,ecsdetectserver"`
 
 	g                  singleflight.Group
 	rebootstrap        atomic.Bool
+	bootstrapIPsMu     sync.RWMutex
 	bootstrapIPs       []string
 	bootstrapIPs4      []string
 	bootstrapIPs6      []string
@@ -217,7 +287,23 @@ type UpstreamConfig struct {
 	http3RoundTripper  http.RoundTripper
 	http3RoundTripper4 http.RoundTripper
 	http3RoundTripper6 http.RoundTripper
+	dotPoolsMu         sync.Mutex
+	dotPools           map[string]*dotPool
+	dotSessionCache    tls.ClientSessionCache
+	doqPoolOnce        sync.Once
+	doqPool            *doqConnPool
 	certPool           *x509.CertPool
+	caCertPool         *x509.CertPool
+	spkiPins           [][]byte
+	stampHashes        [][]byte
+	clientCert         *clientCertificate
+	headers            http.Header
+	bootstrap          *bootstrapServers
+	proxy              *proxyDialer
+	dnscrypt           *dnscryptClient
+	odoh               *odohClient
+	ecs                *ecsState
+	recursive          *recursiveClient
 	u                  *url.URL
 	uid                string
 }
@@ -265,14 +351,22 @@ type Rule map[string][]string
 // Init initialized necessary values for an UpstreamConfig.
 func (uc *UpstreamConfig) Init() {
 	uc.uid = upstreamUID()
-	if u, err := url.Parse(uc.Endpoint); err == nil {
+	if strings.HasPrefix(uc.Endpoint, stampPrefix) {
+		uc.initStamp()
+	}
+	// Domain and bootstrap IP of DNSCrypt upstreams are set from the stamp.
+	// Recursive upstreams do not have an endpoint, the root name servers are queried.
+	if uc.Type == ResolverTypeRecursive {
+		uc.recursive = newRecursiveClient(uc, rootHints, "53")
+	}
+	if u, err := url.Parse(uc.Endpoint); err == nil && uc.dnscrypt == nil {
 		uc.Domain = u.Host
 		switch uc.Type {
 		case ResolverTypeDOH, ResolverTypeDOH3:
 			uc.u = u
 		}
 	}
-	if uc.Domain == "" {
+	if uc.Domain == "" && uc.dnscrypt == nil && uc.recursive == nil {
 		if !strings.Contains(uc.Endpoint, ":") {
 			uc.Domain = uc.Endpoint
 			uc.Endpoint = net.JoinHostPort(uc.Endpoint, defaultPortFor(uc.Type))
@@ -283,6 +377,59 @@ func (uc *UpstreamConfig) Init() {
 			uc.BootstrapIP = uc.Domain
 		}
 	}
+	if uc.Type == ResolverTypeODoH {
+		uc.initODoH()
+	}
+	if uc.ECS == ECSReplace {
+		uc.initECS()
+	}
+	if len(uc.Headers) > 0 {
+		uc.headers = uc.httpHeaders()
+	}
+	if uc.CAFile != "" {
+		cp, err := loadCertPool(uc.CAFile)
+		if err != nil {
+			// Using an empty cert pool, so connecting to upstream fails instead of
+			// silently falling back to the default cert pool.
+			ProxyLogger.Load().Error().Err(err).Msgf("could not load CA file: %s", uc.CAFile)
+			cp = x509.NewCertPool()
+		}
+		uc.caCertPool = cp
+	}
+	uc.spkiPins = uc.spkiPins[:0]
+	for _, pin := range uc.SPKIPins {
+		b, err := parseSPKIPin(pin)
+		if err != nil {
+			ProxyLogger.Load().Error().Err(err).Msgf("invalid spki pin: %q", pin)
+			continue
+		}
+		uc.spkiPins = append(uc.spkiPins, b)
+	}
+	if len(uc.SPKIPins) > 0 && len(uc.spkiPins) == 0 {
+		// All pins are invalid, make sure no connection could be made.
+		uc.spkiPins = [][]byte{make([]byte, sha256.Size)}
+	}
+	if len(uc.BootstrapServers) > 0 {
+		bs, err := newBootstrapServers(uc.BootstrapServers)
+		if err != nil {
+			ProxyLogger.Load().Error().Err(err).Msgf("invalid bootstrap servers for upstream: %s", uc.Name)
+		}
+		uc.bootstrap = bs
+	}
+	if uc.Proxy != "" {
+		pd, err := newProxyDialer(uc.Proxy, uc.bindDialer(newDialer(uc.bootstrapServers()), "tcp"))
+		if err != nil {
+			ProxyLogger.Load().Error().Err(err).Msgf("invalid proxy for upstream: %s", uc.Name)
+		}
+		uc.proxy = pd
+	}
+	if uc.ClientCert != "" {
+		password, err := secretValue(uc.ClientCertPassword)
+		if err != nil {
+			ProxyLogger.Load().Error().Err(err).Msg("could not load client certificate password")
+		}
+		uc.clientCert = newClientCertificate(uc.ClientCert, uc.ClientKey, password)
+	}
 	if uc.IPStack == "" {
 		if uc.isControlD() {
 			uc.IPStack = IpStackSplit
@@ -292,6 +439,25 @@ func (uc *UpstreamConfig) Init() {
 	}
 }
 
+// httpHeaders returns the custom HTTP headers of the upstream, secret values
+// are loaded from environment variables or files.
+func (uc *UpstreamConfig) httpHeaders() http.Header {
+	h := make(http.Header, len(uc.Headers))
+	for name, value := range uc.Headers {
+		if isClientInfoHeader(name) {
+			ProxyLogger.Load().Warn().Msgf("ignoring header %q, client info is controlled by send_client_info", name)
+			continue
+		}
+		v, err := secretValue(value)
+		if err != nil {
+			ProxyLogger.Load().Error().Err(err).Msgf("could not load value for header %q", name)
+			continue
+		}
+		h.Set(name, v)
+	}
+	return h
+}
+
 // VerifyDomain returns the domain name that could be resolved by the upstream endpoint.
 // It returns empty for non-ControlD upstream endpoint.
 func (uc *UpstreamConfig) VerifyDomain() string {
@@ -331,9 +497,41 @@ func (uc *UpstreamConfig) UpstreamSendClientInfo() bool {
 
 // BootstrapIPs returns the bootstrap IPs list of upstreams.
 func (uc *UpstreamConfig) BootstrapIPs() []string {
+	uc.bootstrapIPsMu.RLock()
+	defer uc.bootstrapIPsMu.RUnlock()
 	return uc.bootstrapIPs
 }
 
+// bootstrapIPsByStack returns all bootstrap IPs, the IPv4 and IPv6 ones.
+func (uc *UpstreamConfig) bootstrapIPsByStack() ([]string, []string, []string) {
+	uc.bootstrapIPsMu.RLock()
+	defer uc.bootstrapIPsMu.RUnlock()
+	return uc.bootstrapIPs, uc.bootstrapIPs4, uc.bootstrapIPs6
+}
+
+// setBootstrapIPs sets the bootstrap IPs of the upstream.
+func (uc *UpstreamConfig) setBootstrapIPs(ips []string) {
+	var ips4, ips6 []string
+	for _, ip := range ips {
+		if ctrldnet.IsIPv6(ip) {
+			ips6 = append(ips6, ip)
+		} else {
+			ips4 = append(ips4, ip)
+		}
+	}
+	uc.bootstrapIPsMu.Lock()
+	defer uc.bootstrapIPsMu.Unlock()
+	uc.bootstrapIPs, uc.bootstrapIPs4, uc.bootstrapIPs6 = ips, ips4, ips6
+}
+
+// bootstrapServers returns the bootstrap servers used for resolving the upstream domain.
+func (uc *UpstreamConfig) bootstrapServers() *bootstrapServers {
+	if uc.bootstrap != nil {
+		return uc.bootstrap
+	}
+	return currentBootstrapServers()
+}
+
 // SetCertPool sets the system cert pool used for TLS connections.
 func (uc *UpstreamConfig) SetCertPool(cp *x509.CertPool) {
 	uc.certPool = cp
@@ -342,9 +540,42 @@ func (uc *UpstreamConfig) SetCertPool(cp *x509.CertPool) {
 // SetupBootstrapIP manually find all available IPs of the upstream.
 // The first usable IP will be used as bootstrap IP of the upstream.
 func (uc *UpstreamConfig) SetupBootstrapIP() {
+	if uc.recursive != nil {
+		// Recursive upstreams query the root name servers by their IP addresses.
+		return
+	}
+	if uc.proxy != nil && uc.proxy.resolvesRemotely() {
+		ProxyLogger.Load().Debug().Msgf("upstream domain is resolved by proxy: %s", uc.Domain)
+		return
+	}
 	uc.setupBootstrapIP(true)
 }
 
+// SetupBootstrapIPWithCache is like SetupBootstrapIP, but uses the cached bootstrap IPs if
+// available, so the upstream is usable immediately, then refreshes them in background.
+// The resolved bootstrap IPs are saved to the cache.
+func (uc *UpstreamConfig) SetupBootstrapIPWithCache(c *BootstrapIPCache) {
+	if uc.recursive != nil {
+		return
+	}
+	if uc.proxy != nil && uc.proxy.resolvesRemotely() {
+		uc.SetupBootstrapIP()
+		return
+	}
+	if ips := c.get(uc.Domain); len(ips) > 0 {
+		ProxyLogger.Load().Debug().Msgf("using cached bootstrap IPs: %v", ips)
+		uc.setBootstrapIPs(ips)
+		go func() {
+			uc.setupBootstrapIP(true)
+			c.set(uc.Domain, uc.BootstrapIPs())
+			uc.ReBootstrap()
+		}()
+		return
+	}
+	uc.setupBootstrapIP(true)
+	c.set(uc.Domain, uc.BootstrapIPs())
+}
+
 // UID returns the unique identifier of the upstream.
 func (uc *UpstreamConfig) UID() string {
 	return uc.uid
@@ -355,41 +586,40 @@ func (uc *UpstreamConfig) UID() string {
 func (uc *UpstreamConfig) setupBootstrapIP(withBootstrapDNS bool) {
 	b := backoff.NewBackoff("setupBootstrapIP", func(format string, args ...any) {}, 10*time.Second)
 	isControlD := uc.isControlD()
+	var bs *bootstrapServers
+	if withBootstrapDNS {
+		bs = uc.bootstrapServers()
+	}
+	var ips []string
 	for {
-		uc.bootstrapIPs = lookupIP(uc.Domain, uc.Timeout, withBootstrapDNS)
+		ips = lookupIP(uc.Domain, uc.Timeout, bs)
 		// For ControlD upstream, the bootstrap IPs could not be RFC 1918 addresses,
 		// filtering them out here to prevent weird behavior.
 		if isControlD {
 			n := 0
-			for _, ip := range uc.bootstrapIPs {
+			for _, ip := range ips {
 				netIP := net.ParseIP(ip)
 				if netIP != nil && !netIP.IsPrivate() {
-					uc.bootstrapIPs[n] = ip
+					ips[n] = ip
 					n++
 				}
 			}
-			uc.bootstrapIPs = uc.bootstrapIPs[:n]
+			ips = ips[:n]
 		}
-		if len(uc.bootstrapIPs) > 0 {
+		if len(ips) > 0 {
 			break
 		}
 		ProxyLogger.Load().Warn().Msg("could not resolve bootstrap IPs, retrying...")
 		b.BackOff(context.Background(), errors.New("no bootstrap IPs"))
 	}
-	for _, ip := range uc.bootstrapIPs {
-		if ctrldnet.IsIPv6(ip) {
-			uc.bootstrapIPs6 = append(uc.bootstrapIPs6, ip)
-		} else {
-			uc.bootstrapIPs4 = append(uc.bootstrapIPs4, ip)
-		}
-	}
-	ProxyLogger.Load().Debug().Msgf("bootstrap IPs: %v", uc.bootstrapIPs)
+	uc.setBootstrapIPs(ips)
+	ProxyLogger.Load().Debug().Msgf("bootstrap IPs: %v", ips)
 }
 
 // ReBootstrap re-setup the bootstrap IP and the transport.
 func (uc *UpstreamConfig) ReBootstrap() {
 	switch uc.Type {
-	case ResolverTypeDOH, ResolverTypeDOH3:
+	case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeODoH:
 	default:
 		return
 	}
@@ -401,10 +631,10 @@ func (uc *UpstreamConfig) ReBootstrap() {
 }
 
 // SetupTransport initializes the network transport used to connect to upstream server.
-// For now, only DoH upstream is supported.
+// For now, only DoH and ODoH upstreams are supported.
 func (uc *UpstreamConfig) SetupTransport() {
 	switch uc.Type {
-	case ResolverTypeDOH:
+	case ResolverTypeDOH, ResolverTypeODoH:
 		uc.setupDOHTransport()
 	case ResolverTypeDOH3:
 		uc.setupDOH3Transport()
@@ -412,31 +642,33 @@ func (uc *UpstreamConfig) SetupTransport() {
 }
 
 func (uc *UpstreamConfig) setupDOHTransport() {
+	ips, ips4, ips6 := uc.bootstrapIPsByStack()
 	switch uc.IPStack {
 	case IpStackBoth, "":
-		uc.transport = uc.newDOHTransport(uc.bootstrapIPs)
+		uc.transport = uc.newDOHTransport(ips)
 	case IpStackV4:
-		uc.transport = uc.newDOHTransport(uc.bootstrapIPs4)
+		uc.transport = uc.newDOHTransport(ips4)
 	case IpStackV6:
-		uc.transport = uc.newDOHTransport(uc.bootstrapIPs6)
+		uc.transport = uc.newDOHTransport(ips6)
 	case IpStackSplit:
-		uc.transport4 = uc.newDOHTransport(uc.bootstrapIPs4)
+		uc.transport4 = uc.newDOHTransport(ips4)
 		if hasIPv6() {
-			uc.transport6 = uc.newDOHTransport(uc.bootstrapIPs6)
+			uc.transport6 = uc.newDOHTransport(ips6)
 		} else {
 			uc.transport6 = uc.transport4
 		}
-		uc.transport = uc.newDOHTransport(uc.bootstrapIPs)
+		uc.transport = uc.newDOHTransport(ips)
 	}
 }
 
 func (uc *UpstreamConfig) newDOHTransport(addrs []string) *http.Transport {
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.MaxIdleConnsPerHost = 100
-	transport.TLSClientConfig = &tls.Config{
-		RootCAs:            uc.certPool,
-		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	transport.TLSClientConfig = uc.newTLSConfig()
+	if uc.Type == ResolverTypeODoH {
+		transport.TLSClientConfig = uc.newODoHProxyTLSConfig()
 	}
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
 
 	dialerTimeoutMs := 2000
 	if uc.Timeout > 0 && uc.Timeout < dialerTimeoutMs {
@@ -445,15 +677,16 @@ func (uc *UpstreamConfig) newDOHTransport(addrs []string) *http.Transport {
 	dialerTimeout := time.Duration(dialerTimeoutMs) * time.Millisecond
 	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		_, port, _ := net.SplitHostPort(addr)
+		if uc.proxy != nil {
+			return uc.dialDOHProxy(ctx, network, addr, addrs)
+		}
+		dialer := uc.bindDialer(&net.Dialer{Timeout: dialerTimeout, KeepAlive: dialerTimeout}, network)
 		if uc.BootstrapIP != "" {
-			dialer := net.Dialer{Timeout: dialerTimeout, KeepAlive: dialerTimeout}
 			addr := net.JoinHostPort(uc.BootstrapIP, port)
 			Log(ctx, ProxyLogger.Load().Debug(), "sending doh request to: %s", addr)
 			return dialer.DialContext(ctx, network, addr)
 		}
-		pd := &ctrldnet.ParallelDialer{}
-		pd.Timeout = dialerTimeout
-		pd.KeepAlive = dialerTimeout
+		pd := &ctrldnet.ParallelDialer{Dialer: *dialer}
 		dialAddrs := make([]string, len(addrs))
 		for i := range addrs {
 			dialAddrs[i] = net.JoinHostPort(addrs[i], port)
@@ -471,6 +704,28 @@ func (uc *UpstreamConfig) newDOHTransport(addrs []string) *http.Transport {
 	return transport
 }
 
+// dialDOHProxy dials the DoH upstream through the proxy. If the proxy resolves the upstream
+// domain remotely, the domain is sent to the proxy, otherwise the bootstrap IPs are used.
+func (uc *UpstreamConfig) dialDOHProxy(ctx context.Context, network, addr string, addrs []string) (net.Conn, error) {
+	_, port, _ := net.SplitHostPort(addr)
+	dialAddrs := []string{addr}
+	switch {
+	case uc.BootstrapIP != "":
+		dialAddrs = []string{net.JoinHostPort(uc.BootstrapIP, port)}
+	case !uc.proxy.resolvesRemotely() && len(addrs) > 0:
+		dialAddrs = make([]string, len(addrs))
+		for i := range addrs {
+			dialAddrs[i] = net.JoinHostPort(addrs[i], port)
+		}
+	}
+	conn, err := uc.proxy.dialAny(ctx, network, dialAddrs)
+	if err != nil {
+		return nil, err
+	}
+	Log(ctx, ProxyLogger.Load().Debug(), "sending doh request via proxy to: %s", conn.RemoteAddr())
+	return conn, nil
+}
+
 // Ping warms up the connection to DoH/DoH3 upstream.
 func (uc *UpstreamConfig) Ping() {
 	switch uc.Type {
@@ -541,6 +796,8 @@ func (uc *UpstreamConfig) dohTransport(dnsType uint16) http.RoundTripper {
 }
 
 func (uc *UpstreamConfig) bootstrapIPForDNSType(dnsType uint16) string {
+	uc.bootstrapIPsMu.RLock()
+	defer uc.bootstrapIPsMu.RUnlock()
 	switch uc.IPStack {
 	case IpStackBoth:
 		return pick(uc.bootstrapIPs)
@@ -599,6 +856,13 @@ func ValidateConfig(validate *validator.Validate, cfg *Config) error {
 	_ = validate.RegisterValidation("dnsrcode", validateDnsRcode)
 	_ = validate.RegisterValidation("ipstack", validateIpStack)
 	_ = validate.RegisterValidation("iporempty", validateIpOrEmpty)
+	_ = validate.RegisterValidation("spkipin", validateSPKIPin)
+	_ = validate.RegisterValidation("bootstrapserver", validateBootstrapServer)
+	_ = validate.RegisterValidation("upstreamproxy", validateUpstreamProxy)
+	_ = validate.RegisterValidation("ecssubnet", validateECSSubnet)
+	_ = validate.RegisterValidation("ecsdetectserver", validateECSDetectServer)
+	_ = validate.RegisterValidation("dnssectrustanchor", validateDNSSECTrustAnchor)
+	_ = validate.RegisterValidation("dnsname", validateDNSName)
 	validate.RegisterStructValidation(upstreamConfigStructLevelValidation, UpstreamConfig{})
 	return validate.Struct(cfg)
 }
@@ -616,6 +880,21 @@ func validateIpStack(fl validator.FieldLevel) bool {
 	}
 }
 
+func validateSPKIPin(fl validator.FieldLevel) bool {
+	_, err := parseSPKIPin(fl.Field().String())
+	return err == nil
+}
+
+func validateBootstrapServer(fl validator.FieldLevel) bool {
+	_, _, err := parseBootstrapServer(fl.Field().String())
+	return err == nil
+}
+
+func validateUpstreamProxy(fl validator.FieldLevel) bool {
+	_, err := newProxyDialer(fl.Field().String(), &net.Dialer{})
+	return err == nil
+}
+
 func validateIpOrEmpty(fl validator.FieldLevel) bool {
 	val := fl.Field().String()
 	if val == "" {
@@ -624,35 +903,114 @@ func validateIpOrEmpty(fl validator.FieldLevel) bool {
 	return net.ParseIP(val) != nil
 }
 
+func validateECSSubnet(fl validator.FieldLevel) bool {
+	_, err := parseECSSubnet(fl.Field().String())
+	return err == nil
+}
+
+func validateECSDetectServer(fl validator.FieldLevel) bool {
+	_, err := parseECSDetectServer(fl.Field().String())
+	return err == nil
+}
+
+func validateDNSSECTrustAnchor(fl validator.FieldLevel) bool {
+	_, err := parseTrustAnchor(fl.Field().String())
+	return err == nil
+}
+
+func validateDNSName(fl validator.FieldLevel) bool {
+	_, ok := dns.IsDomainName(fl.Field().String())
+	return ok
+}
+
 func upstreamConfigStructLevelValidation(sl validator.StructLevel) {
 	uc := sl.Current().Addr().Interface().(*UpstreamConfig)
 	if uc.Type == ResolverTypeOS {
 		return
 	}
 
-	// Endpoint is required for non os resolver.
-	if uc.Endpoint == "" {
+	// Endpoint is required for non os and recursive resolver.
+	if uc.Endpoint == "" && uc.Type != ResolverTypeRecursive {
 		sl.ReportError(uc.Endpoint, "endpoint", "Endpoint", "required_unless", "")
 		return
 	}
 
-	// DoH/DoH3 requires endpoint is an HTTP url.
-	if uc.Type == ResolverTypeDOH || uc.Type == ResolverTypeDOH3 {
-		u, err := url.Parse(uc.Endpoint)
-		if err != nil || u.Host == "" {
-			sl.ReportError(uc.Endpoint, "endpoint", "Endpoint", "http_url", "")
+	// Client info headers must only be controlled by send_client_info.
+	for name := range uc.Headers {
+		if isClientInfoHeader(name) {
+			sl.ReportError(uc.Headers, "headers", "Headers", "client_info_header", name)
+			return
+		}
+	}
+
+	// Proxy only supports TCP based upstreams.
+	if uc.Proxy != "" {
+		switch uc.Type {
+		case ResolverTypeDOH, ResolverTypeODoH, ResolverTypeDOT, ResolverTypeLegacy:
+		default:
+			sl.ReportError(uc.Proxy, "proxy", "Proxy", "proxy_type", uc.Type)
 			return
 		}
-		if u.Scheme != "http" && u.Scheme != "https" {
+	}
+
+	// Protocol only applies to plain DNS upstreams.
+	if uc.Protocol != "" {
+		switch uc.Type {
+		case ResolverTypeLegacy, ResolverTypeOS:
+		default:
+			sl.ReportError(uc.Protocol, "protocol", "Protocol", "protocol_type", uc.Type)
+			return
+		}
+	}
+
+	// PEM client certificate requires a private key file.
+	if uc.ClientCert != "" && uc.ClientKey == "" && !isPKCS12File(uc.ClientCert) {
+		sl.ReportError(uc.ClientKey, "client_key", "ClientKey", "required_with", "client_cert")
+		return
+	}
+
+	// DNS stamp must describe an upstream of the same type, DNSCrypt requires a stamp.
+	if strings.HasPrefix(uc.Endpoint, stampPrefix) || uc.Type == ResolverTypeDNSCrypt {
+		st, err := parseStamp(uc.Endpoint)
+		if err != nil || !st.supportsType(uc.Type) {
+			sl.ReportError(uc.Endpoint, "endpoint", "Endpoint", "sdns_stamp", uc.Type)
+		}
+		return
+	}
+
+	// DoH/DoH3/ODoH requires endpoint is an HTTP url.
+	if uc.Type == ResolverTypeDOH || uc.Type == ResolverTypeDOH3 || uc.Type == ResolverTypeODoH {
+		if !isHTTPURL(uc.Endpoint) {
 			sl.ReportError(uc.Endpoint, "endpoint", "Endpoint", "http_url", "")
 			return
 		}
 	}
+
+	// ODoH requires the proxy is an HTTP url.
+	if uc.Type == ResolverTypeODoH {
+		if uc.ODoHProxy == "" {
+			sl.ReportError(uc.ODoHProxy, "odoh_proxy", "ODoHProxy", "required", "")
+			return
+		}
+		if !isHTTPURL(uc.ODoHProxy) {
+			sl.ReportError(uc.ODoHProxy, "odoh_proxy", "ODoHProxy", "http_url", "")
+			return
+		}
+	}
+}
+
+// isHTTPURL reports whether s is an HTTP or HTTPS url.
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
 }
 
 func defaultPortFor(typ string) string {
 	switch typ {
-	case ResolverTypeDOH, ResolverTypeDOH3:
+	case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeDNSCrypt, ResolverTypeODoH:
 		return "443"
 	case ResolverTypeDOQ, ResolverTypeDOT:
 		return "853"
@@ -668,9 +1026,15 @@ func defaultPortFor(typ string) string {
 // - If endpoint is an IP address ->  ResolverTypeLegacy
 // - If endpoint starts with "https://" -> ResolverTypeDOH
 // - If endpoint starts with "quic://" -> ResolverTypeDOQ
+// - If endpoint is a "sdns://" stamp -> the type described by the stamp, ResolverTypeDNSCrypt if invalid
 // - For anything else -> ResolverTypeDOT
 func ResolverTypeFromEndpoint(endpoint string) string {
 	switch {
+	case strings.HasPrefix(endpoint, stampPrefix):
+		if st, err := parseStamp(endpoint); err == nil {
+			return st.resolverType()
+		}
+		return ResolverTypeDNSCrypt
 	case strings.HasPrefix(endpoint, "https://"):
 		return ResolverTypeDOH
 	case strings.HasPrefix(endpoint, "quic://"):
@@ -686,6 +1050,30 @@ func ResolverTypeFromEndpoint(endpoint string) string {
 	return ResolverTypeDOT
 }
 
+// secretValue returns the value of a config setting, which could be:
+//
+//   - "env:NAME": read from the environment variable NAME.
+//   - "file:/path": read from the file at /path, with surrounding spaces trimmed.
+//   - anything else: used as-is.
+func secretValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return value, nil
+}
+
 func pick(s []string) string {
 	return s[rand.Intn(len(s))]
 }
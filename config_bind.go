@@ -0,0 +1,95 @@
+package ctrld
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// bindEnabled reports whether the upstream traffic must be bound to an interface or a source IP.
+func (uc *UpstreamConfig) bindEnabled() bool {
+	return uc.Interface != "" || uc.SourceIP != ""
+}
+
+// bindDialer returns a copy of d, which binds connections of given network to the upstream
+// interface and source IP. If there's no binding configured, d is returned as-is.
+func (uc *UpstreamConfig) bindDialer(d *net.Dialer, network string) *net.Dialer {
+	if !uc.bindEnabled() {
+		return d
+	}
+	bd := *d
+	if ip := uc.localIP(network); ip != nil {
+		if strings.HasPrefix(network, "udp") {
+			bd.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			bd.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if uc.Interface != "" {
+		bd.Control = bindToDeviceControl(uc.Interface)
+	}
+	return &bd
+}
+
+// listenUDP returns an UDP socket for QUIC connections, bound like bindDialer does.
+func (uc *UpstreamConfig) listenUDP(ctx context.Context) (net.PacketConn, error) {
+	lc := net.ListenConfig{}
+	addr := ":0"
+	if ip := uc.localIP("udp"); ip != nil {
+		addr = net.JoinHostPort(ip.String(), "0")
+	}
+	if uc.Interface != "" {
+		lc.Control = bindToDeviceControl(uc.Interface)
+	}
+	return lc.ListenPacket(ctx, "udp", addr)
+}
+
+// localIP returns the local IP address which connections of given network are bound to, if any.
+func (uc *UpstreamConfig) localIP(network string) net.IP {
+	if uc.SourceIP != "" {
+		return net.ParseIP(uc.SourceIP)
+	}
+	if uc.Interface == "" || bindToDeviceSupported {
+		return nil
+	}
+	// Binding to interface is not supported, using the interface address instead.
+	return interfaceIP(uc.Interface, network)
+}
+
+// interfaceIP returns the first non link-local address of given interface, which is usable
+// for given network. For dual stack networks, IPv4 address is preferred.
+func interfaceIP(name, network string) net.IP {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("could not find interface: %s", name)
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("could not get addresses of interface: %s", name)
+		return nil
+	}
+	var ip4, ip6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if ip4 == nil {
+				ip4 = ipNet.IP
+			}
+		} else if ip6 == nil {
+			ip6 = ipNet.IP
+		}
+	}
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ip4
+	case strings.HasSuffix(network, "6"):
+		return ip6
+	case ip4 != nil:
+		return ip4
+	}
+	return ip6
+}
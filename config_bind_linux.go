@@ -0,0 +1,19 @@
+package ctrld
+
+import "syscall"
+
+// bindToDeviceSupported reports whether sockets could be bound to an interface.
+const bindToDeviceSupported = true
+
+// bindToDeviceControl returns a function binding sockets to given interface, using SO_BINDTODEVICE.
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), iface)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package ctrld
+
+import "syscall"
+
+// bindToDeviceSupported reports whether sockets could be bound to an interface.
+const bindToDeviceSupported = false
+
+// bindToDeviceControl returns nil, since binding sockets to an interface is not supported,
+// the interface address is used as source IP instead.
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,136 @@
+package ctrld
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_legacyResolver_bind(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 and SO_BINDTODEVICE are only available on Linux")
+	}
+	srv := newTestRemoteAddrServer(t)
+	tests := []struct {
+		name      string
+		iface     string
+		sourceIP  string
+		wantErr   bool
+		wantLocal string
+	}{
+		{"source ip", "", "127.0.0.2", false, "127.0.0.2"},
+		{"interface", "lo", "", false, "127.0.0.1"},
+		{"interface and source ip", "lo", "127.0.0.3", false, "127.0.0.3"},
+		{"non-existed interface", "ctrld-invalid0", "", true, ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			uc := &UpstreamConfig{
+				Name:      "test",
+				Type:      ResolverTypeLegacy,
+				Endpoint:  srv.addr,
+				Timeout:   5000,
+				Interface: tc.iface,
+				SourceIP:  tc.sourceIP,
+			}
+			uc.Init()
+			r := &legacyResolver{uc: uc}
+			_, err := r.Resolve(context.Background(), testQuery("example.com."))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := srv.lastRemoteIP(); got != tc.wantLocal {
+				t.Errorf("unexpected source ip, want: %s, got: %s", tc.wantLocal, got)
+			}
+		})
+	}
+}
+
+func Test_dotResolver_sourceIP(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 is only available on Linux")
+	}
+	srv := newTestDoTServer(t)
+	uc := srv.upstreamConfig()
+	uc.SourceIP = "127.0.0.2"
+	r := &dotResolver{uc: uc}
+	if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.conns) != 1 {
+		t.Fatalf("unexpected number of connections: %d", len(srv.conns))
+	}
+	if ip := srv.conns[0].RemoteAddr().(*net.TCPAddr).IP.String(); ip != "127.0.0.2" {
+		t.Errorf("unexpected source ip: %s", ip)
+	}
+}
+
+func Test_interfaceIP(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if ip := interfaceIP(iface.Name, "tcp4"); !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("unexpected ipv4 address of %s: %v", iface.Name, ip)
+		}
+		if ip := interfaceIP(iface.Name, "udp"); ip.To4() == nil {
+			t.Errorf("ipv4 address must be preferred, got: %v", ip)
+		}
+		return
+	}
+	t.Skip("no loopback interface")
+}
+
+// testRemoteAddrServer is a plain DNS server, recording the remote address of queries.
+type testRemoteAddrServer struct {
+	addr string
+
+	mu       sync.Mutex
+	remoteIP string
+}
+
+func newTestRemoteAddrServer(t *testing.T) *testRemoteAddrServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testRemoteAddrServer{addr: pc.LocalAddr().String()}
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+			s.mu.Lock()
+			s.remoteIP = host
+			s.mu.Unlock()
+			answer, _ := staticResolver("127.0.0.2").Resolve(context.Background(), m)
+			_ = w.WriteMsg(answer)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return s
+}
+
+func (s *testRemoteAddrServer) lastRemoteIP() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remoteIP
+}
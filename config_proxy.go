@@ -0,0 +1,165 @@
+package ctrld
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var errUnsupportedProxyScheme = errors.New("unsupported proxy scheme")
+
+// contextDialer is the interface implemented by dialers used for connecting to upstreams.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// proxyDialer dials connections to upstream through a proxy.
+type proxyDialer struct {
+	dialer contextDialer
+	// resolver is used for resolving the upstream domain before sending it to the proxy.
+	// If nil, the proxy resolves the domain remotely.
+	resolver *net.Resolver
+}
+
+// newProxyDialer returns a proxyDialer for given proxy URL. Supported schemes are:
+//
+//   - socks5: SOCKS5 proxy, the upstream domain is resolved locally.
+//   - socks5h: SOCKS5 proxy, the upstream domain is resolved by the proxy.
+//   - http: HTTP CONNECT proxy, the upstream domain is resolved by the proxy.
+//
+// The forward dialer is used for connecting to the proxy, and resolving the upstream domain locally.
+func newProxyDialer(rawURL string, forward *net.Dialer) (*proxyDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing proxy host: %q", rawURL)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, err
+		}
+		pd := &proxyDialer{dialer: d.(contextDialer)}
+		if u.Scheme == "socks5" {
+			pd.resolver = forward.Resolver
+			if pd.resolver == nil {
+				pd.resolver = net.DefaultResolver
+			}
+		}
+		return pd, nil
+	case "http":
+		d := &httpConnectDialer{addr: u.Host, forward: forward}
+		if u.Port() == "" {
+			d.addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		}
+		return &proxyDialer{dialer: d}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", errUnsupportedProxyScheme, u.Scheme)
+}
+
+// resolvesRemotely reports whether the proxy resolves the upstream domain.
+func (d *proxyDialer) resolvesRemotely() bool {
+	return d.resolver == nil
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.resolver != nil {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			ips, err := d.resolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			addr = net.JoinHostPort(ips[0], port)
+		}
+	}
+	return d.dialer.DialContext(ctx, network, addr)
+}
+
+// dialAny dials the given addresses in order, returning the first successful connection.
+func (d *proxyDialer) dialAny(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// httpConnectDialer dials connections through an HTTP proxy, using CONNECT method.
+type httpConnectDialer struct {
+	addr    string
+	auth    string
+	forward contextDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http proxy: unsupported network: %s", network)
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The response body is not closed, the connection is now the tunnel,
+	// and closing the body would read from it.
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy: %s", resp.Status)
+	}
+	// The proxy must not send any data before the client does.
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("http proxy: unexpected data after CONNECT response")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -20,36 +20,37 @@ import (
 )
 
 func (uc *UpstreamConfig) setupDOH3Transport() {
+	ips, ips4, ips6 := uc.bootstrapIPsByStack()
 	switch uc.IPStack {
 	case IpStackBoth, "":
-		uc.http3RoundTripper = uc.newDOH3Transport(uc.bootstrapIPs)
+		uc.http3RoundTripper = uc.newDOH3Transport(ips)
 	case IpStackV4:
-		uc.http3RoundTripper = uc.newDOH3Transport(uc.bootstrapIPs4)
+		uc.http3RoundTripper = uc.newDOH3Transport(ips4)
 	case IpStackV6:
-		uc.http3RoundTripper = uc.newDOH3Transport(uc.bootstrapIPs6)
+		uc.http3RoundTripper = uc.newDOH3Transport(ips6)
 	case IpStackSplit:
-		uc.http3RoundTripper4 = uc.newDOH3Transport(uc.bootstrapIPs4)
+		uc.http3RoundTripper4 = uc.newDOH3Transport(ips4)
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
 		if ctrldnet.IPv6Available(ctx) {
-			uc.http3RoundTripper6 = uc.newDOH3Transport(uc.bootstrapIPs6)
+			uc.http3RoundTripper6 = uc.newDOH3Transport(ips6)
 		} else {
 			uc.http3RoundTripper6 = uc.http3RoundTripper4
 		}
-		uc.http3RoundTripper = uc.newDOH3Transport(uc.bootstrapIPs)
+		uc.http3RoundTripper = uc.newDOH3Transport(ips)
 	}
 }
 
 func (uc *UpstreamConfig) newDOH3Transport(addrs []string) http.RoundTripper {
 	rt := &http3.RoundTripper{}
-	rt.TLSClientConfig = &tls.Config{RootCAs: uc.certPool}
+	rt.TLSClientConfig = uc.newTLSConfig()
 	rt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
 		_, port, _ := net.SplitHostPort(addr)
 		// if we have a bootstrap ip set, use it to avoid DNS lookup
 		if uc.BootstrapIP != "" {
 			addr = net.JoinHostPort(uc.BootstrapIP, port)
 			ProxyLogger.Load().Debug().Msgf("sending doh3 request to: %s", addr)
-			udpConn, err := net.ListenUDP("udp", nil)
+			udpConn, err := uc.listenUDP(ctx)
 			if err != nil {
 				return nil, err
 			}
@@ -63,7 +64,7 @@ func (uc *UpstreamConfig) newDOH3Transport(addrs []string) http.RoundTripper {
 		for i := range addrs {
 			dialAddrs[i] = net.JoinHostPort(addrs[i], port)
 		}
-		pd := &quicParallelDialer{}
+		pd := &quicParallelDialer{listenUDP: uc.listenUDP}
 		conn, err := pd.Dial(ctx, dialAddrs, tlsCfg, cfg)
 		if err != nil {
 			return nil, err
@@ -107,7 +108,9 @@ type parallelDialerResult struct {
 	err  error
 }
 
-type quicParallelDialer struct{}
+type quicParallelDialer struct {
+	listenUDP func(ctx context.Context) (net.PacketConn, error)
+}
 
 // Dial performs parallel dialing to the given address list.
 func (d *quicParallelDialer) Dial(ctx context.Context, addrs []string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
@@ -127,7 +130,7 @@ func (d *quicParallelDialer) Dial(ctx context.Context, addrs []string, tlsCfg *t
 		close(ch)
 	}()
 
-	udpConn, err := net.ListenUDP("udp", nil)
+	udpConn, err := d.listenUDP(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,247 @@
+package ctrld
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// spkiPinPrefix is the optional prefix of a SPKI pin, as used by HPKP pin-sha256 directive.
+const spkiPinPrefix = "sha256/"
+
+var (
+	errSPKIPinMismatch   = errors.New("spki pin mismatch")
+	errStampHashMismatch = errors.New("stamp certificate hash mismatch")
+)
+
+// newTLSConfig returns the base TLS config used by all encrypted transports of the upstream.
+func (uc *UpstreamConfig) newTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{RootCAs: uc.certPool}
+	if uc.CAFile != "" {
+		tlsConfig.RootCAs = uc.caCertPool
+	}
+	if uc.clientCert != nil {
+		tlsConfig.GetClientCertificate = uc.clientCert.getClientCertificate
+	}
+	if len(uc.spkiPins) > 0 || len(uc.stampHashes) > 0 {
+		tlsConfig.VerifyConnection = uc.verifyConnection
+	}
+	return tlsConfig
+}
+
+// verifyConnection verifies the upstream certificate chain against the configured
+// SPKI pins and the certificate hashes of the DNS stamp endpoint.
+func (uc *UpstreamConfig) verifyConnection(cs tls.ConnectionState) error {
+	if len(uc.spkiPins) > 0 {
+		if err := uc.verifySPKIPins(cs); err != nil {
+			return err
+		}
+	}
+	if len(uc.stampHashes) > 0 {
+		return uc.verifyStampHashes(cs)
+	}
+	return nil
+}
+
+// verifySPKIPins ensures that at least one certificate in the upstream certificate chain
+// matches one of the configured SPKI pins. Since it's called after the normal certificate
+// verification, the pins are checked against the verified chains.
+func (uc *UpstreamConfig) verifySPKIPins(cs tls.ConnectionState) error {
+	var seen []string
+	check := func(certs []*x509.Certificate) bool {
+		for _, cert := range certs {
+			fp := spkiFingerprint(cert)
+			for _, pin := range uc.spkiPins {
+				if bytes.Equal(fp, pin) {
+					return true
+				}
+			}
+			seen = append(seen, base64.StdEncoding.EncodeToString(fp))
+		}
+		return false
+	}
+	for _, chain := range cs.VerifiedChains {
+		if check(chain) {
+			return nil
+		}
+	}
+	if len(cs.VerifiedChains) == 0 && check(cs.PeerCertificates) {
+		return nil
+	}
+	ProxyLogger.Load().Error().Msgf("spki pin mismatch for upstream %q (%s), refusing connection, server pins: %v", uc.Name, uc.Domain, seen)
+	return errSPKIPinMismatch
+}
+
+// verifyStampHashes ensures that at least one certificate in the upstream certificate chain
+// matches one of the hashes of the DNS stamp endpoint, which are SHA-256 hashes of the TBS
+// certificates, as described in https://dnscrypt.info/stamps-specifications.
+func (uc *UpstreamConfig) verifyStampHashes(cs tls.ConnectionState) error {
+	check := func(certs []*x509.Certificate) bool {
+		for _, cert := range certs {
+			sum := sha256.Sum256(cert.RawTBSCertificate)
+			for _, h := range uc.stampHashes {
+				if bytes.Equal(sum[:], h) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, chain := range cs.VerifiedChains {
+		if check(chain) {
+			return nil
+		}
+	}
+	if len(cs.VerifiedChains) == 0 && check(cs.PeerCertificates) {
+		return nil
+	}
+	ProxyLogger.Load().Error().Msgf("stamp certificate hash mismatch for upstream %q (%s), refusing connection", uc.Name, uc.Domain)
+	return errStampHashMismatch
+}
+
+// spkiFingerprint returns the SHA-256 hash of the certificate's SubjectPublicKeyInfo.
+func spkiFingerprint(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// parseSPKIPin decodes a SPKI pin, which is the base64 encoded SHA-256 hash of
+// a certificate's SubjectPublicKeyInfo, optionally prefixed with "sha256/".
+func parseSPKIPin(pin string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin length: %d", len(b))
+	}
+	return b, nil
+}
+
+// loadCertPool returns a cert pool containing all certificates in given PEM file.
+func loadCertPool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cp := x509.NewCertPool()
+	if !cp.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found")
+	}
+	return cp, nil
+}
+
+// clientCertificate provides the TLS client certificate of an upstream,
+// reloading it whenever the certificate or key file changes.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+	password string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newClientCertificate(certFile, keyFile, password string) *clientCertificate {
+	cc := &clientCertificate{certFile: certFile, keyFile: keyFile, password: password}
+	if _, err := cc.load(); err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("could not load client certificate: %s", certFile)
+	}
+	return cc
+}
+
+func (cc *clientCertificate) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return cc.load()
+}
+
+// load returns the client certificate, re-reading the files if they were modified since
+// the last load. If reloading fails, the previous certificate is used, if any.
+func (cc *clientCertificate) load() (*tls.Certificate, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	modTime, err := cc.lastModified()
+	if err != nil {
+		if cc.cert != nil {
+			ProxyLogger.Load().Warn().Err(err).Msg("could not check client certificate, using the loaded one")
+			return cc.cert, nil
+		}
+		return nil, err
+	}
+	if cc.cert != nil && modTime.Equal(cc.modTime) {
+		return cc.cert, nil
+	}
+	cert, err := cc.read()
+	if err != nil {
+		if cc.cert != nil {
+			ProxyLogger.Load().Warn().Err(err).Msg("could not reload client certificate, using the loaded one")
+			return cc.cert, nil
+		}
+		return nil, err
+	}
+	if cc.cert != nil {
+		ProxyLogger.Load().Info().Msgf("client certificate reloaded: %s", cc.certFile)
+	}
+	cc.cert, cc.modTime = cert, modTime
+	return cc.cert, nil
+}
+
+// lastModified returns the latest modification time of the certificate and key files.
+func (cc *clientCertificate) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, f := range []string{cc.certFile, cc.keyFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func (cc *clientCertificate) read() (*tls.Certificate, error) {
+	if !isPKCS12File(cc.certFile) {
+		cert, err := tls.LoadX509KeyPair(cc.certFile, cc.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	}
+	data, err := os.ReadFile(cc.certFile)
+	if err != nil {
+		return nil, err
+	}
+	key, leaf, err := pkcs12.Decode(data, cc.password)
+	if err != nil {
+		return nil, err
+	}
+	if leaf == nil {
+		return nil, errors.New("no certificate found in PKCS#12 file")
+	}
+	return &tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// isPKCS12File reports whether the given file is a PKCS#12 bundle, based on its extension.
+func isPKCS12File(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".p12", ".pfx":
+		return true
+	}
+	return false
+}
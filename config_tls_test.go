@@ -0,0 +1,197 @@
+package ctrld
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_dotResolver_clientCertificate(t *testing.T) {
+	clientCert, clientCertPool := testTLSCertificate(t)
+	srv := newTestDoTServer(t, func(c *tls.Config) {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = clientCertPool
+	})
+
+	uc := srv.upstreamConfig()
+	if _, err := (&dotResolver{uc: uc}).Resolve(context.Background(), testQuery("example.com.")); err == nil {
+		t.Fatal("expected error without client certificate")
+	}
+
+	uc = srv.upstreamConfig()
+	uc.ClientCert, uc.ClientKey = writeTestCertificate(t, clientCert)
+	uc.Init()
+	uc.SetCertPool(srv.certPool)
+	if _, err := (&dotResolver{uc: uc}).Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_clientCertificate_reload(t *testing.T) {
+	cert1, _ := testTLSCertificate(t)
+	cert2, _ := testTLSCertificate(t)
+	certFile, keyFile := writeTestCertificate(t, cert1)
+
+	cc := newClientCertificate(certFile, keyFile, "")
+	got, err := cc.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Certificate[0], cert1.Certificate[0]) {
+		t.Fatal("unexpected certificate")
+	}
+
+	newCertFile, newKeyFile := writeTestCertificate(t, cert2)
+	for _, f := range [][2]string{{newCertFile, certFile}, {newKeyFile, keyFile}} {
+		if err := os.Rename(f[0], f[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make sure the modification time changes, regardless of the file system precision.
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+
+	got, err = cc.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Certificate[0], cert2.Certificate[0]) {
+		t.Fatal("certificate was not reloaded")
+	}
+
+	// A broken certificate file must not replace the loaded certificate.
+	if err := os.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	got, err = cc.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Certificate[0], cert2.Certificate[0]) {
+		t.Fatal("loaded certificate was replaced by broken one")
+	}
+}
+
+// writeTestCertificate writes the certificate and its private key to PEM files,
+// returning the files path.
+func writeTestCertificate(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func Test_dotResolver_spkiPins(t *testing.T) {
+	srv := newTestDoTServer(t)
+	pin := base64.StdEncoding.EncodeToString(spkiFingerprint(srv.cert.Leaf))
+	otherCert, _ := testTLSCertificate(t)
+	otherPin := base64.StdEncoding.EncodeToString(spkiFingerprint(otherCert.Leaf))
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{"match", []string{pin}, false},
+		{"match with prefix", []string{spkiPinPrefix + pin}, false},
+		{"rotating pins", []string{otherPin, pin}, false},
+		{"mismatch", []string{otherPin}, true},
+		{"invalid pin", []string{"invalid"}, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			uc := srv.upstreamConfig()
+			uc.SPKIPins = tc.pins
+			uc.Init()
+			_, err := (&dotResolver{uc: uc}).Resolve(context.Background(), testQuery("example.com."))
+			if tc.wantErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_dotResolver_stampHashes(t *testing.T) {
+	srv := newTestDoTServer(t)
+	hash := sha256.Sum256(srv.cert.Leaf.RawTBSCertificate)
+	otherCert, _ := testTLSCertificate(t)
+	otherHash := sha256.Sum256(otherCert.Leaf.RawTBSCertificate)
+
+	tests := []struct {
+		name    string
+		hash    []byte
+		wantErr bool
+	}{
+		{"match", hash[:], false},
+		{"mismatch", otherHash[:], true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			uc := &UpstreamConfig{
+				Name:     "test",
+				Type:     ResolverTypeDOT,
+				Endpoint: encodeTestStamp(stampProtoDoT, srv.Addr().String(), string(tc.hash), "127.0.0.1"),
+				Timeout:  5000,
+			}
+			uc.Init()
+			uc.SetCertPool(srv.certPool)
+			_, err := (&dotResolver{uc: uc}).Resolve(context.Background(), testQuery("example.com."))
+			if tc.wantErr && !errors.Is(err, errStampHashMismatch) {
+				t.Fatalf("expected stamp hash mismatch error, got: %v", err)
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_dotResolver_caFile(t *testing.T) {
+	srv := newTestDoTServer(t)
+	caFile, _ := writeTestCertificate(t, srv.cert)
+
+	uc := srv.upstreamConfig()
+	uc.SetCertPool(nil)
+	uc.CAFile = caFile
+	uc.Init()
+	if _, err := (&dotResolver{uc: uc}).Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid CA file must not fall back to the default cert pool.
+	uc = srv.upstreamConfig()
+	uc.CAFile = filepath.Join(t.TempDir(), "not-exist.pem")
+	uc.Init()
+	if _, err := (&dotResolver{uc: uc}).Resolve(context.Background(), testQuery("example.com.")); err == nil {
+		t.Fatal("expected error with invalid CA file")
+	}
+}
@@ -0,0 +1,405 @@
+package ctrld
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// DNSCrypt v2 protocol constants, see https://dnscrypt.info/protocol.
+const (
+	dnscryptCertMagic     = "DNSC"
+	dnscryptResolverMagic = "r6fnvWj8"
+	dnscryptCertLen       = 124
+	// dnscryptHalfNonceLen is the length of the client nonce, padded with zeros to a full nonce.
+	dnscryptHalfNonceLen = 12
+	dnscryptNonceLen     = 24
+	// dnscryptMinUDPQueryLen is the minimum padded length of queries sent over UDP.
+	dnscryptMinUDPQueryLen = 256
+	dnscryptPadBlockLen    = 64
+
+	dnscryptESXSalsa20Poly1305  = 1
+	dnscryptESXChacha20Poly1305 = 2
+)
+
+// dnscryptCertRefreshInterval is the interval after which the resolver certificates are
+// re-fetched, so key rotation is picked up before the current certificate expires.
+const dnscryptCertRefreshInterval = time.Hour
+
+var errDNSCryptInvalidResponse = errors.New("invalid dnscrypt response")
+
+type dnscryptResolver struct {
+	uc *UpstreamConfig
+}
+
+func (r *dnscryptResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	c := r.uc.dnscrypt
+	if c == nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidStamp, r.uc.Endpoint)
+	}
+	dnsTyp := uint16(0)
+	if msg != nil && len(msg.Question) > 0 {
+		dnsTyp = msg.Question[0].Qtype
+	}
+	_, udpNet := r.uc.netForDNSType(dnsTyp)
+	ip := r.uc.BootstrapIP
+	if ip == "" {
+		ip = r.uc.bootstrapIPForDNSType(dnsTyp)
+	} else {
+		udpNet = "udp"
+	}
+	_, port, _ := net.SplitHostPort(c.stamp.serverAddr)
+	return c.exchange(ctx, msg, udpNet, net.JoinHostPort(ip, port))
+}
+
+// dnscryptClient sends queries to a DNSCrypt resolver, keeping track of the resolver certificate.
+type dnscryptClient struct {
+	uc    *UpstreamConfig
+	stamp *serverStamp
+
+	mu        sync.Mutex
+	cert      *dnscryptCert
+	fetchedAt time.Time
+}
+
+func newDNSCryptClient(uc *UpstreamConfig, st *serverStamp) *dnscryptClient {
+	return &dnscryptClient{uc: uc, stamp: st}
+}
+
+// exchange sends msg to the resolver using given UDP network, falling back to TCP if
+// the answer is truncated. If the answer could not be decrypted, the certificate is
+// re-fetched and the query is retried, since the resolver may have rotated its keys.
+func (c *dnscryptClient) exchange(ctx context.Context, msg *dns.Msg, network, endpoint string) (*dns.Msg, error) {
+	cert, err := c.certificate(ctx, network, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := c.exchangeWithCert(ctx, msg, network, endpoint, cert)
+	if errors.Is(err, errDNSCryptInvalidResponse) {
+		ProxyLogger.Load().Debug().Err(err).Msgf("re-fetching dnscrypt certificate of provider: %s", c.stamp.providerName)
+		if cert, err = c.certificate(ctx, network, endpoint, cert); err != nil {
+			return nil, err
+		}
+		answer, err = c.exchangeWithCert(ctx, msg, network, endpoint, cert)
+	}
+	return answer, err
+}
+
+func (c *dnscryptClient) exchangeWithCert(ctx context.Context, msg *dns.Msg, network, endpoint string, cert *dnscryptCert) (*dns.Msg, error) {
+	answer, err := c.exchangeEncrypted(ctx, msg, network, endpoint, cert)
+	if err == nil && answer.Truncated && strings.HasPrefix(network, "udp") {
+		return c.exchangeEncrypted(ctx, msg, tcpNetwork(network), endpoint, cert)
+	}
+	return answer, err
+}
+
+func (c *dnscryptClient) exchangeEncrypted(ctx context.Context, msg *dns.Msg, network, endpoint string, cert *dnscryptCert) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	minLen := 0
+	if strings.HasPrefix(network, "udp") {
+		minLen = dnscryptMinUDPQueryLen
+	}
+	query, nonce, err := cert.encrypt(packed, minLen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.uc.bindDialer(&net.Dialer{}, network).DialContext(ctx, network, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	co := &dns.Conn{Conn: conn}
+	if _, err := co.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := co.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	packet, err := cert.decrypt(buf[:n], nonce)
+	if err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	if err := answer.Unpack(packet); err != nil {
+		return nil, fmt.Errorf("%w: %v", errDNSCryptInvalidResponse, err)
+	}
+	return answer, nil
+}
+
+// certificate returns the resolver certificate, fetching it if there's none yet, the current
+// one is expired, old enough to be refreshed, or is the stale one which could not be used.
+func (c *dnscryptClient) certificate(ctx context.Context, network, endpoint string, stale *dnscryptCert) (*dnscryptCert, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	usable := c.cert != nil && c.cert != stale && now.Before(c.cert.notAfter)
+	if usable && now.Sub(c.fetchedAt) < dnscryptCertRefreshInterval {
+		return c.cert, nil
+	}
+	cert, err := c.fetchCert(ctx, network, endpoint)
+	if err != nil {
+		if usable {
+			ProxyLogger.Load().Warn().Err(err).Msgf("could not refresh dnscrypt certificate of provider: %s", c.stamp.providerName)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.fetchedAt = cert, now
+	return cert, nil
+}
+
+// fetchCert queries the provider certificates, returning the valid one with the highest serial.
+func (c *dnscryptClient) fetchCert(ctx context.Context, network, endpoint string) (*dnscryptCert, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(c.stamp.providerName), dns.TypeTXT)
+	// Providers may publish several certificates, which may not fit in 512 bytes.
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	answer, err := exchangeWithTCPFallback(ctx, msg, endpoint, network, func(network string) *dns.Client {
+		return &dns.Client{Net: network, Dialer: c.uc.bindDialer(&net.Dialer{}, network)}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch dnscrypt certificate: %w", err)
+	}
+	now := time.Now()
+	var best *dnscryptCert
+	for _, rr := range answer.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		b, err := txtBytes(txt)
+		if err != nil {
+			continue
+		}
+		cert, err := parseDNSCryptCert(b, c.stamp.providerPK)
+		if err != nil {
+			ProxyLogger.Load().Debug().Err(err).Msgf("ignoring dnscrypt certificate of provider: %s", c.stamp.providerName)
+			continue
+		}
+		if now.Before(cert.notBefore) || !now.Before(cert.notAfter) {
+			continue
+		}
+		if best == nil || cert.serial > best.serial || (cert.serial == best.serial && cert.esVersion > best.esVersion) {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no valid dnscrypt certificate for provider: %s", c.stamp.providerName)
+	}
+	// A new client key pair is generated for each certificate.
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	best.clientPK = *pk
+	if best.sharedKey, err = dnscryptSharedKey(best.esVersion, sk, &best.resolverPK); err != nil {
+		return nil, err
+	}
+	return best, nil
+}
+
+// dnscryptCert is a DNSCrypt resolver certificate, along with the client key used with it.
+type dnscryptCert struct {
+	esVersion   uint16
+	resolverPK  [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+
+	clientPK  [32]byte
+	sharedKey [32]byte
+}
+
+// parseDNSCryptCert parses a certificate, verifying it was signed by the provider.
+func parseDNSCryptCert(b []byte, providerPK []byte) (*dnscryptCert, error) {
+	if len(b) < dnscryptCertLen || string(b[:4]) != dnscryptCertMagic {
+		return nil, errors.New("invalid dnscrypt certificate")
+	}
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(b[4:6])}
+	switch cert.esVersion {
+	case dnscryptESXSalsa20Poly1305, dnscryptESXChacha20Poly1305:
+	default:
+		return nil, fmt.Errorf("unsupported dnscrypt es version: %d", cert.esVersion)
+	}
+	// Bytes 6:8 are the protocol minor version, then the signature of the remaining bytes.
+	if !ed25519.Verify(providerPK, b[72:], b[8:72]) {
+		return nil, errors.New("invalid dnscrypt certificate signature")
+	}
+	copy(cert.resolverPK[:], b[72:104])
+	copy(cert.clientMagic[:], b[104:112])
+	cert.serial = binary.BigEndian.Uint32(b[112:116])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	return cert, nil
+}
+
+// encrypt encrypts a DNS query, returning the DNSCrypt query packet and the client nonce.
+func (cert *dnscryptCert) encrypt(packet []byte, minLen int) ([]byte, []byte, error) {
+	var nonce [dnscryptNonceLen]byte
+	if _, err := rand.Read(nonce[:dnscryptHalfNonceLen]); err != nil {
+		return nil, nil, err
+	}
+	padded := dnscryptPad(packet, minLen)
+	query := make([]byte, 0, len(cert.clientMagic)+len(cert.clientPK)+dnscryptHalfNonceLen+poly1305.TagSize+len(padded))
+	query = append(query, cert.clientMagic[:]...)
+	query = append(query, cert.clientPK[:]...)
+	query = append(query, nonce[:dnscryptHalfNonceLen]...)
+	query = dnscryptSeal(query, cert.esVersion, &cert.sharedKey, &nonce, padded)
+	return query, nonce[:dnscryptHalfNonceLen], nil
+}
+
+// decrypt decrypts a DNSCrypt response packet to the query with given client nonce.
+func (cert *dnscryptCert) decrypt(packet, clientNonce []byte) ([]byte, error) {
+	hdrLen := len(dnscryptResolverMagic) + dnscryptNonceLen
+	if len(packet) < hdrLen+poly1305.TagSize || string(packet[:len(dnscryptResolverMagic)]) != dnscryptResolverMagic {
+		return nil, errDNSCryptInvalidResponse
+	}
+	var nonce [dnscryptNonceLen]byte
+	copy(nonce[:], packet[len(dnscryptResolverMagic):hdrLen])
+	if !bytes.Equal(nonce[:dnscryptHalfNonceLen], clientNonce) {
+		return nil, fmt.Errorf("%w: nonce mismatch", errDNSCryptInvalidResponse)
+	}
+	padded, ok := dnscryptOpen(nil, cert.esVersion, &cert.sharedKey, &nonce, packet[hdrLen:])
+	if !ok {
+		return nil, fmt.Errorf("%w: could not decrypt", errDNSCryptInvalidResponse)
+	}
+	return dnscryptUnpad(padded)
+}
+
+// dnscryptSharedKey computes the key shared between the client and the resolver.
+func dnscryptSharedKey(esVersion uint16, secretKey, publicKey *[32]byte) ([32]byte, error) {
+	var key [32]byte
+	switch esVersion {
+	case dnscryptESXSalsa20Poly1305:
+		box.Precompute(&key, publicKey, secretKey)
+	case dnscryptESXChacha20Poly1305:
+		dh, err := curve25519.X25519(secretKey[:], publicKey[:])
+		if err != nil {
+			return key, err
+		}
+		subKey, err := chacha20.HChaCha20(dh, make([]byte, 16))
+		if err != nil {
+			return key, err
+		}
+		copy(key[:], subKey)
+	default:
+		return key, fmt.Errorf("unsupported dnscrypt es version: %d", esVersion)
+	}
+	return key, nil
+}
+
+// dnscryptSeal appends the encrypted and authenticated message to out. For XChaCha20Poly1305,
+// it uses the same construction as secretbox, replacing XSalsa20 with XChaCha20.
+func dnscryptSeal(out []byte, esVersion uint16, key *[32]byte, nonce *[dnscryptNonceLen]byte, message []byte) []byte {
+	if esVersion == dnscryptESXSalsa20Poly1305 {
+		return secretbox.Seal(out, message, nonce, key)
+	}
+	cipher, polyKey := xchachaSecretbox(key, nonce)
+	ret := append(out, make([]byte, poly1305.TagSize+len(message))...)
+	tag := ret[len(out) : len(out)+poly1305.TagSize]
+	ciphertext := ret[len(out)+poly1305.TagSize:]
+	cipher.XORKeyStream(ciphertext, message)
+	poly1305.Sum((*[poly1305.TagSize]byte)(tag), ciphertext, polyKey)
+	return ret
+}
+
+// dnscryptOpen authenticates and decrypts a box produced by dnscryptSeal, appending the message to out.
+func dnscryptOpen(out []byte, esVersion uint16, key *[32]byte, nonce *[dnscryptNonceLen]byte, sealed []byte) ([]byte, bool) {
+	if esVersion == dnscryptESXSalsa20Poly1305 {
+		return secretbox.Open(out, sealed, nonce, key)
+	}
+	if len(sealed) < poly1305.TagSize {
+		return nil, false
+	}
+	cipher, polyKey := xchachaSecretbox(key, nonce)
+	tag, ciphertext := sealed[:poly1305.TagSize], sealed[poly1305.TagSize:]
+	if !poly1305.Verify((*[poly1305.TagSize]byte)(tag), ciphertext, polyKey) {
+		return nil, false
+	}
+	ret := append(out, make([]byte, len(ciphertext))...)
+	cipher.XORKeyStream(ret[len(out):], ciphertext)
+	return ret, true
+}
+
+// xchachaSecretbox returns the stream cipher for a XChaCha20 secretbox, with the first 32 bytes
+// of the key stream used as the Poly1305 key, and the next 32 bytes ready to encrypt the message.
+func xchachaSecretbox(key *[32]byte, nonce *[dnscryptNonceLen]byte) (*chacha20.Cipher, *[32]byte) {
+	// The key and nonce sizes are always valid.
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var polyKey [32]byte
+	cipher.XORKeyStream(polyKey[:], polyKey[:])
+	return cipher, &polyKey
+}
+
+// dnscryptPad pads packet using ISO/IEC 7816-4 format, to a multiple of 64 bytes, and at least minLen.
+func dnscryptPad(packet []byte, minLen int) []byte {
+	n := len(packet) + 1
+	if n < minLen {
+		n = minLen
+	}
+	n = (n + dnscryptPadBlockLen - 1) / dnscryptPadBlockLen * dnscryptPadBlockLen
+	padded := make([]byte, n)
+	copy(padded, packet)
+	padded[len(packet)] = 0x80
+	return padded
+}
+
+// dnscryptUnpad removes the padding added by dnscryptPad.
+func dnscryptUnpad(padded []byte) ([]byte, error) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i < 0 || padded[i] != 0x80 {
+		return nil, fmt.Errorf("%w: invalid padding", errDNSCryptInvalidResponse)
+	}
+	return padded[:i], nil
+}
+
+// txtBytes returns the raw data of a TXT record, with all its strings concatenated.
+func txtBytes(rr *dns.TXT) ([]byte, error) {
+	// The TXT strings are in presentation format, using the wire format to get the raw bytes.
+	rfc3597 := new(dns.RFC3597)
+	if err := rfc3597.ToRFC3597(rr); err != nil {
+		return nil, err
+	}
+	rdata, err := hex.DecodeString(rfc3597.Rdata)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	for len(rdata) > 0 {
+		n := int(rdata[0])
+		if len(rdata) < 1+n {
+			return nil, errors.New("invalid TXT record")
+		}
+		b = append(b, rdata[1:1+n]...)
+		rdata = rdata[1+n:]
+	}
+	return b, nil
+}
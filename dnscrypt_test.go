@@ -0,0 +1,335 @@
+package ctrld
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func Test_dnscryptResolver(t *testing.T) {
+	tests := []struct {
+		name      string
+		esVersion uint16
+	}{
+		{"xsalsa20poly1305", dnscryptESXSalsa20Poly1305},
+		{"xchacha20poly1305", dnscryptESXChacha20Poly1305},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv := newTestDNSCryptServer(t)
+			srv.addCert(1, tc.esVersion, time.Hour, srv.providerSK)
+			r := &dnscryptResolver{uc: srv.upstream(t)}
+			for i := 0; i < 2; i++ {
+				testDNSCryptResolve(t, r)
+			}
+			if n := srv.stats().certQueries; n != 1 {
+				t.Errorf("certificate must be fetched once, got: %d", n)
+			}
+		})
+	}
+}
+
+func Test_dnscryptResolver_tcpFallback(t *testing.T) {
+	srv := newTestDNSCryptServer(t)
+	srv.addCert(1, dnscryptESXChacha20Poly1305, time.Hour, srv.providerSK)
+	srv.mu.Lock()
+	srv.truncateUDP = true
+	srv.mu.Unlock()
+	r := &dnscryptResolver{uc: srv.upstream(t)}
+	testDNSCryptResolve(t, r)
+	if n := srv.stats().tcpQueries; n != 1 {
+		t.Errorf("truncated answer must be retried over tcp, got %d tcp queries", n)
+	}
+}
+
+func Test_dnscryptResolver_certRotation(t *testing.T) {
+	srv := newTestDNSCryptServer(t)
+	srv.addCert(1, dnscryptESXChacha20Poly1305, time.Hour, srv.providerSK)
+	uc := srv.upstream(t)
+	r := &dnscryptResolver{uc: uc}
+	testDNSCryptResolve(t, r)
+
+	// New certificate is used after the refresh interval.
+	srv.addCert(2, dnscryptESXSalsa20Poly1305, time.Hour, srv.providerSK)
+	uc.dnscrypt.mu.Lock()
+	uc.dnscrypt.fetchedAt = time.Now().Add(-2 * dnscryptCertRefreshInterval)
+	uc.dnscrypt.mu.Unlock()
+	testDNSCryptResolve(t, r)
+	if serial := uc.dnscrypt.cert.serial; serial != 2 {
+		t.Errorf("unexpected certificate serial, want: 2, got: %d", serial)
+	}
+
+	// Certificate is re-fetched if the answer could not be decrypted.
+	srv.mu.Lock()
+	srv.corruptNext = true
+	srv.mu.Unlock()
+	testDNSCryptResolve(t, r)
+	if n := srv.stats().certQueries; n != 3 {
+		t.Errorf("unexpected certificate queries, want: 3, got: %d", n)
+	}
+}
+
+func Test_dnscryptClient_fetchCert(t *testing.T) {
+	srv := newTestDNSCryptServer(t)
+	_, otherSK, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.addCert(1, dnscryptESXChacha20Poly1305, time.Hour, srv.providerSK)
+	srv.addCert(2, dnscryptESXSalsa20Poly1305, time.Hour, srv.providerSK)
+	srv.addCert(2, dnscryptESXChacha20Poly1305, time.Hour, srv.providerSK)
+	srv.addCert(3, dnscryptESXChacha20Poly1305, -time.Minute, srv.providerSK)
+	srv.addCert(4, dnscryptESXChacha20Poly1305, time.Hour, otherSK)
+
+	uc := srv.upstream(t)
+	cert, err := uc.dnscrypt.fetchCert(context.Background(), "udp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.serial != 2 || cert.esVersion != dnscryptESXChacha20Poly1305 {
+		t.Errorf("unexpected certificate: serial %d, es version %d", cert.serial, cert.esVersion)
+	}
+}
+
+func Test_dnscryptPad(t *testing.T) {
+	for _, n := range []int{0, 1, 63, 64, 255, 300} {
+		packet := bytes.Repeat([]byte{0x80}, n)
+		padded := dnscryptPad(packet, dnscryptMinUDPQueryLen)
+		if len(padded) < dnscryptMinUDPQueryLen || len(padded)%dnscryptPadBlockLen != 0 {
+			t.Errorf("unexpected padded length for %d bytes: %d", n, len(padded))
+		}
+		unpadded, err := dnscryptUnpad(padded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unpadded, packet) {
+			t.Errorf("unexpected unpadded packet for %d bytes", n)
+		}
+	}
+	if _, err := dnscryptUnpad(make([]byte, 64)); err == nil {
+		t.Error("expected error for invalid padding")
+	}
+}
+
+func testDNSCryptResolve(t *testing.T, r Resolver) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	answer, err := r.Resolve(ctx, testQuery("example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Answer) != 1 || answer.Truncated {
+		t.Fatalf("unexpected answer: %v", answer)
+	}
+	if a, ok := answer.Answer[0].(*dns.A); !ok || a.A.String() != "127.0.0.2" {
+		t.Fatalf("unexpected answer: %v", answer)
+	}
+}
+
+// testDNSCryptServer is a local DNSCrypt server, listening on the same UDP and TCP port,
+// answering A queries with 127.0.0.2.
+type testDNSCryptServer struct {
+	addr         string
+	providerName string
+	providerPK   ed25519.PublicKey
+	providerSK   ed25519.PrivateKey
+
+	mu          sync.Mutex
+	certs       []*testDNSCryptServerCert
+	truncateUDP bool
+	corruptNext bool
+	certQueries int
+	tcpQueries  int
+}
+
+type testDNSCryptServerCert struct {
+	raw       []byte
+	esVersion uint16
+	magic     [8]byte
+	sk        [32]byte
+}
+
+type testDNSCryptServerStats struct {
+	certQueries int
+	tcpQueries  int
+}
+
+func newTestDNSCryptServer(t *testing.T) *testDNSCryptServer {
+	t.Helper()
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &testDNSCryptServer{
+		addr:         pc.LocalAddr().String(),
+		providerName: "2.dnscrypt-cert.example.com",
+		providerPK:   pk,
+		providerSK:   sk,
+	}
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.handle(buf[:n], true); resp != nil {
+				_, _ = pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				co := &dns.Conn{Conn: conn}
+				buf := make([]byte, dns.MaxMsgSize)
+				n, err := co.Read(buf)
+				if err != nil {
+					return
+				}
+				if resp := s.handle(buf[:n], false); resp != nil {
+					_, _ = co.Write(resp)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// addCert adds a certificate with a new resolver key pair, signed by given key.
+func (s *testDNSCryptServer) addCert(serial uint32, esVersion uint16, validFor time.Duration, signer ed25519.PrivateKey) {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	cert := &testDNSCryptServerCert{esVersion: esVersion, sk: *sk}
+	_, _ = io.ReadFull(rand.Reader, cert.magic[:])
+	now := time.Now()
+	signed := make([]byte, 0, 52)
+	signed = append(signed, pk[:]...)
+	signed = append(signed, cert.magic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(now.Add(-time.Hour).Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(now.Add(validFor).Unix()))
+	cert.raw = append([]byte(dnscryptCertMagic), 0, byte(esVersion), 0, 0)
+	cert.raw = append(cert.raw, ed25519.Sign(signer, signed)...)
+	cert.raw = append(cert.raw, signed...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs = append(s.certs, cert)
+}
+
+func (s *testDNSCryptServer) upstream(t *testing.T) *UpstreamConfig {
+	t.Helper()
+	uc := &UpstreamConfig{
+		Name:     "test",
+		Type:     ResolverTypeDNSCrypt,
+		Endpoint: encodeTestStamp(stampProtoDNSCrypt, s.addr, string(s.providerPK), s.providerName),
+		Timeout:  5000,
+	}
+	uc.Init()
+	if uc.dnscrypt == nil {
+		t.Fatal("dnscrypt client is not initialized")
+	}
+	return uc
+}
+
+func (s *testDNSCryptServer) stats() testDNSCryptServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return testDNSCryptServerStats{certQueries: s.certQueries, tcpQueries: s.tcpQueries}
+}
+
+func (s *testDNSCryptServer) handle(packet []byte, udp bool) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cert := range s.certs {
+		if len(packet) > 52 && bytes.Equal(packet[:8], cert.magic[:]) {
+			return s.handleEncrypted(cert, packet, udp)
+		}
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet); err != nil || len(msg.Question) != 1 || msg.Question[0].Qtype != dns.TypeTXT {
+		return nil
+	}
+	s.certQueries++
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	for _, cert := range s.certs {
+		answer.Answer = append(answer.Answer, &dns.RFC3597{
+			Hdr:   dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Rdata: hex.EncodeToString(append([]byte{byte(len(cert.raw))}, cert.raw...)),
+		})
+	}
+	resp, _ := answer.Pack()
+	return resp
+}
+
+func (s *testDNSCryptServer) handleEncrypted(cert *testDNSCryptServerCert, packet []byte, udp bool) []byte {
+	var clientPK [32]byte
+	copy(clientPK[:], packet[8:40])
+	var nonce [dnscryptNonceLen]byte
+	copy(nonce[:], packet[40:52])
+	key, err := dnscryptSharedKey(cert.esVersion, &cert.sk, &clientPK)
+	if err != nil {
+		return nil
+	}
+	padded, ok := dnscryptOpen(nil, cert.esVersion, &key, &nonce, packet[52:])
+	if !ok {
+		return nil
+	}
+	query, err := dnscryptUnpad(padded)
+	if err != nil {
+		return nil
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	answer, _ := staticResolver("127.0.0.2").Resolve(context.Background(), msg)
+	if udp && s.truncateUDP {
+		answer.Answer = nil
+		answer.Truncated = true
+	}
+	if !udp {
+		s.tcpQueries++
+	}
+	buf, _ := answer.Pack()
+	_, _ = io.ReadFull(rand.Reader, nonce[dnscryptHalfNonceLen:])
+	if s.corruptNext {
+		s.corruptNext = false
+		key[0] ^= 0xff
+	}
+	resp := append([]byte(dnscryptResolverMagic), nonce[:]...)
+	return dnscryptSeal(resp, cert.esVersion, &key, &nonce, dnscryptPad(buf, 0))
+}
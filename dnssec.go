@@ -0,0 +1,866 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation results.
+const (
+	// DNSSECSecure means the answer is authenticated up to a trust anchor.
+	DNSSECSecure = "secure"
+	// DNSSECInsecure means the answer is proven to be unsigned, or is under a negative trust anchor.
+	DNSSECInsecure = "insecure"
+	// DNSSECBogus means the answer should be signed, but could not be authenticated.
+	DNSSECBogus = "bogus"
+)
+
+// DefaultDNSSECTrustAnchors are the DS records of the root zone KSKs.
+var DefaultDNSSECTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// dnssecKeyMaxTTL is the maximum duration which validated zone keys are cached.
+	dnssecKeyMaxTTL = time.Hour
+	// dnssecMaxZones is the maximum number of zones kept in the key cache.
+	dnssecMaxZones = 4096
+	// dnssecMaxNSEC3Iterations is the maximum NSEC3 iterations, higher values are treated
+	// as insecure, following RFC 9276.
+	dnssecMaxNSEC3Iterations = 150
+	// dnssecMaxDepth limits the nested lookups made while building the chain of trust.
+	dnssecMaxDepth = 32
+)
+
+var errDNSSECMaxDepth = errors.New("dnssec chain of trust is too deep")
+
+// dnssecDepthCtxKey is the context key of the current chain of trust depth.
+type dnssecDepthCtxKey struct{}
+
+// dnssecDescend returns a context with chain of trust depth increased, or an error if the maximum depth is reached.
+func dnssecDescend(ctx context.Context) (context.Context, error) {
+	depth, _ := ctx.Value(dnssecDepthCtxKey{}).(int)
+	if depth >= dnssecMaxDepth {
+		return nil, errDNSSECMaxDepth
+	}
+	return context.WithValue(ctx, dnssecDepthCtxKey{}, depth+1), nil
+}
+
+// DNSSECLookupFunc looks up records needed for DNSSEC validation, e.g: DNSKEY and DS records.
+// The returned answer must include DNSSEC records.
+type DNSSECLookupFunc func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+
+// DNSSECValidator validates DNSSEC signed answers up to configured trust anchors.
+// Validated zone keys are cached and shared between queries.
+type DNSSECValidator struct {
+	anchors map[string][]*dns.DS
+	ntas    []string
+	now     func() time.Time
+
+	mu    sync.Mutex
+	zones map[string]*dnssecZone
+}
+
+// dnssecZone is the validation state of a zone.
+type dnssecZone struct {
+	status string
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+// dnssecRRset is a set of records with the same owner and type, along with their signatures.
+type dnssecRRset struct {
+	name string
+	typ  uint16
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// NewDNSSECValidator creates a new validator with given trust anchors, DS records in presentation
+// format, and negative trust anchors, domains which are not validated. If trustAnchors is empty,
+// DefaultDNSSECTrustAnchors is used.
+func NewDNSSECValidator(trustAnchors, negativeTrustAnchors []string) (*DNSSECValidator, error) {
+	if len(trustAnchors) == 0 {
+		trustAnchors = DefaultDNSSECTrustAnchors
+	}
+	v := &DNSSECValidator{
+		anchors: make(map[string][]*dns.DS),
+		now:     time.Now,
+		zones:   make(map[string]*dnssecZone),
+	}
+	for _, ta := range trustAnchors {
+		ds, err := parseTrustAnchor(ta)
+		if err != nil {
+			return nil, err
+		}
+		zone := canonicalZone(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	for _, nta := range negativeTrustAnchors {
+		v.ntas = append(v.ntas, canonicalZone(nta))
+	}
+	return v, nil
+}
+
+// parseTrustAnchor parses a DS record in presentation format.
+func parseTrustAnchor(s string) (*dns.DS, error) {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust anchor: %w", err)
+	}
+	ds, ok := rr.(*dns.DS)
+	if !ok {
+		return nil, fmt.Errorf("invalid trust anchor, not a DS record: %s", s)
+	}
+	return ds, nil
+}
+
+// Validate validates the answer of query msg. The returned error describes why the answer is bogus.
+func (v *DNSSECValidator) Validate(ctx context.Context, msg, answer *dns.Msg, lookup DNSSECLookupFunc) (string, error) {
+	if len(msg.Question) == 0 {
+		return DNSSECInsecure, nil
+	}
+	q := msg.Question[0]
+	if v.underNTA(q.Name) {
+		return DNSSECInsecure, nil
+	}
+	if answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError {
+		return DNSSECInsecure, nil
+	}
+
+	result := DNSSECSecure
+	merge := func(status string) {
+		if status == DNSSECInsecure {
+			result = DNSSECInsecure
+		}
+	}
+
+	// Follow CNAME chain to the name which the answer is for.
+	target := q.Name
+	answerSets := groupRRsets(answer.Answer)
+	for i := 0; i < len(answerSets); i++ {
+		for _, set := range answerSets {
+			if set.typ == dns.TypeCNAME && strings.EqualFold(set.name, target) && q.Qtype != dns.TypeCNAME {
+				target = set.rrs[0].(*dns.CNAME).Target
+			}
+		}
+	}
+	positive := false
+	for _, set := range answerSets {
+		if strings.EqualFold(set.name, target) && (set.typ == q.Qtype || q.Qtype == dns.TypeANY) {
+			positive = true
+		}
+		if set.typ == dns.TypeCNAME && len(set.sigs) == 0 && synthesizedFromDNAME(set, answerSets) {
+			continue
+		}
+		status, err := v.verifyRRset(ctx, set, "", lookup)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		merge(status)
+		if status == DNSSECSecure {
+			if err := v.verifyWildcard(ctx, set, answer, lookup); err != nil {
+				return DNSSECBogus, err
+			}
+		}
+	}
+	if positive {
+		return result, nil
+	}
+
+	status, err := v.verifyDenial(ctx, target, q.Qtype, answer, lookup)
+	if err != nil {
+		return DNSSECBogus, err
+	}
+	merge(status)
+	return result, nil
+}
+
+// verifyRRset verifies signatures of set. Signatures made by the zone excludeSigner are ignored,
+// so DS records and their denial are only accepted from the parent zone.
+func (v *DNSSECValidator) verifyRRset(ctx context.Context, set *dnssecRRset, excludeSigner string, lookup DNSSECLookupFunc) (string, error) {
+	if len(set.sigs) == 0 {
+		status, err := v.nameStatus(ctx, set.name, lookup)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if status == DNSSECInsecure {
+			return DNSSECInsecure, nil
+		}
+		return DNSSECBogus, fmt.Errorf("missing signature for %s %s", set.name, dns.TypeToString[set.typ])
+	}
+	err := fmt.Errorf("no valid signature for %s %s", set.name, dns.TypeToString[set.typ])
+	for _, sig := range set.sigs {
+		signer := canonicalZone(sig.SignerName)
+		if !dns.IsSubDomain(signer, canonicalZone(set.name)) || signer == excludeSigner {
+			continue
+		}
+		zone, zerr := v.zoneKeys(ctx, signer, lookup)
+		if zerr != nil {
+			err = zerr
+			continue
+		}
+		if zone.status == DNSSECInsecure {
+			return DNSSECInsecure, nil
+		}
+		if verifySig(sig, zone.keys, set.rrs, v.now()) {
+			return DNSSECSecure, nil
+		}
+	}
+	return DNSSECBogus, err
+}
+
+// verifyWildcard verifies that the queried name does not exist, if set is expanded from a wildcard.
+func (v *DNSSECValidator) verifyWildcard(ctx context.Context, set *dnssecRRset, answer *dns.Msg, lookup DNSSECLookupFunc) error {
+	labels := dns.CountLabel(set.name)
+	var sig *dns.RRSIG
+	for _, s := range set.sigs {
+		if int(s.Labels) < labels {
+			sig = s
+		}
+	}
+	if sig == nil {
+		return nil
+	}
+	// The next closer name is one label longer than the closest encloser.
+	idx := dns.Split(set.name)
+	nextCloser := set.name[idx[labels-int(sig.Labels)-1]:]
+	nsecs, nsec3s, err := v.authenticatedDenials(ctx, answer, "", lookup)
+	if err != nil {
+		return err
+	}
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, set.name) {
+			return nil
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(nextCloser) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no proof for wildcard expansion of %s", set.name)
+}
+
+// verifyDenial verifies the negative answer for name and qtype.
+func (v *DNSSECValidator) verifyDenial(ctx context.Context, name string, qtype uint16, answer *dns.Msg, lookup DNSSECLookupFunc) (string, error) {
+	excludeSigner := ""
+	if qtype == dns.TypeDS {
+		excludeSigner = canonicalZone(name)
+	}
+	status := DNSSECSecure
+	for _, set := range groupRRsets(answer.Ns) {
+		s, err := v.verifyRRset(ctx, set, excludeSigner, lookup)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if s == DNSSECInsecure {
+			status = DNSSECInsecure
+		}
+	}
+	if status == DNSSECInsecure {
+		return status, nil
+	}
+	nsecs, nsec3s, err := v.authenticatedDenials(ctx, answer, excludeSigner, lookup)
+	if err != nil {
+		return DNSSECBogus, err
+	}
+	if answer.Rcode == dns.RcodeNameError {
+		return denyName(name, nsecs, nsec3s)
+	}
+	return denyType(name, qtype, nsecs, nsec3s)
+}
+
+// authenticatedDenials returns the NSEC and NSEC3 records in authority section of answer, which are signed.
+func (v *DNSSECValidator) authenticatedDenials(ctx context.Context, answer *dns.Msg, excludeSigner string, lookup DNSSECLookupFunc) ([]*dns.NSEC, []*dns.NSEC3, error) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range groupRRsets(answer.Ns) {
+		if set.typ != dns.TypeNSEC && set.typ != dns.TypeNSEC3 {
+			continue
+		}
+		status, err := v.verifyRRset(ctx, set, excludeSigner, lookup)
+		if err != nil {
+			return nil, nil, err
+		}
+		if status != DNSSECSecure {
+			continue
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	return nsecs, nsec3s, nil
+}
+
+// zoneKeys returns the validated keys of zone.
+func (v *DNSSECValidator) zoneKeys(ctx context.Context, zone string, lookup DNSSECLookupFunc) (*dnssecZone, error) {
+	zone = canonicalZone(zone)
+	v.mu.Lock()
+	z := v.zones[zone]
+	v.mu.Unlock()
+	if z != nil && z.expire.After(v.now()) {
+		return z, nil
+	}
+
+	z, err := v.fetchZoneKeys(ctx, zone, lookup)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.zones) >= dnssecMaxZones {
+		v.zones = make(map[string]*dnssecZone)
+	}
+	v.zones[zone] = z
+	return z, nil
+}
+
+// fetchZoneKeys authenticates the keys of zone, using the trust anchor or DS records of zone.
+func (v *DNSSECValidator) fetchZoneKeys(ctx context.Context, zone string, lookup DNSSECLookupFunc) (*dnssecZone, error) {
+	ctx, err := dnssecDescend(ctx)
+	if err != nil {
+		return nil, err
+	}
+	insecure := &dnssecZone{status: DNSSECInsecure, expire: v.now().Add(dnssecKeyMaxTTL)}
+	if v.underNTA(zone) || v.closestAnchor(zone) == "" {
+		return insecure, nil
+	}
+	if anchors, ok := v.anchors[zone]; ok {
+		return v.fetchDNSKEY(ctx, zone, anchors, lookup)
+	}
+
+	answer, err := lookup(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup DS of %s: %w", zone, err)
+	}
+	for _, set := range groupRRsets(answer.Answer) {
+		if set.typ != dns.TypeDS || canonicalZone(set.name) != zone {
+			continue
+		}
+		status, err := v.verifyRRset(ctx, set, zone, lookup)
+		if err != nil {
+			return nil, err
+		}
+		if status == DNSSECInsecure {
+			return insecure, nil
+		}
+		dsSet := make([]*dns.DS, 0, len(set.rrs))
+		for _, rr := range set.rrs {
+			dsSet = append(dsSet, rr.(*dns.DS))
+		}
+		return v.fetchDNSKEY(ctx, zone, dsSet, lookup)
+	}
+	status, err := v.verifyDenial(ctx, zone, dns.TypeDS, answer, lookup)
+	if err != nil {
+		return nil, err
+	}
+	if status == DNSSECInsecure {
+		return insecure, nil
+	}
+	// DS records are proven not to exist, the zone is unsigned if it is a delegation.
+	nsecs, nsec3s, err := v.authenticatedDenials(ctx, answer, zone, lookup)
+	if err != nil {
+		return nil, err
+	}
+	if !insecureDelegation(zone, nsecs, nsec3s) {
+		return nil, fmt.Errorf("%s is not a delegation", zone)
+	}
+	return insecure, nil
+}
+
+// fetchDNSKEY fetches the DNSKEY records of zone, and authenticates them with dsSet.
+func (v *DNSSECValidator) fetchDNSKEY(ctx context.Context, zone string, dsSet []*dns.DS, lookup DNSSECLookupFunc) (*dnssecZone, error) {
+	supported := false
+	for _, ds := range dsSet {
+		if supportedDNSSECAlgorithm(ds.Algorithm) && supportedDSDigest(ds.DigestType) {
+			supported = true
+		}
+	}
+	if !supported {
+		// RFC 4035 5.2, zones signed with unsupported algorithms are treated as unsigned.
+		return &dnssecZone{status: DNSSECInsecure, expire: v.now().Add(dnssecKeyMaxTTL)}, nil
+	}
+
+	answer, err := lookup(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup DNSKEY of %s: %w", zone, err)
+	}
+	var keySet *dnssecRRset
+	for _, set := range groupRRsets(answer.Answer) {
+		if set.typ == dns.TypeDNSKEY && canonicalZone(set.name) == zone {
+			keySet = set
+		}
+	}
+	if keySet == nil {
+		return nil, fmt.Errorf("no DNSKEY found for %s", zone)
+	}
+	keys := make([]*dns.DNSKEY, 0, len(keySet.rrs))
+	for _, rr := range keySet.rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	var ksks []*dns.DNSKEY
+	for _, ds := range dsSet {
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if kds := key.ToDS(ds.DigestType); kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+				ksks = append(ksks, key)
+			}
+		}
+	}
+	now := v.now()
+	for _, sig := range keySet.sigs {
+		if verifySig(sig, ksks, keySet.rrs, now) {
+			ttl := time.Duration(minTTL(keySet.rrs, sig)) * time.Second
+			if ttl > dnssecKeyMaxTTL {
+				ttl = dnssecKeyMaxTTL
+			}
+			return &dnssecZone{status: DNSSECSecure, keys: keys, expire: now.Add(ttl)}, nil
+		}
+	}
+	return nil, fmt.Errorf("could not authenticate DNSKEY of %s", zone)
+}
+
+// nameStatus returns whether name is in a signed zone, by walking down from the closest
+// trust anchor to name, looking for an insecure delegation.
+func (v *DNSSECValidator) nameStatus(ctx context.Context, name string, lookup DNSSECLookupFunc) (string, error) {
+	ctx, err := dnssecDescend(ctx)
+	if err != nil {
+		return DNSSECBogus, err
+	}
+	name = canonicalZone(name)
+	if v.underNTA(name) {
+		return DNSSECInsecure, nil
+	}
+	zone := v.closestAnchor(name)
+	if zone == "" {
+		return DNSSECInsecure, nil
+	}
+	idx := dns.Split(name)
+	for i := len(idx) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+		child := name[idx[i]:]
+		z, err := v.zoneKeys(ctx, zone, lookup)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if z.status == DNSSECInsecure {
+			return DNSSECInsecure, nil
+		}
+		answer, err := lookup(ctx, child, dns.TypeDS)
+		if err != nil {
+			return DNSSECBogus, fmt.Errorf("could not lookup DS of %s: %w", child, err)
+		}
+		hasDS := false
+		for _, rr := range answer.Answer {
+			if rr.Header().Rrtype == dns.TypeDS && strings.EqualFold(rr.Header().Name, child) {
+				hasDS = true
+			}
+		}
+		if hasDS {
+			// zoneKeys authenticates the DS records of child in next iteration.
+			zone = child
+			continue
+		}
+		status, err := v.verifyDenial(ctx, child, dns.TypeDS, answer, lookup)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if status == DNSSECInsecure {
+			return DNSSECInsecure, nil
+		}
+		nsecs, nsec3s, err := v.authenticatedDenials(ctx, answer, child, lookup)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if insecureDelegation(child, nsecs, nsec3s) {
+			return DNSSECInsecure, nil
+		}
+	}
+	z, err := v.zoneKeys(ctx, zone, lookup)
+	if err != nil {
+		return DNSSECBogus, err
+	}
+	return z.status, nil
+}
+
+// underNTA reports whether name is under a negative trust anchor.
+func (v *DNSSECValidator) underNTA(name string) bool {
+	name = canonicalZone(name)
+	for _, nta := range v.ntas {
+		if dns.IsSubDomain(nta, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// closestAnchor returns the closest trust anchor zone of name, or empty string if there's none.
+func (v *DNSSECValidator) closestAnchor(name string) string {
+	closest := ""
+	for zone := range v.anchors {
+		if dns.IsSubDomain(zone, name) && (closest == "" || dns.CountLabel(zone) > dns.CountLabel(closest)) {
+			closest = zone
+		}
+	}
+	return closest
+}
+
+// denyName verifies that name does not exist.
+func denyName(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (string, error) {
+	if len(nsecs) > 0 {
+		var covering *dns.NSEC
+		for _, nsec := range nsecs {
+			if nsecCovers(nsec, name) {
+				covering = nsec
+			}
+		}
+		if covering == nil {
+			return DNSSECBogus, fmt.Errorf("no NSEC proof for non-existence of %s", name)
+		}
+		ce := closestEncloser(name, covering)
+		for _, nsec := range nsecs {
+			if nsecCovers(nsec, wildcardName(ce)) {
+				return DNSSECSecure, nil
+			}
+		}
+		return DNSSECBogus, fmt.Errorf("no NSEC proof for non-existence of wildcard of %s", name)
+	}
+	if len(nsec3s) > 0 {
+		if !supportedNSEC3(nsec3s) {
+			return DNSSECInsecure, nil
+		}
+		ce, nextCloser, optOut := nsec3ClosestEncloser(name, nsec3s)
+		if ce == "" || nextCloser == "" {
+			return DNSSECBogus, fmt.Errorf("no NSEC3 closest encloser proof for %s", name)
+		}
+		if optOut {
+			return DNSSECInsecure, nil
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover(wildcardName(ce)) {
+				return DNSSECSecure, nil
+			}
+		}
+		return DNSSECBogus, fmt.Errorf("no NSEC3 proof for non-existence of wildcard of %s", name)
+	}
+	return DNSSECBogus, fmt.Errorf("no proof for non-existence of %s", name)
+}
+
+// denyType verifies that name exists, but has no records of type qtype.
+func denyType(name string, qtype uint16, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (string, error) {
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			if hasType(nsec.TypeBitMap, qtype) || hasType(nsec.TypeBitMap, dns.TypeCNAME) {
+				break
+			}
+			return DNSSECSecure, nil
+		}
+	}
+	if len(nsec3s) > 0 {
+		if !supportedNSEC3(nsec3s) {
+			return DNSSECInsecure, nil
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				if hasType(nsec3.TypeBitMap, qtype) || hasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+					break
+				}
+				return DNSSECSecure, nil
+			}
+		}
+		// RFC 5155 8.6, DS denial could be proven by an opt-out NSEC3 covering the next closer name.
+		if qtype == dns.TypeDS {
+			if _, _, optOut := nsec3ClosestEncloser(name, nsec3s); optOut {
+				return DNSSECInsecure, nil
+			}
+		}
+	}
+	return DNSSECBogus, fmt.Errorf("no proof for non-existence of %s %s", name, dns.TypeToString[qtype])
+}
+
+// insecureDelegation reports whether the denial records prove that name is a delegation without DS records.
+func insecureDelegation(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeDS) && !hasType(nsec.TypeBitMap, dns.TypeSOA)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return hasType(nsec3.TypeBitMap, dns.TypeNS) && !hasType(nsec3.TypeBitMap, dns.TypeDS) && !hasType(nsec3.TypeBitMap, dns.TypeSOA)
+		}
+	}
+	if len(nsec3s) > 0 {
+		if _, _, optOut := nsec3ClosestEncloser(name, nsec3s); optOut {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3ClosestEncloser returns the closest encloser of name, the next closer name, and whether
+// the NSEC3 record covering the next closer name has opt-out flag set.
+func nsec3ClosestEncloser(name string, nsec3s []*dns.NSEC3) (string, string, bool) {
+	idx := dns.Split(name)
+	for i := 1; i < len(idx); i++ {
+		ce := name[idx[i]:]
+		for _, nsec3 := range nsec3s {
+			if !nsec3.Match(ce) {
+				continue
+			}
+			nextCloser := name[idx[i-1]:]
+			for _, n := range nsec3s {
+				if n.Cover(nextCloser) {
+					return ce, nextCloser, n.Flags&1 == 1
+				}
+			}
+			return ce, "", false
+		}
+	}
+	return "", "", false
+}
+
+// supportedNSEC3 reports whether the NSEC3 records could be used for proving non-existence.
+func supportedNSEC3(nsec3s []*dns.NSEC3) bool {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Hash != dns.SHA1 || nsec3.Iterations > dnssecMaxNSEC3Iterations {
+			return false
+		}
+	}
+	return true
+}
+
+// nsecCovers reports whether name is strictly between owner and next name of nsec.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// The last NSEC record of the zone, next name is the zone apex.
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// closestEncloser returns the closest encloser of name, proven by the covering NSEC record.
+func closestEncloser(name string, nsec *dns.NSEC) string {
+	ce := nsec.NextDomain
+	if n := dns.CompareDomainName(name, nsec.Hdr.Name); n > dns.CompareDomainName(name, nsec.NextDomain) {
+		ce = nsec.Hdr.Name
+	}
+	common := dns.CompareDomainName(name, ce)
+	idx := dns.Split(name)
+	if common >= len(idx) {
+		return name
+	}
+	if common == 0 {
+		return "."
+	}
+	return name[idx[len(idx)-common]:]
+}
+
+// wildcardName returns the wildcard name of zone.
+func wildcardName(zone string) string {
+	if zone == "." {
+		return "*."
+	}
+	return "*." + zone
+}
+
+// canonicalCompare compares domain names in DNSSEC canonical order, RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+// verifySig reports whether sig is a valid signature of rrs, made by one of keys.
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR, now time.Time) bool {
+	if !sig.ValidityPeriod(now) {
+		return false
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if sig.Verify(key, rrs) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRRsets groups records to RRsets, along with their signatures.
+func groupRRsets(rrs []dns.RR) []*dnssecRRset {
+	var sets []*dnssecRRset
+	find := func(name string, typ uint16) *dnssecRRset {
+		for _, set := range sets {
+			if set.typ == typ && strings.EqualFold(set.name, name) {
+				return set
+			}
+		}
+		set := &dnssecRRset{name: name, typ: typ}
+		sets = append(sets, set)
+		return set
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			set := find(h.Name, sig.TypeCovered)
+			set.sigs = append(set.sigs, sig)
+			continue
+		}
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		set := find(h.Name, h.Rrtype)
+		set.rrs = append(set.rrs, rr)
+	}
+	// Drop signatures without records.
+	n := 0
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			sets[n] = set
+			n++
+		}
+	}
+	return sets[:n]
+}
+
+// synthesizedFromDNAME reports whether the CNAME set is synthesized from a DNAME record in sets.
+func synthesizedFromDNAME(cname *dnssecRRset, sets []*dnssecRRset) bool {
+	for _, set := range sets {
+		if set.typ == dns.TypeDNAME && dns.IsSubDomain(set.name, cname.name) && !strings.EqualFold(set.name, cname.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// minTTL returns the minimum TTL of rrs and the original TTL of sig.
+func minTTL(rrs []dns.RR, sig *dns.RRSIG) uint32 {
+	ttl := sig.OrigTtl
+	for _, rr := range rrs {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// hasType reports whether the NSEC type bitmap contains typ.
+func hasType(bitmap []uint16, typ uint16) bool {
+	for _, t := range bitmap {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedDNSSECAlgorithm reports whether the DNSSEC algorithm could be validated.
+func supportedDNSSECAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// supportedDSDigest reports whether the DS digest type could be validated.
+func supportedDSDigest(digest uint8) bool {
+	switch digest {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+// canonicalZone returns the lower case FQDN of name.
+func canonicalZone(name string) string {
+	return dns.CanonicalName(name)
+}
+
+// DNSSECQuery returns a copy of msg, requesting DNSSEC records without upstream validation.
+func DNSSECQuery(msg *dns.Msg) *dns.Msg {
+	m := msg.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	} else {
+		opt.SetDo()
+	}
+	m.CheckingDisabled = true
+	return m
+}
+
+// DNSSECAnswer adjusts the answer of a DNSSEC query sent upstream, so it matches query msg sent by
+// the client: AD bit is set for secure answers, DNSSEC records are removed if the client did not
+// request them.
+func DNSSECAnswer(answer, msg *dns.Msg, result string) {
+	clientOpt := msg.IsEdns0()
+	do := clientOpt != nil && clientOpt.Do()
+	answer.AuthenticatedData = result == DNSSECSecure && (do || msg.AuthenticatedData)
+	answer.CheckingDisabled = msg.CheckingDisabled
+	if clientOpt == nil {
+		removeOPT(answer)
+	} else if opt := answer.IsEdns0(); opt != nil {
+		opt.SetDo(do)
+	}
+	if do || len(msg.Question) == 0 {
+		return
+	}
+	qtype := msg.Question[0].Qtype
+	strip := func(rrs []dns.RR) []dns.RR {
+		n := 0
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			rrs[n] = rr
+			n++
+		}
+		return rrs[:n]
+	}
+	answer.Answer = strip(answer.Answer)
+	answer.Ns = strip(answer.Ns)
+	answer.Extra = strip(answer.Extra)
+}
+
+// removeOPT removes the EDNS0 OPT record from msg.
+func removeOPT(msg *dns.Msg) {
+	n := 0
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			msg.Extra[n] = rr
+			n++
+		}
+	}
+	msg.Extra = msg.Extra[:n]
+}
@@ -0,0 +1,299 @@
+package ctrld
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSSECValidator_Validate(t *testing.T) {
+	h := newTestDNSSECHierarchy(t)
+	example := h.zones["example."]
+	now := time.Now()
+	expired := func(sig *dns.RRSIG) {
+		sig.Inception = uint32(now.Add(-2 * time.Hour).Unix())
+		sig.Expiration = uint32(now.Add(-time.Hour).Unix())
+	}
+	nsec := func(owner, next string, types ...uint16) dns.RR {
+		return &dns.NSEC{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600}, NextDomain: next, TypeBitMap: types}
+	}
+	soa := testRR(t, "example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 3600")
+
+	tests := []struct {
+		name   string
+		ntas   []string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		want   string
+	}{
+		{
+			name:   "secure",
+			qname:  "secure.example.",
+			qtype:  dns.TypeA,
+			answer: example.sign(t, nil, testRR(t, "secure.example. 3600 IN A 192.0.2.1")),
+			want:   DNSSECSecure,
+		},
+		{
+			name:   "tampered",
+			qname:  "secure.example.",
+			qtype:  dns.TypeA,
+			answer: tamperA(example.sign(t, nil, testRR(t, "secure.example. 3600 IN A 192.0.2.1"))),
+			want:   DNSSECBogus,
+		},
+		{
+			name:   "expired signature",
+			qname:  "secure.example.",
+			qtype:  dns.TypeA,
+			answer: example.sign(t, expired, testRR(t, "secure.example. 3600 IN A 192.0.2.1")),
+			want:   DNSSECBogus,
+		},
+		{
+			name:   "insecure delegation",
+			qname:  "www.insecure.example.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{testRR(t, "www.insecure.example. 3600 IN A 192.0.2.2")},
+			want:   DNSSECInsecure,
+		},
+		{
+			name:   "missing signature",
+			qname:  "nosig.example.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{testRR(t, "nosig.example. 3600 IN A 192.0.2.3")},
+			want:   DNSSECBogus,
+		},
+		{
+			name:   "negative trust anchor",
+			ntas:   []string{"example"},
+			qname:  "secure.example.",
+			qtype:  dns.TypeA,
+			answer: tamperA(example.sign(t, nil, testRR(t, "secure.example. 3600 IN A 192.0.2.1"))),
+			want:   DNSSECInsecure,
+		},
+		{
+			name:  "nxdomain",
+			qname: "missing.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns: joinRRs(
+				example.sign(t, nil, soa),
+				example.sign(t, nil, nsec("example.", "insecure.example.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY)),
+				example.sign(t, nil, nsec("insecure.example.", "nosig.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)),
+			),
+			want: DNSSECSecure,
+		},
+		{
+			name:  "nxdomain without wildcard proof",
+			qname: "missing.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns: joinRRs(
+				example.sign(t, nil, soa),
+				example.sign(t, nil, nsec("insecure.example.", "nosig.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)),
+			),
+			want: DNSSECBogus,
+		},
+		{
+			name:  "nodata",
+			qname: "secure.example.",
+			qtype: dns.TypeAAAA,
+			ns: joinRRs(
+				example.sign(t, nil, soa),
+				example.sign(t, nil, nsec("secure.example.", "example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+			),
+			want: DNSSECSecure,
+		},
+		{
+			name:  "nodata with existing type",
+			qname: "secure.example.",
+			qtype: dns.TypeA,
+			ns: joinRRs(
+				example.sign(t, nil, soa),
+				example.sign(t, nil, nsec("secure.example.", "example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+			),
+			want: DNSSECBogus,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			v, err := NewDNSSECValidator([]string{h.anchor}, tc.ntas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := new(dns.Msg)
+			msg.SetQuestion(tc.qname, tc.qtype)
+			answer := new(dns.Msg)
+			answer.SetRcode(msg, tc.rcode)
+			answer.Answer = tc.answer
+			answer.Ns = tc.ns
+			got, err := v.Validate(context.Background(), msg, answer, h.lookup)
+			if got != tc.want {
+				t.Errorf("unexpected result, want: %s, got: %s, err: %v", tc.want, got, err)
+			}
+			if (got == DNSSECBogus) != (err != nil) {
+				t.Errorf("error must be returned for bogus answer only, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestDNSSECAnswer(t *testing.T) {
+	answer := new(dns.Msg)
+	answer.SetReply(testQuery("example.com."))
+	answer.Answer = []dns.RR{
+		testRR(t, "example.com. 3600 IN A 192.0.2.1"),
+		testRR(t, "example.com. 3600 IN RRSIG A 13 2 3600 20300101000000 20200101000000 12345 example.com. AAAA"),
+	}
+	answer.SetEdns0(dns.DefaultMsgSize, true)
+
+	msg := testQuery("example.com.")
+	DNSSECAnswer(answer, msg, DNSSECSecure)
+	if len(answer.Answer) != 1 || answer.IsEdns0() != nil || answer.AuthenticatedData {
+		t.Errorf("unexpected answer: %v", answer)
+	}
+
+	answer.Answer = append(answer.Answer, testRR(t, "example.com. 3600 IN RRSIG A 13 2 3600 20300101000000 20200101000000 12345 example.com. AAAA"))
+	answer.SetEdns0(dns.DefaultMsgSize, true)
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+	DNSSECAnswer(answer, msg, DNSSECSecure)
+	if len(answer.Answer) != 2 || !answer.AuthenticatedData {
+		t.Errorf("unexpected answer: %v", answer)
+	}
+}
+
+// testDNSSECHierarchy is a signed hierarchy of the root zone and "example." zone, where
+// "insecure.example." is delegated without DS records.
+type testDNSSECHierarchy struct {
+	anchor    string
+	zones     map[string]*testDNSSECZone
+	responses map[string]*dns.Msg
+}
+
+func newTestDNSSECHierarchy(t *testing.T) *testDNSSECHierarchy {
+	t.Helper()
+	root := newTestDNSSECZone(t, ".")
+	example := newTestDNSSECZone(t, "example.")
+	h := &testDNSSECHierarchy{
+		anchor:    root.key.ToDS(dns.SHA256).String(),
+		zones:     map[string]*testDNSSECZone{".": root, "example.": example},
+		responses: make(map[string]*dns.Msg),
+	}
+	soa := testRR(t, "example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 3600")
+	h.add(".", dns.TypeDNSKEY, root.sign(t, nil, root.key), nil)
+	h.add("example.", dns.TypeDS, root.sign(t, nil, example.key.ToDS(dns.SHA256)), nil)
+	h.add("example.", dns.TypeDNSKEY, example.sign(t, nil, example.key), nil)
+	h.add("insecure.example.", dns.TypeDS, nil, joinRRs(
+		example.sign(t, nil, soa),
+		example.sign(t, nil, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "insecure.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+			NextDomain: "nosig.example.",
+			TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+		}),
+	))
+	h.add("nosig.example.", dns.TypeDS, nil, joinRRs(
+		example.sign(t, nil, soa),
+		example.sign(t, nil, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "nosig.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+			NextDomain: "secure.example.",
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+		}),
+	))
+	return h
+}
+
+func (h *testDNSSECHierarchy) add(name string, qtype uint16, answer, ns []dns.RR) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.Response = true
+	msg.Answer = answer
+	msg.Ns = ns
+	h.responses[name+"/"+dns.TypeToString[qtype]] = msg
+}
+
+func (h *testDNSSECHierarchy) lookup(_ context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg, ok := h.responses[strings.ToLower(name)+"/"+dns.TypeToString[qtype]]
+	if !ok {
+		return nil, errors.New("unexpected lookup: " + name + " " + dns.TypeToString[qtype])
+	}
+	return msg.Copy(), nil
+}
+
+// testDNSSECZone is a zone signed by a single ECDSA key.
+type testDNSSECZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestDNSSECZone(t *testing.T, name string) *testDNSSECZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDNSSECZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrs along with their signature, modify is applied to the signature before signing.
+func (z *testDNSSECZone) sign(t *testing.T, modify func(*dns.RRSIG), rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+	}
+	if modify != nil {
+		modify(sig)
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]dns.RR{}, rrs...), sig)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// tamperA changes the address of A records in rrs.
+func tamperA(rrs []dns.RR) []dns.RR {
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			a.A = a.A.To4()
+			a.A[3]++
+		}
+	}
+	return rrs
+}
+
+func joinRRs(sets ...[]dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, set := range sets {
+		rrs = append(rrs, set...)
+	}
+	return rrs
+}
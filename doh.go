@@ -1,6 +1,7 @@
 package ctrld
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
@@ -23,6 +24,7 @@ const (
 	dohHostHeader        = "x-cd-host"
 	dohOsHeader          = "x-cd-os"
 	headerApplicationDNS = "application/dns-message"
+	dohMethodPost        = "post"
 )
 
 // EncodeOsNameMap provides mapping from OS name to a shorter string, used for encoding x-cd-os value.
@@ -96,16 +98,13 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		return nil, err
 	}
 
-	enc := base64.RawURLEncoding.EncodeToString(data)
-	query := r.endpoint.Query()
-	query.Add("dns", enc)
-
-	endpoint := *r.endpoint
-	endpoint.RawQuery = query.Encode()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	req, err := r.newRequest(ctx, data)
 	if err != nil {
 		return nil, fmt.Errorf("could not create request: %w", err)
 	}
+	for name, values := range r.uc.headers {
+		req.Header[name] = values
+	}
 	addHeader(ctx, req, r.sendClientInfo)
 	dnsTyp := uint16(0)
 	if len(msg.Question) > 0 {
@@ -146,6 +145,31 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 	return answer, nil
 }
 
+// newRequest creates the DoH request for given DNS message, using the upstream configured method.
+func (r *dohResolver) newRequest(ctx context.Context, data []byte) (*http.Request, error) {
+	if r.uc.Method == dohMethodPost {
+		return http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint.String(), bytes.NewReader(data))
+	}
+	enc := base64.RawURLEncoding.EncodeToString(data)
+	query := r.endpoint.Query()
+	query.Add("dns", enc)
+
+	endpoint := *r.endpoint
+	endpoint.RawQuery = query.Encode()
+	return http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+}
+
+// isClientInfoHeader reports whether the given header is used for sending client info.
+func isClientInfoHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case http.CanonicalHeaderKey(dohMacHeader),
+		http.CanonicalHeaderKey(dohIPHeader),
+		http.CanonicalHeaderKey(dohHostHeader):
+		return true
+	}
+	return false
+}
+
 func addHeader(ctx context.Context, req *http.Request, sendClientInfo bool) {
 	req.Header.Set("Content-Type", headerApplicationDNS)
 	req.Header.Set("Accept", headerApplicationDNS)
@@ -170,6 +194,18 @@ func addHeader(ctx context.Context, req *http.Request, sendClientInfo bool) {
 		}
 	}
 	if printed {
-		Log(ctx, ProxyLogger.Load().Debug().Interface("header", req.Header), "sending request header")
+		Log(ctx, ProxyLogger.Load().Debug().Interface("header", clientInfoHeaders(req.Header)), "sending request header")
+	}
+}
+
+// clientInfoHeaders returns the client info headers of h. Other headers are not logged,
+// since configured headers could contain credentials.
+func clientInfoHeaders(h http.Header) http.Header {
+	ch := make(http.Header)
+	for name, values := range h {
+		if isClientInfoHeader(name) || http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(dohOsHeader) {
+			ch[name] = values
+		}
 	}
+	return ch
 }
@@ -1,8 +1,18 @@
 package ctrld
 
 import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func Test_dohOsHeaderValue(t *testing.T) {
@@ -21,3 +31,120 @@ func Test_dohOsHeaderValue(t *testing.T) {
 		t.Fatalf("missing decoding value for: %q", runtime.GOOS)
 	}
 }
+
+func Test_dohResolver_methodAndHeaders(t *testing.T) {
+	t.Setenv("CTRLD_TEST_DOH_TOKEN", "Bearer secret")
+	tests := []struct {
+		name   string
+		method string
+	}{
+		{"get", ""},
+		{"post", dohMethodPost},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var data []byte
+				switch r.Method {
+				case http.MethodGet:
+					data, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+				case http.MethodPost:
+					data, _ = io.ReadAll(r.Body)
+				}
+				if want := strings.ToUpper(tc.method); want != "" && r.Method != want {
+					t.Errorf("unexpected method, want: %s, got: %s", want, r.Method)
+				}
+				if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+					t.Errorf("unexpected Authorization header: %q", got)
+				}
+				if got := r.Header.Get("User-Agent"); got != "ctrld-test" {
+					t.Errorf("unexpected User-Agent header: %q", got)
+				}
+				if got := r.Header.Get(dohMacHeader); got != "" {
+					t.Errorf("unexpected client info header: %q", got)
+				}
+				m := new(dns.Msg)
+				if err := m.Unpack(data); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				answer := new(dns.Msg)
+				answer.SetReply(m)
+				buf, _ := answer.Pack()
+				w.Header().Set("Content-Type", headerApplicationDNS)
+				_, _ = w.Write(buf)
+			}))
+			defer srv.Close()
+
+			uc := &UpstreamConfig{
+				Name:        "test",
+				Type:        ResolverTypeDOH,
+				Endpoint:    srv.URL + "/dns-query",
+				BootstrapIP: "127.0.0.1",
+				Method:      tc.method,
+				Headers: map[string]string{
+					"authorization": "env:CTRLD_TEST_DOH_TOKEN",
+					"user-agent":    "ctrld-test",
+					dohMacHeader:    "00:00:00:00:00:01",
+				},
+			}
+			uc.Init()
+			r := newDohResolver(uc)
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			if _, err := r.Resolve(context.Background(), msg); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_clientInfoHeaders(t *testing.T) {
+	h := make(http.Header)
+	h.Set("Authorization", "Bearer secret")
+	h.Set(dohMacHeader, "00:00:00:00:00:01")
+	h.Set(dohOsHeader, dohOsHeaderValue())
+	got := clientInfoHeaders(h)
+	if v := got.Get("Authorization"); v != "" {
+		t.Errorf("configured header is leaked: %q", v)
+	}
+	if v := got.Get(dohMacHeader); v != "00:00:00:00:00:01" {
+		t.Errorf("unexpected %s header: %q", dohMacHeader, v)
+	}
+	if v := got.Get(dohOsHeader); v == "" {
+		t.Errorf("missing %s header", dohOsHeader)
+	}
+}
+
+func Test_secretValue(t *testing.T) {
+	t.Setenv("CTRLD_TEST_SECRET", "from-env")
+	f := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(f, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"plain", "plain", "plain", false},
+		{"env", "env:CTRLD_TEST_SECRET", "from-env", false},
+		{"env not set", "env:CTRLD_TEST_SECRET_NOT_SET", "", true},
+		{"file", "file:" + f, "from-file", false},
+		{"file not exist", "file:" + f + ".not-exist", "", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := secretValue(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("unexpected value, want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
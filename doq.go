@@ -5,21 +5,26 @@ package ctrld
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
+	"golang.org/x/sync/singleflight"
 )
 
+// doqIdleTimeout is the duration a DoQ connection is kept open without any activity.
+const doqIdleTimeout = 30 * time.Second
+
 type doqResolver struct {
 	uc *UpstreamConfig
 }
 
 func (r *doqResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	endpoint := r.uc.Endpoint
-	tlsConfig := &tls.Config{NextProtos: []string{"doq"}}
 	ip := r.uc.BootstrapIP
 	if ip == "" {
 		dnsTyp := uint16(0)
@@ -28,41 +33,196 @@ func (r *doqResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		}
 		ip = r.uc.bootstrapIPForDNSType(dnsTyp)
 	}
-	tlsConfig.ServerName = r.uc.Domain
 	_, port, _ := net.SplitHostPort(endpoint)
 	endpoint = net.JoinHostPort(ip, port)
-	return resolve(ctx, msg, endpoint, tlsConfig)
+	return r.uc.doqConnPool().resolve(ctx, msg, endpoint)
+}
+
+// doqConnPool returns the DoQ connection pool of the upstream.
+func (uc *UpstreamConfig) doqConnPool() *doqConnPool {
+	uc.doqPoolOnce.Do(func() {
+		tlsConfig := uc.newTLSConfig()
+		tlsConfig.NextProtos = []string{"doq"}
+		tlsConfig.ServerName = uc.Domain
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		uc.doqPool = &doqConnPool{
+			tlsConfig:  tlsConfig,
+			quicConfig: &quic.Config{MaxIdleTimeout: doqIdleTimeout},
+			conns:      make(map[string]quic.EarlyConnection),
+		}
+		if uc.bindEnabled() {
+			uc.doqPool.listenUDP = uc.listenUDP
+		}
+	})
+	return uc.doqPool
+}
+
+// doqConnPool manages long-lived QUIC connections to a DoQ upstream, one per endpoint.
+// Each query is sent on its own stream, as described in RFC 9250.
+//
+// TLS session tickets are cached, so reconnecting to the upstream could use 0-RTT.
+type doqConnPool struct {
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	// listenUDP returns the UDP socket for new connections, if nil, quic-go creates one.
+	listenUDP func(ctx context.Context) (net.PacketConn, error)
+
+	mu    sync.Mutex
+	conns map[string]quic.EarlyConnection
+	// dialGroup deduplicates concurrent dials to the same endpoint.
+	dialGroup singleflight.Group
+}
+
+func (p *doqConnPool) resolve(ctx context.Context, msg *dns.Msg, endpoint string) (*dns.Msg, error) {
+	conn, cached, err := p.getConn(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := doResolve(ctx, conn, msg)
+	if err == nil {
+		return answer, nil
+	}
+	closed := doqConnClosed(conn, err)
+	if closed {
+		p.closeConn(endpoint, conn)
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	switch {
+	case closed && cached:
+		// The cached connection may be closed by the upstream in the meantime,
+		// reconnecting to the upstream and try again.
+		Log(ctx, ProxyLogger.Load().Debug().Err(err), "doq connection closed, reconnecting")
+	case errors.Is(err, io.EOF):
+		// The upstream returns io.EOF for a good stream of a long-running connection,
+		// so trying again on a new stream.
+		Log(ctx, ProxyLogger.Load().Debug().Err(err), "doq stream failed, retrying")
+	default:
+		return nil, err
+	}
+	if conn, _, err = p.getConn(ctx, endpoint); err != nil {
+		return nil, err
+	}
+	answer, err = doResolve(ctx, conn, msg)
+	if err != nil {
+		if doqConnClosed(conn, err) {
+			p.closeConn(endpoint, conn)
+		}
+		return nil, err
+	}
+	return answer, nil
 }
 
-func resolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tls.Config) (*dns.Msg, error) {
-	// DoQ quic-go server returns io.EOF error after running for a long time,
-	// even for a good stream. So retrying the query for 5 times before giving up.
-	for i := 0; i < 5; i++ {
-		answer, err := doResolve(ctx, msg, endpoint, tlsConfig)
-		if err == io.EOF {
-			continue
+// doqConnClosed reports whether err, returned by a query on conn, means the connection
+// is no longer usable. Other errors, like stream errors or timeout of a single query,
+// do not affect other queries on the same connection.
+func doqConnClosed(conn quic.Connection, err error) bool {
+	if conn.Context().Err() != nil {
+		return true
+	}
+	var (
+		idleErr  *quic.IdleTimeoutError
+		appErr   *quic.ApplicationError
+		resetErr *quic.StatelessResetError
+	)
+	return errors.As(err, &idleErr) || errors.As(err, &appErr) || errors.As(err, &resetErr)
+}
+
+// getConn returns the connection to given endpoint, dialing a new one if there's no
+// usable connection. The second return value reports whether the connection is cached.
+//
+// Dialing is done without holding the lock, so queries to other endpoints are not blocked,
+// and concurrent queries to the same endpoint share a single dial.
+func (p *doqConnPool) getConn(ctx context.Context, endpoint string) (quic.EarlyConnection, bool, error) {
+	if conn := p.cachedConn(endpoint); conn != nil {
+		return conn, true, nil
+	}
+	ch := p.dialGroup.DoChan(endpoint, func() (any, error) {
+		if conn := p.cachedConn(endpoint); conn != nil {
+			return conn, nil
 		}
+		conn, err := p.dial(ctx, endpoint)
 		if err != nil {
 			return nil, err
 		}
-		return answer, nil
+		Log(ctx, ProxyLogger.Load().Debug(), "new doq connection to: %s", endpoint)
+		p.mu.Lock()
+		p.conns[endpoint] = conn
+		p.mu.Unlock()
+		return conn, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, false, res.Err
+		}
+		return res.Val.(quic.EarlyConnection), false, nil
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// cachedConn returns the usable connection to given endpoint, or nil if there's none.
+func (p *doqConnPool) cachedConn(endpoint string) quic.EarlyConnection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn := p.conns[endpoint]
+	if conn == nil {
+		return nil
 	}
-	return nil, &quic.ApplicationError{ErrorCode: quic.ApplicationErrorCode(quic.InternalError), ErrorMessage: quic.InternalError.Message()}
+	if conn.Context().Err() != nil {
+		delete(p.conns, endpoint)
+		return nil
+	}
+	return conn
 }
 
-func doResolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tls.Config) (*dns.Msg, error) {
-	session, err := quic.DialAddr(ctx, endpoint, tlsConfig, nil)
+func (p *doqConnPool) dial(ctx context.Context, endpoint string) (quic.EarlyConnection, error) {
+	if p.listenUDP == nil {
+		return quic.DialAddrEarly(ctx, endpoint, p.tlsConfig, p.quicConfig)
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := p.listenUDP(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer session.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+	conn, err := quic.DialEarly(ctx, udpConn, remoteAddr, p.tlsConfig, p.quicConfig)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	// The UDP socket is owned by us, so closing it once the connection is closed.
+	go func() {
+		<-conn.Context().Done()
+		udpConn.Close()
+	}()
+	return conn, nil
+}
+
+// closeConn closes the connection, removing it from the pool.
+func (p *doqConnPool) closeConn(endpoint string, conn quic.EarlyConnection) {
+	p.mu.Lock()
+	if p.conns[endpoint] == conn {
+		delete(p.conns, endpoint)
+	}
+	p.mu.Unlock()
+	_ = conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+}
 
-	msgBytes, err := msg.Pack()
+func doResolve(ctx context.Context, conn quic.Connection, msg *dns.Msg) (*dns.Msg, error) {
+	// RFC 9250 requires the DNS message ID to be 0.
+	m := msg.Copy()
+	m.Id = 0
+	msgBytes, err := m.Pack()
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := session.OpenStream()
+	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -75,21 +235,18 @@ func doResolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tl
 
 	var msgLen = uint16(len(msgBytes))
 	var msgLenBytes = []byte{byte(msgLen >> 8), byte(msgLen & 0xFF)}
-	if _, err := stream.Write(msgLenBytes); err != nil {
+	if _, err := stream.Write(append(msgLenBytes, msgBytes...)); err != nil {
 		return nil, err
 	}
 
-	if _, err := stream.Write(msgBytes); err != nil {
-		return nil, err
-	}
+	// Closing the write direction of the stream, indicating that no more data will be sent.
+	_ = stream.Close()
 
 	buf, err := io.ReadAll(stream)
 	if err != nil {
 		return nil, err
 	}
 
-	_ = stream.Close()
-
 	// io.ReadAll hide the io.EOF error returned by quic-go server.
 	// Once we figure out why quic-go server sends io.EOF after running
 	// for a long time, we can have a better way to handle this. For now,
@@ -97,11 +254,14 @@ func doResolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tl
 	if len(buf) == 0 {
 		return nil, io.EOF
 	}
+	if len(buf) < 2 {
+		return nil, errors.New("doq: short response")
+	}
 
 	answer := new(dns.Msg)
 	if err := answer.Unpack(buf[2:]); err != nil {
 		return nil, err
 	}
-	answer.SetReply(msg)
+	answer.Id = msg.Id
 	return answer, nil
 }
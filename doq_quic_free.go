@@ -9,6 +9,8 @@ import (
 	"github.com/miekg/dns"
 )
 
+type doqConnPool struct{}
+
 type doqResolver struct {
 	uc *UpstreamConfig
 }
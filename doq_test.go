@@ -0,0 +1,220 @@
+//go:build !qf
+
+package ctrld
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func Test_doqResolver_reuseConnection(t *testing.T) {
+	srv := newTestDoQServer(t)
+	r := &doqResolver{uc: srv.uc}
+
+	for i := 0; i < 5; i++ {
+		msg := testQuery("example.com.")
+		answer, err := r.Resolve(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer.Id != msg.Id {
+			t.Errorf("mismatched id, want: %d, got: %d", msg.Id, answer.Id)
+		}
+	}
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
+
+func Test_doqResolver_reconnect(t *testing.T) {
+	srv := newTestDoQServer(t)
+	r := &doqResolver{uc: srv.uc}
+
+	if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	srv.closeConns()
+	if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatalf("closed connection is not handled: %v", err)
+	}
+	if n := srv.accepted.Load(); n != 2 {
+		t.Errorf("unexpected number of connections, want: 2, got: %d", n)
+	}
+}
+
+func Test_doqResolver_streamError(t *testing.T) {
+	srv := newTestDoQServer(t)
+	r := &doqResolver{uc: srv.uc}
+
+	if _, err := r.Resolve(context.Background(), testQuery(testDoQResetName)); err == nil {
+		t.Fatal("expected error for reset stream")
+	}
+	if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("connection is closed on stream error, want: 1 connection, got: %d", n)
+	}
+}
+
+func Test_doqResolver_concurrentDial(t *testing.T) {
+	srv := newTestDoQServer(t)
+	r := &doqResolver{uc: srv.uc}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Resolve(context.Background(), testQuery("example.com."))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
+
+// testDoQResetName is the query name which the test server resets the stream for.
+const testDoQResetName = "reset.example.com."
+
+var errTestDoQReset = errors.New("stream reset")
+
+// testDoQServer is a local DoQ server, counting the number of accepted connections.
+type testDoQServer struct {
+	ln       *quic.Listener
+	uc       *UpstreamConfig
+	accepted atomic.Int64
+
+	mu    sync.Mutex
+	conns []quic.Connection
+}
+
+func newTestDoQServer(t *testing.T) *testDoQServer {
+	t.Helper()
+	cert, certPool := testTLSCertificate(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &testDoQServer{ln: ln}
+	s.uc = &UpstreamConfig{
+		Name:     "test",
+		Type:     ResolverTypeDOQ,
+		Endpoint: ln.Addr().String(),
+		Timeout:  5000,
+	}
+	s.uc.Init()
+	s.uc.SetCertPool(certPool)
+
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			s.accepted.Add(1)
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serveConn(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testDoQServer) serveConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			if err := serveDoQStream(stream); err != nil && !errors.Is(err, io.EOF) {
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+			}
+		}()
+	}
+}
+
+func serveDoQStream(stream quic.Stream) error {
+	buf, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	if len(buf) < 2 {
+		return io.EOF
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf[2:]); err != nil {
+		return err
+	}
+	if m.Question[0].Name == testDoQResetName {
+		return errTestDoQReset
+	}
+	answer := new(dns.Msg)
+	answer.SetReply(m)
+	rr, _ := dns.NewRR(m.Question[0].Name + " 300 IN A 127.0.0.1")
+	answer.Answer = append(answer.Answer, rr)
+	data, err := answer.Pack()
+	if err != nil {
+		return err
+	}
+	out := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(out, uint16(len(data)))
+	copy(out[2:], data)
+	_, err = stream.Write(out)
+	return err
+}
+
+func (s *testDoQServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.CloseWithError(0, "")
+	}
+	s.conns = nil
+}
+
+func Test_doqResolver_sourceIP(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 is only available on Linux")
+	}
+	srv := newTestDoQServer(t)
+	srv.uc.SourceIP = "127.0.0.2"
+	r := &doqResolver{uc: srv.uc}
+	if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.conns) != 1 {
+		t.Fatalf("unexpected number of connections: %d", len(srv.conns))
+	}
+	if ip := srv.conns[0].RemoteAddr().(*net.UDPAddr).IP.String(); ip != "127.0.0.2" {
+		t.Errorf("unexpected source ip: %s", ip)
+	}
+}
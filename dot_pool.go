@@ -0,0 +1,417 @@
+package ctrld
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dotIdleTimeout is the default duration a pooled DoT connection is kept open
+	// without any in-flight queries. It's replaced by the upstream's own idle timeout
+	// once the upstream advertises one via the edns-tcp-keepalive option (RFC 7828).
+	dotIdleTimeout = 10 * time.Second
+	// dotMaxConns is the maximum number of connections kept in a DoT pool.
+	dotMaxConns = 4
+	// dotMaxPipelined is the number of in-flight queries on a single connection,
+	// above which the pool prefers dialing a new connection.
+	dotMaxPipelined = 64
+)
+
+var errDoTConnClosed = errors.New("dot: connection closed")
+
+// dotConnPool returns the DoT connection pool of the upstream for given network and endpoint.
+func (uc *UpstreamConfig) dotConnPool(network, endpoint string) *dotPool {
+	uc.dotPoolsMu.Lock()
+	defer uc.dotPoolsMu.Unlock()
+	if uc.dotPools == nil {
+		uc.dotPools = make(map[string]*dotPool)
+		uc.dotSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	key := network + "|" + endpoint
+	if p := uc.dotPools[key]; p != nil {
+		return p
+	}
+	tlsConfig := uc.newTLSConfig()
+	tlsConfig.ServerName = uc.Domain
+	tlsConfig.ClientSessionCache = uc.dotSessionCache
+	// The dialer is used to prevent bootstrapping cycle.
+	// If endpoint is set to dns.controld.dev, we need to resolve
+	// dns.controld.dev first. By using a dialer with custom resolver,
+	// we ensure that we can always resolve the bootstrap domain
+	// regardless of the machine DNS status.
+	var dialer contextDialer = uc.bindDialer(newDialer(uc.bootstrapServers()), network)
+	if uc.proxy != nil {
+		dialer = uc.proxy
+	}
+	p := &dotPool{
+		network:   network,
+		endpoint:  endpoint,
+		dialer:    dialer,
+		tlsConfig: tlsConfig,
+	}
+	uc.dotPools[key] = p
+	return p
+}
+
+// dotPool manages persistent connections to a DoT upstream.
+//
+// Queries are pipelined on pooled connections as described in RFC 7766,
+// responses are matched with their queries by ID, so they can arrive out of order.
+type dotPool struct {
+	network   string
+	endpoint  string
+	dialer    contextDialer
+	tlsConfig *tls.Config
+
+	dialMu sync.Mutex
+	mu     sync.Mutex
+	conns  []*dotConn
+}
+
+// exchange sends the query using a pooled connection, dialing a new one if necessary.
+// If the query fails on a reused connection, it's retried once on a fresh connection,
+// since the upstream may have closed the connection in the meantime.
+func (p *dotPool) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	dc, reused, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := dc.exchange(ctx, msg)
+	if err == nil || !reused || ctx.Err() != nil {
+		return answer, err
+	}
+	Log(ctx, ProxyLogger.Load().Debug().Err(err), "pooled dot connection failed, retrying with new connection")
+	dc.close(err)
+	if dc, err = p.dial(ctx); err != nil {
+		return nil, err
+	}
+	return dc.exchange(ctx, msg)
+}
+
+// get returns the least loaded connection of the pool. A new connection is dialed if there's
+// no usable connection, or all connections are busy and the pool is not full yet.
+//
+// The second return value reports whether the connection was already in the pool.
+func (p *dotPool) get(ctx context.Context) (*dotConn, bool, error) {
+	if dc := p.pick(); dc != nil {
+		return dc, true, nil
+	}
+	// Only one dial at a time, so concurrent queries on an empty pool
+	// share the new connection instead of dialing their own.
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+	if dc := p.pick(); dc != nil {
+		return dc, true, nil
+	}
+	dc, err := p.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return dc, false, nil
+}
+
+// pick returns the least loaded usable connection, or nil if a new connection should be dialed.
+func (p *dotPool) pick() *dotConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *dotConn
+	bestLoad := 0
+	for _, dc := range p.conns {
+		load, ok := dc.load()
+		if !ok {
+			continue
+		}
+		if best == nil || load < bestLoad {
+			best, bestLoad = dc, load
+		}
+	}
+	if best != nil && (bestLoad < dotMaxPipelined || len(p.conns) >= dotMaxConns) {
+		return best
+	}
+	return nil
+}
+
+// dial creates a new connection to the upstream, adding it to the pool.
+func (p *dotPool) dial(ctx context.Context) (*dotConn, error) {
+	conn, err := p.dialer.DialContext(ctx, p.network, p.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, p.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	Log(ctx, ProxyLogger.Load().Debug(), "new dot connection to: %s, resumed: %v", conn.RemoteAddr(), tlsConn.ConnectionState().DidResume)
+	dc := &dotConn{
+		pool:    p,
+		conn:    tlsConn,
+		pending: make(map[uint16]chan *dns.Msg),
+		nextID:  uint16(rand.Intn(1 << 16)),
+		idle:    dotIdleTimeout,
+		done:    make(chan struct{}),
+	}
+	p.mu.Lock()
+	p.conns = append(p.conns, dc)
+	p.mu.Unlock()
+	go dc.readLoop()
+	return dc, nil
+}
+
+// remove removes the connection from the pool.
+func (p *dotPool) remove(dc *dotConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.conns {
+		if p.conns[i] == dc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// dotConn is a single DoT connection, which may have multiple in-flight queries.
+type dotConn struct {
+	pool *dotPool
+	conn net.Conn
+
+	wmu sync.Mutex // serializes writes to conn.
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	nextID  uint16
+	idle    time.Duration
+	err     error
+	closed  bool
+	done    chan struct{}
+}
+
+// load returns the number of in-flight queries on the connection,
+// the second return value reports whether the connection is still usable.
+func (dc *dotConn) load() (int, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return len(dc.pending), dc.err == nil
+}
+
+// exchange sends the query on the connection and waits for its answer.
+//
+// The query ID is rewritten to a unique ID among in-flight queries of the connection,
+// the original ID is restored in the answer.
+func (dc *dotConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	m := msg.Copy()
+	addedOpt := m.IsEdns0() == nil
+	setTCPKeepalive(m)
+
+	ch := make(chan *dns.Msg, 1)
+	id, err := dc.register(ch)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.unregister(id)
+	m.Id = id
+
+	if err := dc.write(ctx, m); err != nil {
+		dc.close(err)
+		return nil, err
+	}
+
+	select {
+	case answer := <-ch:
+		answer.Id = msg.Id
+		stripTCPKeepalive(answer, addedOpt)
+		return answer, nil
+	case <-dc.done:
+		return nil, dc.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (dc *dotConn) register(ch chan *dns.Msg) (uint16, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.err != nil {
+		return 0, dc.err
+	}
+	for {
+		dc.nextID++
+		if _, ok := dc.pending[dc.nextID]; !ok {
+			break
+		}
+	}
+	dc.pending[dc.nextID] = ch
+	return dc.nextID, nil
+}
+
+func (dc *dotConn) unregister(id uint16) {
+	dc.mu.Lock()
+	delete(dc.pending, id)
+	dc.mu.Unlock()
+}
+
+func (dc *dotConn) write(ctx context.Context, m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(b, uint16(len(buf)))
+	copy(b[2:], buf)
+
+	dc.wmu.Lock()
+	defer dc.wmu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	_ = dc.conn.SetWriteDeadline(deadline)
+	_, err = dc.conn.Write(b)
+	return err
+}
+
+// readLoop reads answers from the connection, dispatching them to the waiting queries.
+// The connection is closed if it has been idle for too long, or any error happens.
+func (dc *dotConn) readLoop() {
+	r := bufio.NewReader(dc.conn)
+	lenBuf := make([]byte, 2)
+	for {
+		dc.mu.Lock()
+		idle := dc.idle
+		dc.mu.Unlock()
+		_ = dc.conn.SetReadDeadline(time.Now().Add(idle))
+
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && dc.busy() {
+				continue
+			}
+			dc.close(err)
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			dc.close(err)
+			return
+		}
+		answer := new(dns.Msg)
+		if err := answer.Unpack(buf); err != nil {
+			dc.close(err)
+			return
+		}
+		dc.mu.Lock()
+		if timeout := tcpKeepaliveTimeout(answer); timeout > 0 {
+			dc.idle = timeout
+		}
+		if ch, ok := dc.pending[answer.Id]; ok {
+			delete(dc.pending, answer.Id)
+			ch <- answer
+		}
+		dc.mu.Unlock()
+	}
+}
+
+// busy reports whether the connection has in-flight queries. An idle connection is
+// marked as closed, so no new queries will be sent on it.
+func (dc *dotConn) busy() bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if len(dc.pending) > 0 {
+		return true
+	}
+	if dc.err == nil {
+		dc.err = errDoTConnClosed
+	}
+	return false
+}
+
+// close closes the connection, in-flight queries are failed with given error.
+func (dc *dotConn) close(err error) {
+	dc.mu.Lock()
+	if dc.closed {
+		dc.mu.Unlock()
+		return
+	}
+	dc.closed = true
+	if dc.err == nil {
+		dc.err = err
+	}
+	dc.mu.Unlock()
+	close(dc.done)
+	_ = dc.conn.Close()
+	dc.pool.remove(dc)
+}
+
+func (dc *dotConn) closeErr() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.err
+}
+
+// setTCPKeepalive adds the edns-tcp-keepalive option to the query, so the upstream
+// could tell how long it's willing to keep the connection open.
+func setTCPKeepalive(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+}
+
+// stripTCPKeepalive removes the edns-tcp-keepalive option from the answer, since it's
+// only meaningful for the connection between ctrld and the upstream. If the OPT record
+// was added by ctrld, it's removed entirely.
+func stripTCPKeepalive(m *dns.Msg, removeOpt bool) {
+	n := 0
+	for _, rr := range m.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			m.Extra[n] = rr
+			n++
+			continue
+		}
+		if removeOpt {
+			continue
+		}
+		options := opt.Option[:0]
+		for _, o := range opt.Option {
+			if o.Option() != dns.EDNS0TCPKEEPALIVE {
+				options = append(options, o)
+			}
+		}
+		opt.Option = options
+		m.Extra[n] = rr
+		n++
+	}
+	m.Extra = m.Extra[:n]
+}
+
+// tcpKeepaliveTimeout returns the idle timeout advertised by the upstream in the answer.
+func tcpKeepaliveTimeout(m *dns.Msg) time.Duration {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	for _, o := range opt.Option {
+		if ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			return time.Duration(ka.Timeout) * 100 * time.Millisecond
+		}
+	}
+	return 0
+}
@@ -0,0 +1,256 @@
+package ctrld
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_dotResolver_reuseConnection(t *testing.T) {
+	srv := newTestDoTServer(t)
+	uc := srv.upstreamConfig()
+	r := &dotResolver{uc: uc}
+
+	for i := 0; i < 5; i++ {
+		if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("unexpected number of connections, want: 1, got: %d", n)
+	}
+}
+
+func Test_dotResolver_pipelining(t *testing.T) {
+	srv := newTestDoTServer(t)
+	uc := srv.upstreamConfig()
+	r := &dotResolver{uc: uc}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := testQuery("example.com.")
+			answer, err := r.Resolve(context.Background(), msg)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if answer.Id != msg.Id {
+				t.Errorf("mismatched id, want: %d, got: %d", msg.Id, answer.Id)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+	if n := srv.accepted.Load(); n > dotMaxConns {
+		t.Errorf("too many connections: %d", n)
+	}
+}
+
+func Test_dotResolver_brokenConnection(t *testing.T) {
+	srv := newTestDoTServer(t)
+	uc := srv.upstreamConfig()
+	r := &dotResolver{uc: uc}
+
+	if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	srv.closeConns()
+	if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+		t.Fatalf("pooled connection failure is not handled: %v", err)
+	}
+	if n := srv.accepted.Load(); n != 2 {
+		t.Errorf("unexpected number of connections, want: 2, got: %d", n)
+	}
+}
+
+func Test_stripTCPKeepalive(t *testing.T) {
+	msg := testQuery("example.com.")
+	setTCPKeepalive(msg)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+
+	answer := msg.Copy()
+	answer.IsEdns0().Option[0].(*dns.EDNS0_TCP_KEEPALIVE).Timeout = 300
+	if timeout := tcpKeepaliveTimeout(answer); timeout != 30*time.Second {
+		t.Errorf("unexpected keepalive timeout: %s", timeout)
+	}
+	stripTCPKeepalive(answer, false)
+	if opt := answer.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0COOKIE {
+		t.Errorf("unexpected OPT record: %v", opt)
+	}
+	stripTCPKeepalive(answer, true)
+	if answer.IsEdns0() != nil {
+		t.Error("OPT record added by ctrld must be removed")
+	}
+}
+
+func BenchmarkDoT_perQueryDial(b *testing.B) {
+	srv := newTestDoTServer(b)
+	uc := srv.upstreamConfig()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dnsClient := &dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: &tls.Config{RootCAs: uc.certPool, ServerName: uc.Domain},
+		}
+		if _, _, err := dnsClient.Exchange(testQuery("example.com."), uc.Endpoint); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDoT_pooled(b *testing.B) {
+	srv := newTestDoTServer(b)
+	r := &dotResolver{uc: srv.upstreamConfig()}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDoT_pooledParallel(b *testing.B) {
+	srv := newTestDoTServer(b)
+	r := &dotResolver{uc: srv.upstreamConfig()}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := r.Resolve(context.Background(), testQuery("example.com.")); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func testQuery(name string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	msg.RecursionDesired = true
+	return msg
+}
+
+// testDoTServer is a local DoT server, counting the number of accepted connections.
+type testDoTServer struct {
+	net.Listener
+	cert     tls.Certificate
+	certPool *x509.CertPool
+	accepted atomic.Int64
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestDoTServer(tb testing.TB, opts ...func(*tls.Config)) *testDoTServer {
+	tb.Helper()
+	cert, certPool := testTLSCertificate(tb)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := &testDoTServer{Listener: ln, cert: cert, certPool: certPool}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	for _, opt := range opts {
+		opt(tlsConfig)
+	}
+	server := &dns.Server{
+		Listener:      tls.NewListener(s, tlsConfig),
+		Net:           "tcp-tls",
+		MaxTCPQueries: -1,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			answer := new(dns.Msg)
+			answer.SetReply(m)
+			rr, _ := dns.NewRR(m.Question[0].Name + " 300 IN A 127.0.0.1")
+			answer.Answer = append(answer.Answer, rr)
+			_ = w.WriteMsg(answer)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	tb.Cleanup(func() { _ = server.Shutdown() })
+	return s
+}
+
+func (s *testDoTServer) Accept() (net.Conn, error) {
+	conn, err := s.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	s.accepted.Add(1)
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+	return conn, nil
+}
+
+func (s *testDoTServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testDoTServer) upstreamConfig() *UpstreamConfig {
+	uc := &UpstreamConfig{
+		Name:     "test",
+		Type:     ResolverTypeDOT,
+		Endpoint: s.Addr().String(),
+		Timeout:  5000,
+	}
+	uc.Init()
+	uc.SetCertPool(s.certPool)
+	return uc
+}
+
+// testTLSCertificate generates a self-signed certificate for 127.0.0.1,
+// returning it with the cert pool which trusts it.
+func testTLSCertificate(tb testing.TB) (tls.Certificate, *x509.CertPool) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	certPool := x509.NewCertPool()
+	certPool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, certPool
+}
@@ -0,0 +1,336 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ECS policies of upstreams.
+const (
+	// ECSPass forwards the EDNS Client Subnet sent by clients as-is.
+	ECSPass = "pass"
+	// ECSStrip removes the EDNS Client Subnet from queries.
+	ECSStrip = "strip"
+	// ECSReplace replaces the EDNS Client Subnet with the configured or detected public prefix.
+	ECSReplace = "replace"
+)
+
+const (
+	// ecsSourceV4 and ecsSourceV6 are the maximum prefix lengths sent to upstreams.
+	ecsSourceV4 = 24
+	ecsSourceV6 = 56
+	// ecsDetectInterval is how often the public IP is re-detected.
+	ecsDetectInterval = 30 * time.Minute
+	// ecsDetectRetryInterval is how long to wait before retrying a failed detection.
+	ecsDetectRetryInterval = time.Minute
+	ecsDetectTimeout       = 5 * time.Second
+)
+
+// defaultECSDetectServers are queried for detecting the public IP, answering a CHAOS TXT query
+// of ecsWhoamiName with the IP address of the client.
+var defaultECSDetectServers = []string{"1.1.1.1:53", "[2606:4700:4700::1111]:53"}
+
+const ecsWhoamiName = "whoami.cloudflare."
+
+// ecsState holds the prefix used for replacing EDNS Client Subnet of an upstream.
+type ecsState struct {
+	mu         sync.Mutex
+	subnet     *dns.EDNS0_SUBNET
+	servers    []string
+	configured bool
+	detecting  bool
+	detectedAt time.Time
+}
+
+// initECS parses the configured ECS subnet of the upstream.
+func (uc *UpstreamConfig) initECS() {
+	uc.ecs = &ecsState{servers: defaultECSDetectServers}
+	if len(uc.ECSDetectServers) > 0 {
+		uc.ecs.servers = nil
+		for _, server := range uc.ECSDetectServers {
+			addr, err := parseECSDetectServer(server)
+			if err != nil {
+				ProxyLogger.Load().Error().Err(err).Msgf("invalid ecs detect server for upstream: %s", uc.Name)
+				continue
+			}
+			uc.ecs.servers = append(uc.ecs.servers, addr)
+		}
+	}
+	if uc.ECSSubnet == "" {
+		return
+	}
+	subnet, err := parseECSSubnet(uc.ECSSubnet)
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("invalid ecs subnet for upstream: %s", uc.Name)
+		return
+	}
+	uc.ecs.subnet = subnet
+	uc.ecs.configured = true
+}
+
+// ECSQuery returns the query sent to the upstream according to its ECS policy. If the query
+// does not need to be changed, msg is returned, otherwise a modified copy of msg is returned.
+func (uc *UpstreamConfig) ECSQuery(msg *dns.Msg) *dns.Msg {
+	switch uc.ECS {
+	case ECSStrip:
+		if ecsFromMsg(msg) == nil {
+			return msg
+		}
+		m := msg.Copy()
+		removeECS(m)
+		return m
+	case ECSReplace:
+		subnet := uc.ecsSubnet()
+		m := msg.Copy()
+		removeECS(m)
+		if subnet == nil {
+			// Public IP is not detected yet, do not leak the client subnet meanwhile.
+			if ecsFromMsg(msg) == nil {
+				return msg
+			}
+			return m
+		}
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			opt = m.IsEdns0()
+		}
+		e := *subnet
+		opt.Option = append(opt.Option, &e)
+		return m
+	}
+	return msg
+}
+
+// RestoreECS makes the EDNS0 OPT record of answer match the query sent by the client, after
+// the query was sent to the upstream with a different EDNS Client Subnet.
+func RestoreECS(answer, msg *dns.Msg) {
+	if answer == nil {
+		return
+	}
+	clientOpt := msg.IsEdns0()
+	if clientOpt == nil {
+		// The client did not send OPT record, it must not be included in the answer.
+		removeOPT(answer)
+		return
+	}
+	e := ecsFromMsg(msg)
+	if ae := ecsFromMsg(answer); e != nil && ae != nil && ae.Family == e.Family && ae.SourceNetmask == e.SourceNetmask && ae.Address.Equal(e.Address) {
+		// The upstream received the client subnet as-is, keep its scope.
+		return
+	}
+	removeECS(answer)
+	if e == nil {
+		return
+	}
+	opt := answer.IsEdns0()
+	if opt == nil {
+		return
+	}
+	// Scope 0 means the answer is suitable for all addresses.
+	ce := *e
+	ce.SourceScope = 0
+	opt.Option = append(opt.Option, &ce)
+}
+
+// ecsSubnet returns the subnet used for replacing EDNS Client Subnet. If the subnet
+// is not configured, the public IP is detected in background.
+func (uc *UpstreamConfig) ecsSubnet() *dns.EDNS0_SUBNET {
+	s := uc.ecs
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.configured {
+		return s.subnet
+	}
+	interval := ecsDetectInterval
+	if s.subnet == nil {
+		interval = ecsDetectRetryInterval
+	}
+	if !s.detecting && time.Since(s.detectedAt) >= interval {
+		s.detecting = true
+		go uc.detectECSSubnet()
+	}
+	return s.subnet
+}
+
+// detectECSSubnet detects the public IP of the upstream connections, and updates the ECS subnet.
+func (uc *UpstreamConfig) detectECSSubnet() {
+	ctx, cancel := context.WithTimeout(context.Background(), ecsDetectTimeout)
+	defer cancel()
+	ip, err := uc.detectPublicIP(ctx)
+	s := uc.ecs
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detecting = false
+	s.detectedAt = time.Now()
+	if err != nil {
+		ProxyLogger.Load().Warn().Err(err).Msgf("could not detect public ip for ecs of upstream: %s", uc.Name)
+		return
+	}
+	ProxyLogger.Load().Debug().Msgf("detected public ip for ecs of upstream %s: %s", uc.Name, ip)
+	s.subnet = newECSSubnet(ip, 0)
+}
+
+// detectPublicIP returns the public IP address of the host, preferring IPv4. The whoami
+// servers are connected the same way as the upstream, so the detected IP address is
+// the one seen by the upstream.
+func (uc *UpstreamConfig) detectPublicIP(ctx context.Context) (net.IP, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(ecsWhoamiName, dns.TypeTXT)
+	msg.Question[0].Qclass = dns.ClassCHAOS
+	network := "udp"
+	var dialer contextDialer = uc.bindDialer(&net.Dialer{}, network)
+	if uc.proxy != nil {
+		// Proxies only support TCP connections.
+		network = "tcp"
+		dialer = uc.proxy
+	}
+	servers := uc.ecsDetectServers()
+	if len(servers) == 0 {
+		return nil, errors.New("no ecs detect server usable with ip stack: " + uc.IPStack)
+	}
+	var errs []error
+	for _, server := range servers {
+		answer, err := exchangeWithDialer(ctx, dialer, network, msg, server)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range answer.Answer {
+			if txt, ok := rr.(*dns.TXT); ok && len(txt.Txt) > 0 {
+				if ip := net.ParseIP(txt.Txt[0]); ip != nil {
+					return ip, nil
+				}
+			}
+		}
+		errs = append(errs, errors.New("no public ip in answer from "+server))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ecsDetectServers returns the servers used for detecting the public IP, which are usable
+// with the upstream IP stack.
+func (uc *UpstreamConfig) ecsDetectServers() []string {
+	var servers []string
+	for _, server := range uc.ecs.servers {
+		host, _, _ := net.SplitHostPort(server)
+		isV4 := net.ParseIP(host).To4() != nil
+		if uc.IPStack == IpStackV4 && !isV4 || uc.IPStack == IpStackV6 && isV4 {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// parseECSDetectServer parses s, an IP address with optional port, to the address of
+// an ECS detect server. The default port is 53.
+func parseECSDetectServer(s string) (string, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(s, "53"), nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) == nil {
+		return "", errors.New("invalid ip address: " + host)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", errors.New("invalid port: " + port)
+	}
+	return s, nil
+}
+
+// exchangeWithDialer sends msg to server using a connection of given network dialed by d.
+func exchangeWithDialer(ctx context.Context, d contextDialer, network string, msg *dns.Msg, server string) (*dns.Msg, error) {
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	co := &dns.Conn{Conn: conn}
+	if err := co.WriteMsg(msg); err != nil {
+		return nil, err
+	}
+	return co.ReadMsg()
+}
+
+// parseECSSubnet parses s, an IP address or a CIDR, to an EDNS Client Subnet option.
+func parseECSSubnet(s string) (*dns.EDNS0_SUBNET, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid ip address: " + s)
+		}
+		return newECSSubnet(ip, 0), nil
+	}
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := ipNet.Mask.Size()
+	return newECSSubnet(ip, ones), nil
+}
+
+// newECSSubnet returns the EDNS Client Subnet option for ip, truncated to given prefix length,
+// at most /24 for IPv4 and /56 for IPv6. A zero prefix length means the maximum one.
+func newECSSubnet(ip net.IP, prefix int) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	maxPrefix, bits := ecsSourceV6, 128
+	e.Family = 2
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		maxPrefix, bits = ecsSourceV4, 32
+		e.Family = 1
+	}
+	if prefix <= 0 || prefix > maxPrefix {
+		prefix = maxPrefix
+	}
+	e.SourceNetmask = uint8(prefix)
+	e.Address = ip.Mask(net.CIDRMask(prefix, bits))
+	return e
+}
+
+// ecsFromMsg returns the EDNS Client Subnet option of msg, if any.
+func ecsFromMsg(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// removeECS removes the EDNS Client Subnet option from msg.
+func removeECS(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	n := 0
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			opt.Option[n] = o
+			n++
+		}
+	}
+	opt.Option = opt.Option[:n]
+}
@@ -0,0 +1,246 @@
+package ctrld
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_parseECSSubnet(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnet  string
+		want    string
+		netmask uint8
+		wantErr bool
+	}{
+		{"ipv4", "203.0.113.57", "203.0.113.0", 24, false},
+		{"ipv4 cidr", "203.0.113.57/16", "203.0.0.0", 16, false},
+		{"ipv4 narrow cidr", "203.0.113.57/30", "203.0.113.0", 24, false},
+		{"ipv6", "2001:db8:1234:5678::1", "2001:db8:1234:5600::", 56, false},
+		{"ipv6 cidr", "2001:db8:1234:5678::/48", "2001:db8:1234::", 48, false},
+		{"invalid ip", "203.0.113", "", 0, true},
+		{"invalid cidr", "203.0.113.0/33", "", 0, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			e, err := parseECSSubnet(tc.subnet)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Address.String() != tc.want || e.SourceNetmask != tc.netmask {
+				t.Errorf("unexpected subnet, want: %s/%d, got: %s/%d", tc.want, tc.netmask, e.Address, e.SourceNetmask)
+			}
+		})
+	}
+}
+
+func Test_parseECSDetectServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  string
+		want    string
+		wantErr bool
+	}{
+		{"ipv4", "192.0.2.53", "192.0.2.53:53", false},
+		{"ipv4 with port", "192.0.2.53:5353", "192.0.2.53:5353", false},
+		{"ipv6", "2001:db8::53", "[2001:db8::53]:53", false},
+		{"ipv6 with port", "[2001:db8::53]:5353", "[2001:db8::53]:5353", false},
+		{"hostname", "dns.example.com", "", true},
+		{"hostname with port", "dns.example.com:53", "", true},
+		{"invalid port", "192.0.2.53:dns", "", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseECSDetectServer(tc.server)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("unexpected server, want: %s, got: %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestUpstreamConfig_ecsDetectServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipStack string
+		servers []string
+		want    []string
+	}{
+		{"default", IpStackBoth, nil, defaultECSDetectServers},
+		{"default v4", IpStackV4, nil, []string{"1.1.1.1:53"}},
+		{"default v6", IpStackV6, nil, []string{"[2606:4700:4700::1111]:53"}},
+		{"configured", IpStackSplit, []string{"192.0.2.53", "[2001:db8::53]:5353"}, []string{"192.0.2.53:53", "[2001:db8::53]:5353"}},
+		{"configured v6 without ipv6 server", IpStackV6, []string{"192.0.2.53"}, nil},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			uc := &UpstreamConfig{
+				Name:             "test",
+				Type:             ResolverTypeLegacy,
+				Endpoint:         "192.0.2.1:53",
+				IPStack:          tc.ipStack,
+				ECS:              ECSReplace,
+				ECSDetectServers: tc.servers,
+			}
+			uc.Init()
+			if got := uc.ecsDetectServers(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected servers, want: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestUpstreamConfig_ECSQuery(t *testing.T) {
+	clientSubnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.0.2.10").To4()}
+	tests := []struct {
+		name      string
+		ecs       string
+		ecsSubnet string
+		clientECS bool
+		want      string
+		same      bool
+	}{
+		{"pass", ECSPass, "", true, "192.0.2.10/32", true},
+		{"default", "", "", true, "192.0.2.10/32", true},
+		{"strip", ECSStrip, "", true, "", false},
+		{"strip without ecs", ECSStrip, "", false, "", true},
+		{"replace", ECSReplace, "203.0.113.57", true, "203.0.113.0/24", false},
+		{"replace without ecs", ECSReplace, "2001:db8:1234:5678::1", false, "2001:db8:1234:5600::/56", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			uc := &UpstreamConfig{Name: "test", Type: ResolverTypeLegacy, Endpoint: "192.0.2.1:53", ECS: tc.ecs, ECSSubnet: tc.ecsSubnet}
+			uc.Init()
+			msg := testQuery("example.com.")
+			if tc.clientECS {
+				msg.SetEdns0(dns.DefaultMsgSize, false)
+				opt := msg.IsEdns0()
+				opt.Option = append(opt.Option, clientSubnet)
+			}
+			got := uc.ECSQuery(msg)
+			if (got == msg) != tc.same {
+				t.Errorf("unexpected query copy, want same: %v", tc.same)
+			}
+			gotECS := ""
+			if e := ecsFromMsg(got); e != nil {
+				gotECS = (&net.IPNet{IP: e.Address, Mask: net.CIDRMask(int(e.SourceNetmask), len(e.Address)*8)}).String()
+			}
+			if gotECS != tc.want {
+				t.Errorf("unexpected ecs, want: %q, got: %q", tc.want, gotECS)
+			}
+			if e := ecsFromMsg(msg); tc.clientECS && e != clientSubnet {
+				t.Error("client query must not be modified")
+			}
+		})
+	}
+}
+
+func TestRestoreECS(t *testing.T) {
+	upstreamSubnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("203.0.113.0").To4()}
+	newAnswer := func() *dns.Msg {
+		answer := new(dns.Msg)
+		answer.SetReply(testQuery("example.com."))
+		answer.SetEdns0(dns.DefaultMsgSize, false)
+		opt := answer.IsEdns0()
+		opt.Option = append(opt.Option, upstreamSubnet)
+		return answer
+	}
+
+	// Client did not send OPT record.
+	answer := newAnswer()
+	RestoreECS(answer, testQuery("example.com."))
+	if answer.IsEdns0() != nil {
+		t.Errorf("unexpected OPT record: %v", answer.Extra)
+	}
+
+	// Client sent OPT record without ECS.
+	msg := testQuery("example.com.")
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	answer = newAnswer()
+	RestoreECS(answer, msg)
+	if e := ecsFromMsg(answer); e != nil {
+		t.Errorf("unexpected ecs: %v", e)
+	}
+
+	// Client sent its own ECS.
+	clientSubnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.0.2.10").To4()}
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, clientSubnet)
+	answer = newAnswer()
+	RestoreECS(answer, msg)
+	if e := ecsFromMsg(answer); e == nil || !e.Address.Equal(clientSubnet.Address) || e.SourceNetmask != 32 || e.SourceScope != 0 {
+		t.Errorf("unexpected ecs: %v", e)
+	}
+}
+
+func TestUpstreamConfig_detectPublicIP_proxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		Listener: ln,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			answer := new(dns.Msg)
+			answer.SetReply(m)
+			answer.Answer = append(answer.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+				Txt: []string{"203.0.113.7"},
+			})
+			_ = w.WriteMsg(answer)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	proxy := newTestProxy(t, "socks5", ln.Addr().String())
+
+	uc := &UpstreamConfig{
+		Name:             "test",
+		Type:             ResolverTypeDOH,
+		Endpoint:         "https://dns.example.com/dns-query",
+		Proxy:            "socks5://user:pass@" + proxy.Addr().String(),
+		ECS:              ECSReplace,
+		ECSDetectServers: []string{"192.0.2.53"},
+	}
+	uc.Init()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ip, err := uc.detectPublicIP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "203.0.113.7" {
+		t.Errorf("unexpected public ip: %s", ip)
+	}
+	if got := proxy.requests(); len(got) != 1 || got[0] != "192.0.2.53:53" {
+		t.Errorf("whoami query is not sent through the proxy: %v", got)
+	}
+}
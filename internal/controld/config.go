@@ -107,7 +107,7 @@ func postUtilityAPI(version string, cdDev bool, body io.Reader) (*ResolverConfig
 		ips := ctrld.LookupIP(apiDomain)
 		if len(ips) == 0 {
 			ctrld.ProxyLogger.Load().Warn().Msgf("No IPs found for %s, connecting to %s", apiDomain, addr)
-			return ctrldnet.Dialer.DialContext(ctx, network, addr)
+			return ctrld.BootstrapDialer().DialContext(ctx, network, addr)
 		}
 		ctrld.ProxyLogger.Load().Debug().Msgf("API IPs: %v", ips)
 		_, port, _ := net.SplitHostPort(addr)
@@ -1,7 +1,10 @@
 package dnscache
 
 import (
+	"net"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -12,6 +15,29 @@ import (
 type Cacher interface {
 	Get(Key) *Value
 	Add(Key, *Value)
+	// Len returns the number of cached entries.
+	Len() int
+	// Bytes returns the estimated memory used by cached entries.
+	Bytes() int64
+	// Range calls f for each cached entry, from the least to the most recently used, without
+	// updating their recency, until f returns false.
+	Range(f func(Key, *Value) bool)
+	// Remove removes cached entries which keys match, returning the number of removed entries.
+	Remove(match func(Key) bool) int
+	// Purge removes all cached entries.
+	Purge()
+}
+
+// entryOverhead is the estimated memory used by a cache entry, besides its packed DNS message.
+const entryOverhead = 256
+
+// EntrySize returns the estimated memory used by the cache entry of given key and value.
+func EntrySize(key Key, value *Value) int64 {
+	size := entryOverhead + len(key.Name) + len(key.Upstream) + len(key.ECS) + len(value.DNSSEC) + len(value.Upstream)
+	if value.Msg != nil {
+		size += value.Msg.Len()
+	}
+	return int64(size)
 }
 
 // Key is the caching key for DNS message.
@@ -20,11 +46,34 @@ type Key struct {
 	Qclass   uint16
 	Name     string
 	Upstream string
+	// ECS is the EDNS Client Subnet of the message, in CIDR form, if any.
+	ECS string
 }
 
 type Value struct {
 	Expire time.Time
 	Msg    *dns.Msg
+	// DNSSEC is the DNSSEC validation result of Msg, empty if it was not validated.
+	DNSSEC string
+	// Stored is the time when the value was added to the cache.
+	Stored time.Time
+	// Upstream is the upstream which answered Msg. With cache scopes shared by upstreams,
+	// it may differ from the key upstream.
+	Upstream string
+
+	hits atomic.Uint64
+	// size is the estimated memory used by the entry, tracked by SizedLRUCache.
+	size int64
+}
+
+// Hit records a cache hit of the value, returning the number of hits so far.
+func (v *Value) Hit() uint64 {
+	return v.hits.Add(1)
+}
+
+// Hits returns the number of cache hits of the value.
+func (v *Value) Hits() uint64 {
+	return v.hits.Load()
 }
 
 var _ Cacher = (*LRUCache)(nil)
@@ -43,6 +92,46 @@ func (l *LRUCache) Add(key Key, value *Value) {
 	l.cacher.Add(key, value)
 }
 
+func (l *LRUCache) Len() int {
+	return l.cacher.Len()
+}
+
+func (l *LRUCache) Bytes() int64 {
+	var n int64
+	l.Range(func(k Key, v *Value) bool {
+		n += EntrySize(k, v)
+		return true
+	})
+	return n
+}
+
+func (l *LRUCache) Range(f func(Key, *Value) bool) {
+	for _, k := range l.cacher.Keys() {
+		v, ok := l.cacher.Peek(k)
+		if !ok {
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (l *LRUCache) Remove(match func(Key) bool) int {
+	n := 0
+	for _, k := range l.cacher.Keys() {
+		if match(k) {
+			l.cacher.Remove(k)
+			n++
+		}
+	}
+	return n
+}
+
+func (l *LRUCache) Purge() {
+	l.cacher.Purge()
+}
+
 // NewLRUCache creates a new LRUCache instance with given size.
 func NewLRUCache(size int) (*LRUCache, error) {
 	cacher, err := lru.NewARC[Key, *Value](size)
@@ -52,7 +141,89 @@ func NewLRUCache(size int) (*LRUCache, error) {
 // NewKey creates a new cache key for given DNS message.
 func NewKey(msg *dns.Msg, upstream string) Key {
 	q := msg.Question[0]
-	return Key{Qtype: q.Qtype, Qclass: q.Qclass, Name: normalizeQname(q.Name), Upstream: upstream}
+	return Key{Qtype: q.Qtype, Qclass: q.Qclass, Name: normalizeQname(q.Name), Upstream: upstream, ECS: ecsScope(msg)}
+}
+
+// ecsScope returns the EDNS Client Subnet of msg in CIDR form, or empty string if there's none.
+func ecsScope(msg *dns.Msg) string {
+	e := ecsOption(msg)
+	if e == nil {
+		return ""
+	}
+	bits := 128
+	if e.Family == 1 {
+		bits = 32
+	}
+	return ecsCIDR(e.Address, int(e.SourceNetmask), bits)
+}
+
+// ecsOption returns the EDNS Client Subnet option of msg, if any.
+func ecsOption(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// ecsCIDR returns ip truncated to given prefix length in CIDR form.
+func ecsCIDR(ip net.IP, prefix, bits int) string {
+	ip = ip.Mask(net.CIDRMask(prefix, bits))
+	return ip.String() + "/" + strconv.Itoa(prefix)
+}
+
+// AnswerKey returns the key for caching answer of the query with given key. As described
+// in RFC 7871, section 7.3.1, the EDNS Client Subnet of the key is truncated to the scope
+// prefix length of the answer, so the answer is served to all clients within the scope.
+// Answers without EDNS Client Subnet, or with scope 0, are suitable for all clients.
+func AnswerKey(key Key, answer *dns.Msg) Key {
+	if key.ECS == "" {
+		return key
+	}
+	_, ipNet, err := net.ParseCIDR(key.ECS)
+	if err != nil {
+		return key
+	}
+	source, bits := ipNet.Mask.Size()
+	scope := 0
+	if e := ecsOption(answer); e != nil {
+		scope = int(e.SourceScope)
+	}
+	if scope > source {
+		scope = source
+	}
+	key.ECS = ""
+	if scope > 0 {
+		key.ECS = ecsCIDR(ipNet.IP, scope, bits)
+	}
+	return key
+}
+
+// LookupKeys returns the keys which answers of the query with given key could be cached with,
+// see AnswerKey, from the most specific to the least specific scope.
+func LookupKeys(key Key) []Key {
+	if key.ECS == "" {
+		return []Key{key}
+	}
+	_, ipNet, err := net.ParseCIDR(key.ECS)
+	if err != nil {
+		return []Key{key}
+	}
+	source, bits := ipNet.Mask.Size()
+	keys := make([]Key, 0, source+1)
+	for scope := source; scope > 0; scope-- {
+		k := key
+		k.ECS = ecsCIDR(ipNet.IP, scope, bits)
+		keys = append(keys, k)
+	}
+	k := key
+	k.ECS = ""
+	return append(keys, k)
 }
 
 // NewValue creates a new cache value for given DNS message.
@@ -60,6 +231,7 @@ func NewValue(msg *dns.Msg, expire time.Time) *Value {
 	return &Value{
 		Expire: expire,
 		Msg:    msg,
+		Stored: time.Now(),
 	}
 }
 
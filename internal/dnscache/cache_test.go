@@ -0,0 +1,67 @@
+package dnscache
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testECSMsg(subnet string, source, scope uint8) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: source,
+		SourceScope:   scope,
+		Address:       net.ParseIP(subnet).To4(),
+	})
+	return msg
+}
+
+func TestAnswerKey(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	tests := []struct {
+		name   string
+		query  *dns.Msg
+		answer *dns.Msg
+		want   string
+	}{
+		{"no ecs", msg, msg, ""},
+		{"answer scope", testECSMsg("192.0.2.0", 24, 0), testECSMsg("192.0.2.0", 24, 16), "192.0.0.0/16"},
+		{"scope larger than source", testECSMsg("192.0.2.0", 24, 0), testECSMsg("192.0.2.0", 24, 32), "192.0.2.0/24"},
+		{"scope 0", testECSMsg("192.0.2.0", 24, 0), testECSMsg("192.0.2.0", 24, 0), ""},
+		{"answer without ecs", testECSMsg("192.0.2.0", 24, 0), msg, ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := AnswerKey(NewKey(tc.query, "upstream.0"), tc.answer); got.ECS != tc.want {
+				t.Errorf("unexpected ECS, want: %q, got: %q", tc.want, got.ECS)
+			}
+		})
+	}
+}
+
+func TestLookupKeys(t *testing.T) {
+	key := NewKey(testECSMsg("192.0.2.0", 24, 0), "upstream.0")
+	keys := LookupKeys(key)
+	if len(keys) != 25 {
+		t.Fatalf("unexpected number of keys: %d", len(keys))
+	}
+	if keys[0] != key {
+		t.Errorf("the query key must be looked up first, got: %+v", keys[0])
+	}
+	if keys[8].ECS != "192.0.0.0/16" {
+		t.Errorf("unexpected key of /16 scope: %q", keys[8].ECS)
+	}
+	if keys[24].ECS != "" {
+		t.Errorf("the key without ECS must be looked up last, got: %q", keys[24].ECS)
+	}
+
+}
@@ -0,0 +1,120 @@
+package dnscache
+
+import (
+	"errors"
+	"math"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+var _ Cacher = (*SizedLRUCache)(nil)
+
+// SizedLRUCache implements Cacher interface, evicting least recently used entries
+// to keep the memory used by cached entries under a byte budget.
+type SizedLRUCache struct {
+	mu       sync.Mutex
+	lru      *simplelru.LRU[Key, *Value]
+	maxBytes int64
+	bytes    int64
+}
+
+// NewSizedLRUCache creates a new SizedLRUCache instance, holding at most size entries
+// using at most maxBytes bytes. A zero size means the number of entries is not limited.
+func NewSizedLRUCache(size int, maxBytes int64) (*SizedLRUCache, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("must provide a positive max bytes")
+	}
+	if size == 0 {
+		size = math.MaxInt32
+	}
+	c := &SizedLRUCache{maxBytes: maxBytes}
+	l, err := simplelru.NewLRU[Key, *Value](size, c.onEvict)
+	if err != nil {
+		return nil, err
+	}
+	c.lru = l
+	return c, nil
+}
+
+// onEvict is called by c.lru when an entry is removed, c.mu is held by the caller.
+func (c *SizedLRUCache) onEvict(_ Key, value *Value) {
+	c.bytes -= value.size
+}
+
+func (c *SizedLRUCache) Get(key Key) *Value {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, _ := c.lru.Get(key)
+	return v
+}
+
+func (c *SizedLRUCache) Add(key Key, value *Value) {
+	value.size = EntrySize(key, value)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, exists := c.lru.Peek(key)
+	if value.size > c.maxBytes {
+		// The entry could never fit, remove the stale one instead.
+		c.lru.Remove(key)
+		return
+	}
+	// Replacing an entry does not call onEvict.
+	if exists {
+		c.bytes -= old.size
+	}
+	c.lru.Add(key, value)
+	c.bytes += value.size
+	for c.bytes > c.maxBytes {
+		if _, _, ok := c.lru.RemoveOldest(); !ok {
+			break
+		}
+	}
+}
+
+func (c *SizedLRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *SizedLRUCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+func (c *SizedLRUCache) Range(f func(Key, *Value) bool) {
+	c.mu.Lock()
+	keys := c.lru.Keys()
+	c.mu.Unlock()
+	for _, k := range keys {
+		c.mu.Lock()
+		v, ok := c.lru.Peek(k)
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (c *SizedLRUCache) Remove(match func(Key) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, k := range c.lru.Keys() {
+		if match(k) && c.lru.Remove(k) {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *SizedLRUCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Purge()
+}
@@ -0,0 +1,60 @@
+package dnscache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSizedLRUCache(t *testing.T) {
+	names := []string{"a.example.com.", "b.example.com.", "c.example.com."}
+	entrySize := EntrySize(NewKey(newTestAnswer(names[0]), "upstream.0"), NewValue(newTestAnswer(names[0]), time.Time{}))
+
+	// Room for two entries only.
+	c, err := NewSizedLRUCache(0, 2*entrySize+entrySize/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		answer := newTestAnswer(name)
+		c.Add(NewKey(answer, "upstream.0"), NewValue(answer, time.Now().Add(time.Minute)))
+	}
+	if n := c.Len(); n != 2 {
+		t.Fatalf("unexpected number of entries, want: 2, got: %d", n)
+	}
+	if c.Get(NewKey(newTestAnswer(names[0]), "upstream.0")) != nil {
+		t.Error("least recently used entry was not evicted")
+	}
+	if got, want := c.Bytes(), 2*entrySize; got != want {
+		t.Errorf("unexpected bytes, want: %d, got: %d", want, got)
+	}
+
+	// Replacing an entry keeps the byte count.
+	answer := newTestAnswer(names[2])
+	c.Add(NewKey(answer, "upstream.0"), NewValue(answer, time.Now().Add(time.Minute)))
+	if got, want := c.Bytes(), 2*entrySize; got != want {
+		t.Errorf("unexpected bytes after replacing, want: %d, got: %d", want, got)
+	}
+
+	c.Remove(func(k Key) bool { return k.Name == names[1] })
+	if got, want := c.Bytes(), entrySize; got != want {
+		t.Errorf("unexpected bytes after removing, want: %d, got: %d", want, got)
+	}
+	c.Purge()
+	if c.Len() != 0 || c.Bytes() != 0 {
+		t.Errorf("unexpected cache after purging, len: %d, bytes: %d", c.Len(), c.Bytes())
+	}
+}
+
+func TestSizedLRUCache_countLimit(t *testing.T) {
+	c, err := NewSizedLRUCache(1, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		answer := newTestAnswer(name)
+		c.Add(NewKey(answer, "upstream.0"), NewValue(answer, time.Now().Add(time.Minute)))
+	}
+	if c.Len() != 1 || c.Bytes() != EntrySize(NewKey(newTestAnswer("b.example.com."), "upstream.0"), NewValue(newTestAnswer("b.example.com."), time.Time{})) {
+		t.Errorf("unexpected cache, len: %d, bytes: %d", c.Len(), c.Bytes())
+	}
+}
@@ -0,0 +1,125 @@
+package dnscache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// snapshotVersion is the current version of cache snapshot file format.
+const snapshotVersion = 1
+
+type snapshotFile struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	// Upstreams maps upstream names to the identity of their config at the time of saving.
+	Upstreams map[string]string `json:"upstreams"`
+	Entries   []snapshotEntry   `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Qtype    uint16 `json:"qtype"`
+	Qclass   uint16 `json:"qclass"`
+	Name     string `json:"name"`
+	Upstream string `json:"upstream"`
+	ECS      string `json:"ecs,omitempty"`
+	// TTL is the remaining TTL of the entry in seconds, relative to SavedAt.
+	TTL    int64  `json:"ttl"`
+	Msg    []byte `json:"msg"`
+	DNSSEC string `json:"dnssec,omitempty"`
+	// Source is the upstream which answered Msg, see Value.Upstream.
+	Source string `json:"source,omitempty"`
+}
+
+// SaveSnapshot writes fresh entries of the cache to given file. The upstreams map contains
+// the identity of each upstream config, see LoadSnapshot.
+func SaveSnapshot(c Cacher, path string, upstreams map[string]string) error {
+	now := time.Now()
+	f := &snapshotFile{Version: snapshotVersion, SavedAt: now, Upstreams: upstreams}
+	// Keys are ordered from the oldest to the newest, so loading them back keeps the recency.
+	c.Range(func(k Key, v *Value) bool {
+		if v == nil || v.Msg == nil {
+			return true
+		}
+		ttl := int64(v.Expire.Sub(now) / time.Second)
+		if ttl <= 0 {
+			return true
+		}
+		msg, err := v.Msg.Pack()
+		if err != nil {
+			return true
+		}
+		f.Entries = append(f.Entries, snapshotEntry{
+			Qtype:    k.Qtype,
+			Qclass:   k.Qclass,
+			Name:     k.Name,
+			Upstream: k.Upstream,
+			ECS:      k.ECS,
+			TTL:      ttl,
+			Msg:      msg,
+			DNSSEC:   v.DNSSEC,
+			Source:   v.Upstream,
+		})
+		return true
+	})
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	// Writing to a temporary file then renaming, so the snapshot file is never partially written.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadSnapshot adds entries from given snapshot file to the cache, returning the number of
+// loaded entries. Expired entries are discarded, and so are entries of upstreams which
+// identity in upstreams differs from the one at the time of saving, since their answers
+// may not be valid for the current config.
+func LoadSnapshot(c Cacher, path string, upstreams map[string]string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var f snapshotFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return 0, err
+	}
+	if f.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported cache snapshot version: %d", f.Version)
+	}
+	if f.SavedAt.IsZero() {
+		return 0, errors.New("invalid cache snapshot: missing saved time")
+	}
+	now := time.Now()
+	n := 0
+	for _, e := range f.Entries {
+		id, ok := upstreams[e.Upstream]
+		if !ok || id != f.Upstreams[e.Upstream] {
+			continue
+		}
+		expire := f.SavedAt.Add(time.Duration(e.TTL) * time.Second)
+		if !expire.After(now) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Msg); err != nil {
+			continue
+		}
+		// Unpacking does not set compression, see the same handling of upstream answers.
+		msg.Compress = true
+		key := Key{Qtype: e.Qtype, Qclass: e.Qclass, Name: e.Name, Upstream: e.Upstream, ECS: e.ECS}
+		value := NewValue(msg, expire)
+		value.DNSSEC = e.DNSSEC
+		value.Upstream = e.Source
+		c.Add(key, value)
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,89 @@
+package dnscache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLRUCache_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	upstreams := map[string]string{"upstream.0": "doh https://example.com/dns-query", "upstream.1": "legacy 1.1.1.1"}
+
+	c, err := NewLRUCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := newTestAnswer("fresh.example.com.")
+	c.Add(NewKey(fresh, "upstream.0"), &Value{Expire: time.Now().Add(time.Hour), Msg: fresh, DNSSEC: "secure", Upstream: "upstream.1"})
+	expired := newTestAnswer("expired.example.com.")
+	c.Add(NewKey(expired, "upstream.0"), NewValue(expired, time.Now().Add(-time.Second)))
+	changed := newTestAnswer("changed.example.com.")
+	c.Add(NewKey(changed, "upstream.1"), NewValue(changed, time.Now().Add(time.Hour)))
+	if err := SaveSnapshot(c, path, upstreams); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewLRUCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := LoadSnapshot(loaded, path, map[string]string{"upstream.0": upstreams["upstream.0"], "upstream.1": "legacy 8.8.8.8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of loaded entries, want: 1, got: %d", n)
+	}
+	v := loaded.Get(NewKey(fresh, "upstream.0"))
+	if v == nil {
+		t.Fatal("fresh entry was not loaded")
+	}
+	if v.DNSSEC != "secure" || v.Upstream != "upstream.1" || v.Msg.Answer[0].String() != fresh.Answer[0].String() {
+		t.Errorf("unexpected loaded entry: %v", v)
+	}
+	if ttl := time.Until(v.Expire); ttl <= 58*time.Minute || ttl > time.Hour {
+		t.Errorf("unexpected remaining ttl: %v", ttl)
+	}
+}
+
+func TestLRUCache_LoadSnapshotInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown version", `{"version":1000,"saved_at":"2023-01-01T00:00:00Z","entries":[]}`},
+		{"corrupted", `{"version":1,`},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(dir, tc.name)
+			if err := os.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := NewLRUCache(16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadSnapshot(c, path, nil); err == nil {
+				t.Error("expected error for invalid snapshot")
+			}
+		})
+	}
+}
+
+func newTestAnswer(name string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	rr, _ := dns.NewRR(name + " 300 IN A 192.0.2.1")
+	answer.Answer = append(answer.Answer, rr)
+	return answer
+}
@@ -14,19 +14,33 @@ import (
 	"tailscale.com/logtail/backoff"
 )
 
-const (
-	controldIPv6Test = "ipv6.controld.io"
-	v4BootstrapDNS   = "76.76.2.0:53"
-	v6BootstrapDNS   = "[2606:1a40::]:53"
-)
+const controldIPv6Test = "ipv6.controld.io"
+
+// bootstrapDNS is the bootstrap DNS configuration, set by SetBootstrapDNS.
+type bootstrapDNS struct {
+	dial  func(ctx context.Context, network, address string) (net.Conn, error)
+	addrs []string
+}
+
+var bootstrap atomic.Pointer[bootstrapDNS]
+
+// SetBootstrapDNS sets the bootstrap DNS servers used by Dialer. The dial function returns
+// the connection used by Dialer for resolving domain names, addrs are the addresses of
+// bootstrap servers, in "ip:port" form, used for checking whether the network is up.
+func SetBootstrapDNS(dial func(ctx context.Context, network, address string) (net.Conn, error), addrs []string) {
+	bootstrap.Store(&bootstrapDNS{dial: dial, addrs: addrs})
+}
 
+// Dialer is a dialer which resolves domain names using the bootstrap DNS servers.
 var Dialer = &net.Dialer{
 	Resolver: &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := ParallelDialer{}
-			d.Timeout = 10 * time.Second
-			return d.DialContext(ctx, "udp", []string{v4BootstrapDNS, v6BootstrapDNS})
+			if bs := bootstrap.Load(); bs != nil {
+				return bs.dial(ctx, network, address)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
 		},
 	},
 }
@@ -73,12 +87,12 @@ func probeStack() {
 	}()
 
 	b := backoff.NewBackoff("probeStack", func(format string, args ...any) {}, 5*time.Second)
+	var addrs []string
+	if bs := bootstrap.Load(); bs != nil {
+		addrs = bs.addrs
+	}
 	for {
-		if _, err := probeStackDialer.DialContext(ctx, "udp", v4BootstrapDNS); err == nil {
-			hasNetworkUp = true
-			break
-		}
-		if _, err := probeStackDialer.DialContext(ctx, "udp", v6BootstrapDNS); err == nil {
+		if networkUp(ctx, addrs) {
 			hasNetworkUp = true
 			break
 		}
@@ -92,6 +106,21 @@ func probeStack() {
 	canListenIPv6Local = supportListenIPv6Local()
 }
 
+// networkUp reports whether any of bootstrap servers addrs is reachable.
+// Without bootstrap servers, the network is assumed to be up.
+func networkUp(ctx context.Context, addrs []string) bool {
+	if len(addrs) == 0 {
+		return true
+	}
+	for _, addr := range addrs {
+		if conn, err := probeStackDialer.DialContext(ctx, "udp", addr); err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
 func Up() bool {
 	stackOnce.Load().Do(probeStack)
 	return hasNetworkUp
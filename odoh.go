@@ -0,0 +1,421 @@
+package ctrld
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Oblivious DoH constants, see RFC 9230.
+const (
+	headerApplicationODoH = "application/oblivious-dns-message"
+	odohConfigsPath       = "/.well-known/odohconfigs"
+	odohVersion           = 0x0001
+	odohMessageQuery      = 0x01
+	odohMessageResponse   = 0x02
+	// odohQueryPadBlockLen is the block size queries are padded to, as recommended by RFC 8467.
+	odohQueryPadBlockLen = 128
+)
+
+// odohConfigRefreshInterval is the interval after which the target configs are re-fetched.
+const odohConfigRefreshInterval = time.Hour
+
+// errODoHDecryption is returned when the target could not decrypt the query,
+// or the response could not be decrypted, the target may have rotated its keys.
+var errODoHDecryption = errors.New("odoh decryption failed")
+
+// initODoH initializes an ODoH upstream. Queries are sent to the proxy, so the upstream domain
+// and DoH transport are for the proxy, the target is only connected for fetching its config.
+func (uc *UpstreamConfig) initODoH() {
+	target, err := url.Parse(uc.Endpoint)
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("invalid odoh target for upstream: %s", uc.Name)
+		return
+	}
+	proxy, err := url.Parse(uc.ODoHProxy)
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("invalid odoh proxy for upstream: %s", uc.Name)
+		return
+	}
+	query := proxy.Query()
+	query.Set("targethost", target.Host)
+	query.Set("targetpath", target.Path)
+	proxy.RawQuery = query.Encode()
+	uc.u = proxy
+	uc.Domain = proxy.Hostname()
+	if net.ParseIP(uc.Domain) != nil {
+		uc.BootstrapIP = uc.Domain
+	}
+	uc.odoh = newODoHClient(uc, target)
+}
+
+type odohResolver struct {
+	uc *UpstreamConfig
+}
+
+// Resolve sends the encrypted query to the ODoH proxy, which forwards it to the target.
+// If the query or response could not be decrypted, the target config is re-fetched and
+// the query is retried.
+func (r *odohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	c := r.uc.odoh
+	if c == nil {
+		return nil, fmt.Errorf("invalid odoh upstream: %s", r.uc.Name)
+	}
+	data, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	dnsTyp := uint16(0)
+	if len(msg.Question) > 0 {
+		dnsTyp = msg.Question[0].Qtype
+	}
+	cfg, err := c.config(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := c.exchange(ctx, data, dnsTyp, cfg)
+	if errors.Is(err, errODoHDecryption) {
+		ProxyLogger.Load().Debug().Err(err).Msgf("re-fetching odoh config of target: %s", c.target.Host)
+		if cfg, err = c.config(ctx, cfg); err != nil {
+			return nil, err
+		}
+		answer, err = c.exchange(ctx, data, dnsTyp, cfg)
+	}
+	return answer, err
+}
+
+// odohClient sends queries to an ODoH target through the upstream proxy, keeping track
+// of the target config.
+type odohClient struct {
+	uc     *UpstreamConfig
+	target *url.URL
+
+	transportOnce sync.Once
+	transport     *http.Transport
+
+	mu        sync.Mutex
+	cfg       *odohConfig
+	fetchedAt time.Time
+}
+
+func newODoHClient(uc *UpstreamConfig, target *url.URL) *odohClient {
+	return &odohClient{uc: uc, target: target}
+}
+
+func (c *odohClient) exchange(ctx context.Context, data []byte, dnsTyp uint16, cfg *odohConfig) (*dns.Msg, error) {
+	query, qc, err := cfg.encryptQuery(data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.uc.u.String(), bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	for name, values := range c.uc.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", headerApplicationODoH)
+	req.Header.Set("Accept", headerApplicationODoH)
+	hc := http.Client{Transport: c.uc.dohTransport(dnsTyp)}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read message from response: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		// RFC 9230, section 4.3: the target could not decrypt the query.
+		return nil, fmt.Errorf("%w: query rejected by target", errODoHDecryption)
+	default:
+		return nil, fmt.Errorf("wrong response from ODoH proxy, got: %s, status: %d", string(buf), resp.StatusCode)
+	}
+	plaintext, err := qc.decryptResponse(buf)
+	if err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	if err := answer.Unpack(plaintext); err != nil {
+		return nil, fmt.Errorf("answer.Unpack: %w", err)
+	}
+	return answer, nil
+}
+
+// config returns the target config, fetching it if there's none yet, the current one is
+// old enough to be refreshed, or is the stale one which could not be used.
+func (c *odohClient) config(ctx context.Context, stale *odohConfig) (*odohConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	usable := c.cfg != nil && c.cfg != stale
+	if usable && now.Sub(c.fetchedAt) < odohConfigRefreshInterval {
+		return c.cfg, nil
+	}
+	cfg, err := c.fetchConfig(ctx)
+	if err != nil {
+		if usable {
+			ProxyLogger.Load().Warn().Err(err).Msgf("could not refresh odoh config of target: %s", c.target.Host)
+			return c.cfg, nil
+		}
+		return nil, err
+	}
+	c.cfg, c.fetchedAt = cfg, now
+	return cfg, nil
+}
+
+// fetchConfig fetches the target configs, returning the first supported one.
+func (c *odohClient) fetchConfig(ctx context.Context) (*odohConfig, error) {
+	u := url.URL{Scheme: c.target.Scheme, Host: c.target.Host, Path: odohConfigsPath}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	hc := http.Client{Transport: c.configTransport()}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch odoh config: %w", err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read odoh config: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch odoh config, status: %d", resp.StatusCode)
+	}
+	configs, err := parseODoHConfigs(buf)
+	if err != nil {
+		return nil, err
+	}
+	return configs[0], nil
+}
+
+// configTransport returns the transport for fetching the target configs. The target is
+// connected directly, its domain is resolved using the upstream bootstrap servers, and its
+// certificate is verified using the upstream TLS settings.
+func (c *odohClient) configTransport() *http.Transport {
+	c.transportOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.uc.newTLSConfig()
+		transport.DialContext = c.uc.bindDialer(newDialer(c.uc.bootstrapServers()), "tcp").DialContext
+		if c.uc.proxy != nil {
+			transport.DialContext = c.uc.proxy.DialContext
+		}
+		c.transport = transport
+	})
+	return c.transport
+}
+
+// newODoHProxyTLSConfig returns the TLS config for connections to the ODoH proxy. The CA file,
+// SPKI pins and stamp hashes are for the target, so the proxy is verified using the cert pool only.
+func (uc *UpstreamConfig) newODoHProxyTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{RootCAs: uc.certPool}
+	if uc.clientCert != nil {
+		tlsConfig.GetClientCertificate = uc.clientCert.getClientCertificate
+	}
+	return tlsConfig
+}
+
+// odohConfig is an ODoH target config, with the key id derived from it.
+type odohConfig struct {
+	suite     hpke.Suite
+	kdf       hpke.KDF
+	aead      hpke.AEAD
+	publicKey kem.PublicKey
+	keyID     []byte
+}
+
+// parseODoHConfigs parses the ObliviousDoHConfigs structure, returning the supported configs.
+func parseODoHConfigs(b []byte) ([]*odohConfig, error) {
+	var configs []*odohConfig
+	s := cryptobyte.String(b)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() {
+		return nil, errors.New("invalid odoh configs")
+	}
+	for !list.Empty() {
+		var version uint16
+		var contents cryptobyte.String
+		if !list.ReadUint16(&version) || !list.ReadUint16LengthPrefixed(&contents) {
+			return nil, errors.New("invalid odoh configs")
+		}
+		if version != odohVersion {
+			continue
+		}
+		cfg, err := parseODoHConfigContents(contents)
+		if err != nil {
+			ProxyLogger.Load().Debug().Err(err).Msg("ignoring odoh config")
+			continue
+		}
+		configs = append(configs, cfg)
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no supported odoh config")
+	}
+	return configs, nil
+}
+
+func parseODoHConfigContents(contents []byte) (*odohConfig, error) {
+	s := cryptobyte.String(contents)
+	var kemID, kdfID, aeadID uint16
+	var pk cryptobyte.String
+	if !s.ReadUint16(&kemID) || !s.ReadUint16(&kdfID) || !s.ReadUint16(&aeadID) ||
+		!s.ReadUint16LengthPrefixed(&pk) || !s.Empty() {
+		return nil, errors.New("invalid odoh config contents")
+	}
+	kemAlg, kdf, aead := hpke.KEM(kemID), hpke.KDF(kdfID), hpke.AEAD(aeadID)
+	if !kemAlg.IsValid() || !kdf.IsValid() || !aead.IsValid() {
+		return nil, fmt.Errorf("unsupported odoh config suite: 0x%04x, 0x%04x, 0x%04x", kemID, kdfID, aeadID)
+	}
+	publicKey, err := kemAlg.Scheme().UnmarshalBinaryPublicKey(pk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid odoh config public key: %w", err)
+	}
+	return &odohConfig{
+		suite:     hpke.NewSuite(kemAlg, kdf, aead),
+		kdf:       kdf,
+		aead:      aead,
+		publicKey: publicKey,
+		keyID:     kdf.Expand(kdf.Extract(contents, nil), []byte("odoh key id"), uint(kdf.ExtractSize())),
+	}, nil
+}
+
+// odohQueryContext holds the state needed to decrypt the response of a query.
+type odohQueryContext struct {
+	cfg       *odohConfig
+	sealer    hpke.Sealer
+	plaintext []byte
+}
+
+// encryptQuery encrypts a DNS query, returning the ObliviousDoHMessage to send.
+func (cfg *odohConfig) encryptQuery(query []byte) ([]byte, *odohQueryContext, error) {
+	plaintext := odohPlaintext(query, odohQueryPadBlockLen)
+	sender, err := cfg.suite.NewSender(cfg.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := sealer.Seal(plaintext, odohAAD(odohMessageQuery, cfg.keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := odohMessage(odohMessageQuery, cfg.keyID, append(enc, ct...))
+	return msg, &odohQueryContext{cfg: cfg, sealer: sealer, plaintext: plaintext}, nil
+}
+
+// decryptResponse decrypts an ObliviousDoHMessage response, returning the DNS response.
+func (qc *odohQueryContext) decryptResponse(msg []byte) ([]byte, error) {
+	typ, nonce, ct, err := parseODoHMessage(msg)
+	if err != nil || typ != odohMessageResponse {
+		return nil, fmt.Errorf("%w: invalid response message", errODoHDecryption)
+	}
+	aead, aeadNonce, err := odohResponseAEAD(qc.sealer, qc.cfg, qc.plaintext, nonce)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, aeadNonce, ct, odohAAD(odohMessageResponse, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errODoHDecryption, err)
+	}
+	answer, err := parseODoHPlaintext(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errODoHDecryption, err)
+	}
+	return answer, nil
+}
+
+// odohResponseAEAD derives the key and nonce used to encrypt the response to a query,
+// from the HPKE context of the query, as described in RFC 9230, section 6.4.
+func odohResponseAEAD(hc hpke.Context, cfg *odohConfig, queryPlaintext, responseNonce []byte) (cipher.AEAD, []byte, error) {
+	secret := hc.Export([]byte("odoh response"), cfg.aead.KeySize())
+	salt := make([]byte, 0, len(queryPlaintext)+2+len(responseNonce))
+	salt = append(salt, queryPlaintext...)
+	salt = append(salt, byte(len(responseNonce)>>8), byte(len(responseNonce)))
+	salt = append(salt, responseNonce...)
+	prk := cfg.kdf.Extract(secret, salt)
+	key := cfg.kdf.Expand(prk, []byte("odoh key"), cfg.aead.KeySize())
+	nonce := cfg.kdf.Expand(prk, []byte("odoh nonce"), cfg.aead.NonceSize())
+	aead, err := cfg.aead.New(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+// odohPlaintext encodes the ObliviousDoHMessagePlaintext, padding the DNS message with zeros
+// so its length is a multiple of padBlockLen.
+func odohPlaintext(dnsMsg []byte, padBlockLen int) []byte {
+	padLen := 0
+	if padBlockLen > 0 {
+		padLen = (padBlockLen - len(dnsMsg)%padBlockLen) % padBlockLen
+	}
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(dnsMsg) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, padLen)) })
+	return b.BytesOrPanic()
+}
+
+// parseODoHPlaintext returns the DNS message of an ObliviousDoHMessagePlaintext.
+func parseODoHPlaintext(plaintext []byte) ([]byte, error) {
+	s := cryptobyte.String(plaintext)
+	var dnsMsg, padding cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&dnsMsg) || !s.ReadUint16LengthPrefixed(&padding) || !s.Empty() {
+		return nil, errors.New("invalid odoh plaintext")
+	}
+	for _, b := range padding {
+		if b != 0 {
+			return nil, errors.New("invalid odoh padding")
+		}
+	}
+	return dnsMsg, nil
+}
+
+// odohMessage encodes an ObliviousDoHMessage.
+func odohMessage(typ uint8, keyID, encrypted []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(typ)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(keyID) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(encrypted) })
+	return b.BytesOrPanic()
+}
+
+// parseODoHMessage decodes an ObliviousDoHMessage, returning its type, key id and encrypted message.
+func parseODoHMessage(msg []byte) (uint8, []byte, []byte, error) {
+	s := cryptobyte.String(msg)
+	var typ uint8
+	var keyID, encrypted cryptobyte.String
+	if !s.ReadUint8(&typ) || !s.ReadUint16LengthPrefixed(&keyID) || !s.ReadUint16LengthPrefixed(&encrypted) || !s.Empty() {
+		return 0, nil, nil, errors.New("invalid odoh message")
+	}
+	return typ, keyID, encrypted, nil
+}
+
+// odohAAD returns the associated data of a message with given type and key id.
+func odohAAD(typ uint8, keyID []byte) []byte {
+	aad := make([]byte, 0, 3+len(keyID))
+	aad = append(aad, typ, byte(len(keyID)>>8), byte(len(keyID)))
+	return append(aad, keyID...)
+}
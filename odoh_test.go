@@ -0,0 +1,336 @@
+package ctrld
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+func Test_odohResolver(t *testing.T) {
+	target := newTestODoHTarget(t)
+	proxy := newTestODoHProxy(t, target)
+	uc := &UpstreamConfig{
+		Name:      "test",
+		Type:      ResolverTypeODoH,
+		Endpoint:  target.URL + "/dns-query",
+		ODoHProxy: proxy.URL + "/proxy",
+		Timeout:   5000,
+	}
+	uc.Init()
+	certPool := x509.NewCertPool()
+	certPool.AddCert(target.Certificate())
+	certPool.AddCert(proxy.Certificate())
+	uc.SetCertPool(certPool)
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		testODoHResolve(t, r)
+	}
+	if got := proxy.targets(); len(got) != 2 || got[0] != target.Listener.Addr().String()+"/dns-query" {
+		t.Errorf("unexpected proxied targets: %v", got)
+	}
+	if n := target.configFetches(); n != 1 {
+		t.Errorf("config must be fetched once, got: %d", n)
+	}
+
+	// The target rotated its key, the config must be re-fetched.
+	target.rotateKey(t)
+	testODoHResolve(t, r)
+	if n := target.configFetches(); n != 2 {
+		t.Errorf("config must be re-fetched after key rotation, got: %d", n)
+	}
+}
+
+func Test_odohResolver_targetTLS(t *testing.T) {
+	target := newTestODoHTarget(t)
+	proxy := newTestODoHProxy(t, target)
+	caFile, _ := writeTestCertificate(t, target.TLS.Certificates[0])
+	targetPin := base64.StdEncoding.EncodeToString(spkiFingerprint(target.Certificate()))
+	proxyPin := base64.StdEncoding.EncodeToString(spkiFingerprint(proxy.Certificate()))
+
+	// The CA file and pins are for the target, the proxy is verified using the cert pool.
+	tests := []struct {
+		name    string
+		caFile  string
+		pins    []string
+		wantErr bool
+	}{
+		{"ca file", caFile, nil, false},
+		{"target pin", caFile, []string{targetPin}, false},
+		{"proxy pin", caFile, []string{proxyPin}, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			uc := &UpstreamConfig{
+				Name:      "test",
+				Type:      ResolverTypeODoH,
+				Endpoint:  target.URL + "/dns-query",
+				ODoHProxy: proxy.URL + "/proxy",
+				Timeout:   5000,
+				CAFile:    tc.caFile,
+				SPKIPins:  tc.pins,
+			}
+			uc.Init()
+			uc.SetCertPool(proxy.certPool)
+			r, err := NewResolver(uc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.wantErr {
+				testODoHResolve(t, r)
+				return
+			}
+			_, err = r.Resolve(context.Background(), testQuery("example.com."))
+			if !errors.Is(err, errSPKIPinMismatch) {
+				t.Fatalf("expected spki pin mismatch, got: %v", err)
+			}
+		})
+	}
+}
+
+func Test_parseODoHConfigs(t *testing.T) {
+	pk, _, err := hpke.KEM_X25519_HKDF_SHA256.Scheme().GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := testODoHConfigContents(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM, pk)
+	unsupported := testODoHConfigContents(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, 0xffff, pk)
+	tests := []struct {
+		name    string
+		configs []byte
+		want    int
+		wantErr bool
+	}{
+		{"valid", testODoHConfigs(map[uint16][]byte{odohVersion: valid}), 1, false},
+		{"unknown version", testODoHConfigs(map[uint16][]byte{0xff00: valid}), 0, true},
+		{"unsupported suite", testODoHConfigs(map[uint16][]byte{odohVersion: unsupported}), 0, true},
+		{"truncated", []byte{0, 10, 0, 1}, 0, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			configs, err := parseODoHConfigs(tc.configs)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(configs) != tc.want {
+				t.Errorf("unexpected configs, want: %d, got: %d", tc.want, len(configs))
+			}
+		})
+	}
+}
+
+func testODoHResolve(t *testing.T, r Resolver) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	answer, err := r.Resolve(ctx, testQuery("example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("unexpected answer: %v", answer)
+	}
+	if a, ok := answer.Answer[0].(*dns.A); !ok || a.A.String() != "127.0.0.2" {
+		t.Fatalf("unexpected answer: %v", answer)
+	}
+}
+
+// testODoHTarget is a local ODoH target, answering A queries with 127.0.0.2.
+type testODoHTarget struct {
+	*httptest.Server
+	certPool *x509.CertPool
+
+	mu       sync.Mutex
+	cfg      *odohConfig
+	contents []byte
+	sk       kem.PrivateKey
+	fetches  int
+}
+
+func newTestODoHTarget(t *testing.T) *testODoHTarget {
+	t.Helper()
+	target := &testODoHTarget{}
+	target.rotateKey(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc(odohConfigsPath, func(w http.ResponseWriter, r *http.Request) {
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		target.fetches++
+		_, _ = w.Write(testODoHConfigs(map[uint16][]byte{odohVersion: target.contents}))
+	})
+	mux.HandleFunc("/dns-query", target.serveQuery)
+	// The target has its own certificate, distinct from the proxy one.
+	cert, certPool := testTLSCertificate(t)
+	target.Server = httptest.NewUnstartedServer(mux)
+	target.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	target.StartTLS()
+	t.Cleanup(target.Close)
+	target.certPool = certPool
+	return target
+}
+
+func (s *testODoHTarget) rotateKey(t *testing.T) {
+	t.Helper()
+	kemAlg := hpke.KEM_X25519_HKDF_SHA256
+	pk, sk, err := kemAlg.Scheme().GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := testODoHConfigContents(kemAlg, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM, pk)
+	cfg, err := parseODoHConfigContents(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg, s.contents, s.sk = cfg, contents, sk
+}
+
+func (s *testODoHTarget) configFetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func (s *testODoHTarget) serveQuery(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	cfg, sk := s.cfg, s.sk
+	s.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	typ, keyID, encrypted, err := parseODoHMessage(body)
+	if err != nil || typ != odohMessageQuery {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	if !bytes.Equal(keyID, cfg.keyID) {
+		http.Error(w, "unknown key", http.StatusUnauthorized)
+		return
+	}
+	receiver, _ := cfg.suite.NewReceiver(sk, []byte("odoh query"))
+	encLen := hpke.KEM_X25519_HKDF_SHA256.Scheme().CiphertextSize()
+	opener, err := receiver.Setup(encrypted[:encLen])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	plaintext, err := opener.Open(encrypted[encLen:], odohAAD(odohMessageQuery, keyID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	query, err := parseODoHPlaintext(plaintext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	answer, _ := staticResolver("127.0.0.2").Resolve(r.Context(), msg)
+	buf, _ := answer.Pack()
+	nonce := make([]byte, cfg.aead.KeySize())
+	_, _ = rand.Read(nonce)
+	aead, aeadNonce, err := odohResponseAEAD(opener, cfg, plaintext, nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ct := aead.Seal(nil, aeadNonce, odohPlaintext(buf, 0), odohAAD(odohMessageResponse, nonce))
+	w.Header().Set("Content-Type", headerApplicationODoH)
+	_, _ = w.Write(odohMessage(odohMessageResponse, nonce, ct))
+}
+
+// testODoHProxy is a local ODoH proxy, forwarding queries to the target.
+type testODoHProxy struct {
+	*httptest.Server
+	certPool *x509.CertPool
+
+	mu   sync.Mutex
+	reqs []string
+}
+
+func newTestODoHProxy(t *testing.T, target *testODoHTarget) *testODoHProxy {
+	t.Helper()
+	p := &testODoHProxy{}
+	client := target.Client()
+	p.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != headerApplicationODoH {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		targetHost, targetPath := r.URL.Query().Get("targethost"), r.URL.Query().Get("targetpath")
+		p.mu.Lock()
+		p.reqs = append(p.reqs, targetHost+targetPath)
+		p.mu.Unlock()
+		u := url.URL{Scheme: "https", Host: targetHost, Path: targetPath}
+		resp, err := client.Post(u.String(), headerApplicationODoH, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(p.Close)
+	p.certPool = x509.NewCertPool()
+	p.certPool.AddCert(p.Certificate())
+	return p
+}
+
+func (p *testODoHProxy) targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.reqs...)
+}
+
+func testODoHConfigContents(kemID hpke.KEM, kdfID hpke.KDF, aeadID hpke.AEAD, pk kem.PublicKey) []byte {
+	pkBytes, _ := pk.MarshalBinary()
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(kemID))
+	b.AddUint16(uint16(kdfID))
+	b.AddUint16(uint16(aeadID))
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(pkBytes) })
+	return b.BytesOrPanic()
+}
+
+func testODoHConfigs(configs map[uint16][]byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for version, contents := range configs {
+			b.AddUint16(version)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(contents) })
+		}
+	})
+	return b.BytesOrPanic()
+}
@@ -0,0 +1,396 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// recursiveMaxSteps is the maximum number of queries made for resolving a single name.
+	recursiveMaxSteps = 32
+	// recursiveMaxDepth limits nested resolutions, e.g: name servers without glue.
+	recursiveMaxDepth = 8
+	// recursiveMaxCNAMEs is the maximum length of a CNAME chain.
+	recursiveMaxCNAMEs = 8
+	// recursiveQueryTimeout is the timeout of a query to a single authoritative server.
+	recursiveQueryTimeout = 2 * time.Second
+	// recursiveUDPSize is the EDNS0 UDP payload size advertised to authoritative servers.
+	recursiveUDPSize = 1232
+	// recursiveMaxDelegationTTL caps how long delegations are kept in the infrastructure cache.
+	recursiveMaxDelegationTTL = 24 * time.Hour
+	// recursiveMaxDelegations is the maximum number of zones kept in the infrastructure cache.
+	recursiveMaxDelegations = 4096
+)
+
+var errRecursionTooDeep = errors.New("recursion too deep")
+
+// rootHints are the addresses of the root name servers.
+var rootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10", "192.5.5.241", "192.112.36.4",
+	"198.97.190.53", "192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42", "202.12.27.33",
+	"2001:503:ba3e::2:30", "2801:1b8:10::b", "2001:500:2::c", "2001:500:2d::d", "2001:500:a8::e", "2001:500:2f::f",
+	"2001:500:12::d0d", "2001:500:1::53", "2001:7fe::53", "2001:503:c27::2:30", "2001:7fd::1", "2001:500:9f::42",
+	"2001:dc3::35",
+}
+
+type recursiveResolver struct {
+	uc *UpstreamConfig
+}
+
+// Resolve resolves msg iteratively, starting from the root name servers. If msg has the DO bit,
+// DNSSEC records are requested from authoritative servers and returned, so the answer could be validated.
+func (r *recursiveResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		return nil, errors.New("no question")
+	}
+	if r.uc.recursive == nil {
+		return nil, errors.New("recursive resolver is not initialized")
+	}
+	q := msg.Question[0]
+	opt := msg.IsEdns0()
+	do := opt != nil && opt.Do()
+	resp, err := r.uc.recursive.resolve(ctx, q.Name, q.Qtype, do, 0)
+	if err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	answer.SetRcode(msg, resp.Rcode)
+	answer.RecursionAvailable = true
+	answer.Answer = resp.Answer
+	answer.Ns = resp.Ns
+	if opt != nil {
+		answer.SetEdns0(opt.UDPSize(), do)
+	}
+	return answer, nil
+}
+
+// recursiveClient resolves names iteratively, keeping an infrastructure cache of delegations.
+type recursiveClient struct {
+	uc    *UpstreamConfig
+	hints []string
+	port  string
+
+	mu          sync.Mutex
+	delegations map[string]*recursiveDelegation
+}
+
+// recursiveDelegation is the name server addresses of a zone.
+type recursiveDelegation struct {
+	servers []string
+	expire  time.Time
+}
+
+func newRecursiveClient(uc *UpstreamConfig, hints []string, port string) *recursiveClient {
+	c := &recursiveClient{uc: uc, port: port, delegations: make(map[string]*recursiveDelegation)}
+	for _, ip := range hints {
+		c.hints = append(c.hints, net.JoinHostPort(ip, port))
+	}
+	return c
+}
+
+// resolve resolves qname, following CNAME chain. CNAME targets outside the zone of the server
+// which answered are resolved again from their closest delegation, see resolveName. If do is
+// true, DNSSEC records are requested.
+func (c *recursiveClient) resolve(ctx context.Context, qname string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	if depth > recursiveMaxDepth {
+		return nil, errRecursionTooDeep
+	}
+	qname = dns.Fqdn(qname)
+	var answers []dns.RR
+	for i := 0; ; i++ {
+		resp, err := c.resolveName(ctx, qname, qtype, do, depth)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, resp.Answer...)
+		target := cnameTarget(resp.Answer, qname, qtype)
+		if target == "" || i >= recursiveMaxCNAMEs {
+			resp.Answer = answers
+			return resp, nil
+		}
+		qname = target
+	}
+}
+
+// resolveName resolves qname, starting from the closest known delegation, using QNAME minimisation.
+// Records of the final response outside the zone of the server which answered are dropped, since
+// the server is not authoritative for them.
+func (c *recursiveClient) resolveName(ctx context.Context, qname string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	delegation := qname
+	if qtype == dns.TypeDS && qname != "." {
+		// DS records are served by the parent zone.
+		off, _ := dns.NextLabel(qname, 0)
+		delegation = qname[off:]
+	}
+	zone, servers := c.closestDelegation(delegation)
+	// known is the longest ancestor of qname which is known to be served by servers.
+	known := zone
+	for i := 0; i < recursiveMaxSteps; i++ {
+		name, typ := minimisedName(known, qname), qtype
+		if name != qname {
+			typ = dns.TypeA
+		}
+		resp, err := c.exchange(ctx, servers, name, typ, do)
+		if err != nil {
+			return nil, err
+		}
+		if child, ttl := referral(resp, zone, name, typ); child != "" {
+			addrs, err := c.delegationAddrs(ctx, resp, zone, child, depth)
+			if err != nil {
+				return nil, err
+			}
+			c.addDelegation(child, addrs, ttl)
+			zone, known, servers = child, child, addrs
+			continue
+		}
+		if name == qname {
+			resp.Answer = inBailiwick(resp.Answer, zone)
+			resp.Ns = inBailiwick(resp.Ns, zone)
+			return resp, nil
+		}
+		// RFC 8020, nothing exists below a non-existent name.
+		if resp.Rcode == dns.RcodeNameError {
+			resp.Question[0] = dns.Question{Name: qname, Qtype: qtype, Qclass: dns.ClassINET}
+			resp.Answer = nil
+			resp.Ns = inBailiwick(resp.Ns, zone)
+			return resp, nil
+		}
+		known = name
+	}
+	return nil, fmt.Errorf("too many steps resolving %s", qname)
+}
+
+// exchange sends query for name to servers in turn, until a valid response is received.
+// The case of name is randomized, and must be echoed back by the server.
+func (c *recursiveClient) exchange(ctx context.Context, servers []string, name string, qtype uint16, do bool) (*dns.Msg, error) {
+	randomized := randomizeCase(name)
+	msg := new(dns.Msg)
+	msg.SetQuestion(randomized, qtype)
+	msg.RecursionDesired = false
+	msg.SetEdns0(recursiveUDPSize, do)
+
+	var errs []error
+	start := rand.Intn(len(servers))
+	for i := range servers {
+		server := servers[(start+i)%len(servers)]
+		queryCtx, cancel := context.WithTimeout(ctx, recursiveQueryTimeout)
+		resp, err := exchangeWithTCPFallback(queryCtx, msg, server, "udp", func(network string) *dns.Client {
+			return &dns.Client{Net: network, Dialer: c.uc.bindDialer(&net.Dialer{}, network)}
+		})
+		cancel()
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+			continue
+		case len(resp.Question) != 1 || resp.Question[0].Name != randomized:
+			errs = append(errs, fmt.Errorf("question mismatch from %s", server))
+			continue
+		case resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError:
+			errs = append(errs, fmt.Errorf("%s from %s", dns.RcodeToString[resp.Rcode], server))
+			continue
+		}
+		restoreCase(resp, randomized, name)
+		return resp, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("could not query %s: %w", name, errors.Join(errs...))
+}
+
+// delegationAddrs returns the addresses of name servers of child zone, using in-bailiwick glue
+// records, or resolving the name servers if there's no glue.
+func (c *recursiveClient) delegationAddrs(ctx context.Context, resp *dns.Msg, zone, child string, depth int) ([]string, error) {
+	var nsNames []string
+	for _, rr := range resp.Ns {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, child) {
+			nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+		}
+	}
+	var addrs4, addrs6 []string
+	for _, rr := range resp.Extra {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !containsString(nsNames, name) || !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs4 = append(addrs4, net.JoinHostPort(rr.A.String(), c.port))
+		case *dns.AAAA:
+			addrs6 = append(addrs6, net.JoinHostPort(rr.AAAA.String(), c.port))
+		}
+	}
+	if addrs := append(addrs4, addrs6...); len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	var errs []error
+	for _, ns := range nsNames {
+		// Name servers under the child zone could not be resolved without glue.
+		if dns.IsSubDomain(child, ns) {
+			continue
+		}
+		resp, err := c.resolve(ctx, ns, dns.TypeA, false, depth+1)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var addrs []string
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), c.port))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, fmt.Errorf("no address for name servers of %s: %w", child, errors.Join(errs...))
+}
+
+// closestDelegation returns the closest cached zone of name and its servers, the root zone if there's none.
+func (c *recursiveClient) closestDelegation(name string) (string, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name = dns.CanonicalName(name)
+	now := time.Now()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if d := c.delegations[name[off:]]; d != nil && d.expire.After(now) {
+			return name[off:], d.servers
+		}
+	}
+	return ".", c.hints
+}
+
+// addDelegation adds the servers of zone to the infrastructure cache.
+func (c *recursiveClient) addDelegation(zone string, servers []string, ttl uint32) {
+	d := time.Duration(ttl) * time.Second
+	if d > recursiveMaxDelegationTTL {
+		d = recursiveMaxDelegationTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.delegations) >= recursiveMaxDelegations {
+		c.delegations = make(map[string]*recursiveDelegation)
+	}
+	c.delegations[dns.CanonicalName(zone)] = &recursiveDelegation{servers: servers, expire: time.Now().Add(d)}
+}
+
+// referral returns the child zone and its NS records TTL if resp, the response to a query for
+// name and qtype, is a referral from zone to a child zone enclosing name.
+func referral(resp *dns.Msg, zone, name string, qtype uint16) (string, uint32) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return "", 0
+	}
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		child := dns.CanonicalName(ns.Hdr.Name)
+		if qtype == dns.TypeDS && child == dns.CanonicalName(name) {
+			// The parent zone answers DS queries of the child, this is a NODATA response.
+			continue
+		}
+		if child != dns.CanonicalName(zone) && dns.IsSubDomain(zone, child) && dns.IsSubDomain(child, name) {
+			return child, ns.Hdr.Ttl
+		}
+	}
+	return "", 0
+}
+
+// inBailiwick returns records of rrs which owners are in zone.
+func inBailiwick(rrs []dns.RR, zone string) []dns.RR {
+	n := 0
+	for _, rr := range rrs {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			rrs[n] = rr
+			n++
+		}
+	}
+	return rrs[:n]
+}
+
+// minimisedName returns the ancestor of qname which is one label longer than known.
+func minimisedName(known, qname string) string {
+	idx := dns.Split(qname)
+	n := dns.CountLabel(known) + 1
+	if n >= len(idx) {
+		return qname
+	}
+	return qname[idx[len(idx)-n]:]
+}
+
+// cnameTarget returns the name which the CNAME chain of qname ends at, if there's no
+// records of qtype for it in rrs.
+func cnameTarget(rrs []dns.RR, qname string, qtype uint16) string {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+	target := ""
+	name := qname
+	for i := 0; i <= len(rrs); i++ {
+		found := false
+		for _, rr := range rrs {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				name, target, found = cname.Target, cname.Target, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return target
+}
+
+// randomizeCase returns name with the case of its letters randomized, see draft-vixie-dnsext-dns0x20.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if rand.Intn(2) == 0 {
+				b[i] = c | 0x20
+			} else {
+				b[i] = c &^ 0x20
+			}
+		}
+	}
+	return string(b)
+}
+
+// restoreCase replaces the randomized name with name in the question and record owners of resp.
+func restoreCase(resp *dns.Msg, randomized, name string) {
+	resp.Question[0].Name = name
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Name == randomized {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,371 @@
+package ctrld
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_recursiveResolver(t *testing.T) {
+	h := newTestRecursiveHierarchy(t)
+	uc := &UpstreamConfig{Name: "test", Type: ResolverTypeRecursive}
+	uc.Init()
+	uc.recursive = newRecursiveClient(uc, []string{h.root.ip}, h.port)
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []string
+	}{
+		{"glue", "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.1"}},
+		{"glueless", "www.glueless.com.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.2"}},
+		{"cname to other zone", "alias.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.glueless.com.", "192.0.2.2"}},
+		{"nodata", "www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"nxdomain", "a.b.missing.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			answer, err := r.Resolve(ctx, newTestMsg(tc.qname, tc.qtype))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer.Rcode != tc.rcode {
+				t.Fatalf("unexpected rcode, want: %s, got: %s", dns.RcodeToString[tc.rcode], dns.RcodeToString[answer.Rcode])
+			}
+			var got []string
+			for _, rr := range answer.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.CNAME:
+					got = append(got, rr.Target)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tc.answer, ",") {
+				t.Errorf("unexpected answer, want: %v, got: %v", tc.answer, got)
+			}
+		})
+	}
+
+	// QNAME minimisation, the root servers only see top level domains.
+	for _, q := range h.root.queries() {
+		if dns.CountLabel(q) > 1 {
+			t.Errorf("root server received non-minimised query: %s", q)
+		}
+	}
+	// Infrastructure cache, the root servers are only asked once for each top level domain.
+	if n := len(h.root.queries()); n != 2 {
+		t.Errorf("unexpected number of root queries: %v", h.root.queries())
+	}
+	// 0x20 case randomization, queries are sent with mixed case.
+	mixed := false
+	for _, q := range h.auth.queries() {
+		if q != strings.ToLower(q) {
+			mixed = true
+		}
+	}
+	if !mixed {
+		t.Errorf("queries case is not randomized: %v", h.auth.queries())
+	}
+}
+
+func Test_recursiveResolver_caseMismatch(t *testing.T) {
+	h := newTestRecursiveHierarchy(t)
+	h.auth.lowercase.Store(true)
+	uc := &UpstreamConfig{Name: "test", Type: ResolverTypeRecursive}
+	uc.Init()
+	uc.recursive = newRecursiveClient(uc, []string{h.root.ip}, h.port)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The name has enough letters, so the randomized case almost surely differs from the lowercased one.
+	if _, err := uc.recursive.exchange(ctx, []string{net.JoinHostPort(h.auth.ip, h.port)}, "wwwwwwwwwwwwwwww.example.com.", dns.TypeA, false); err == nil {
+		t.Fatal("expected error for question case mismatch")
+	}
+}
+
+func Test_recursiveResolver_bailiwick(t *testing.T) {
+	h := newTestRecursiveHierarchy(t)
+	// The server of "example.com." answers with records of "glueless.com." along with the CNAME.
+	h.auth.addExtra("alias.example.com.", testRR(t, "www.glueless.com. 300 IN A 203.0.113.66"))
+	uc := &UpstreamConfig{Name: "test", Type: ResolverTypeRecursive}
+	uc.Init()
+	uc.recursive = newRecursiveClient(uc, []string{h.root.ip}, h.port)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := uc.recursive.resolve(ctx, "alias.example.com.", dns.TypeA, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			got = append(got, a.A.String())
+		}
+	}
+	if strings.Join(got, ",") != "192.0.2.2" {
+		t.Errorf("out of bailiwick records must be dropped, got: %v", got)
+	}
+}
+
+func Test_recursiveResolver_dnssec(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+
+	root := newTestDNSSECZone(t, ".")
+	example := newTestDNSSECZone(t, "example.")
+	rootServer := newTestAuthServerRRs(t, "127.0.0.2", port, []string{"."}, joinRRs(
+		[]dns.RR{testRR(t, "example. 3600 IN NS ns.example."), testRR(t, "ns.example. 3600 IN A 127.0.0.4")},
+		root.sign(t, nil, example.key.ToDS(dns.SHA256)),
+		root.sign(t, nil, root.key),
+	))
+	newTestAuthServerRRs(t, "127.0.0.4", port, []string{"example."}, joinRRs(
+		example.sign(t, nil, example.key),
+		example.sign(t, nil, testRR(t, "www.example. 3600 IN A 192.0.2.1")),
+	))
+
+	uc := &UpstreamConfig{Name: "test", Type: ResolverTypeRecursive}
+	uc.Init()
+	uc.recursive = newRecursiveClient(uc, []string{rootServer.ip}, port)
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	plain := newTestMsg("www.example.", dns.TypeA)
+	plain.SetEdns0(dns.DefaultMsgSize, false)
+	answer, err := r.Resolve(ctx, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range answer.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			t.Errorf("RRSIG must not be returned without DO bit: %v", rr)
+		}
+	}
+
+	msg := DNSSECQuery(newTestMsg("www.example.", dns.TypeA))
+	answer, err = r.Resolve(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt := answer.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("DO bit must be set in answer: %v", answer)
+	}
+	v, err := NewDNSSECValidator([]string{root.key.ToDS(dns.SHA256).String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+		return r.Resolve(ctx, DNSSECQuery(newTestMsg(name, qtype)))
+	}
+	if result, err := v.Validate(ctx, msg, answer, lookup); result != DNSSECSecure {
+		t.Errorf("unexpected dnssec result, want: %s, got: %s, err: %v", DNSSECSecure, result, err)
+	}
+}
+
+func Test_minimisedName(t *testing.T) {
+	tests := []struct {
+		known string
+		qname string
+		want  string
+	}{
+		{".", "www.example.com.", "com."},
+		{"com.", "www.example.com.", "example.com."},
+		{"example.com.", "www.example.com.", "www.example.com."},
+		{"www.example.com.", "www.example.com.", "www.example.com."},
+	}
+	for _, tc := range tests {
+		if got := minimisedName(tc.known, tc.qname); got != tc.want {
+			t.Errorf("minimisedName(%q, %q) = %q, want: %q", tc.known, tc.qname, got, tc.want)
+		}
+	}
+}
+
+func newTestMsg(name string, qtype uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	return msg
+}
+
+// testRecursiveHierarchy is an in-process DNS hierarchy:
+//
+//   - root server delegates "com." and "net." to the TLD server.
+//   - TLD server delegates "example.com." and "provider.net." with glue, and "glueless.com." to "ns.provider.net." without glue.
+//   - auth server serves "example.com.", "glueless.com." and "provider.net.".
+type testRecursiveHierarchy struct {
+	port string
+	root *testAuthServer
+	tld  *testAuthServer
+	auth *testAuthServer
+}
+
+func newTestRecursiveHierarchy(t *testing.T) *testRecursiveHierarchy {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+
+	h := &testRecursiveHierarchy{port: port}
+	h.root = newTestAuthServer(t, "127.0.0.2", port, []string{"."},
+		"com. 86400 IN NS a.nic.com.",
+		"net. 86400 IN NS a.nic.net.",
+		"a.nic.com. 86400 IN A 127.0.0.3",
+		"a.nic.net. 86400 IN A 127.0.0.3",
+	)
+	h.tld = newTestAuthServer(t, "127.0.0.3", port, []string{"com.", "net."},
+		"example.com. 3600 IN NS ns1.example.com.",
+		"ns1.example.com. 3600 IN A 127.0.0.4",
+		"glueless.com. 3600 IN NS ns.provider.net.",
+		"provider.net. 3600 IN NS ns.provider.net.",
+		"ns.provider.net. 3600 IN A 127.0.0.4",
+	)
+	h.auth = newTestAuthServer(t, "127.0.0.4", port, []string{"example.com.", "glueless.com.", "provider.net."},
+		"www.example.com. 300 IN A 192.0.2.1",
+		"alias.example.com. 300 IN CNAME www.glueless.com.",
+		"www.glueless.com. 300 IN A 192.0.2.2",
+		"ns.provider.net. 300 IN A 127.0.0.4",
+	)
+	return h
+}
+
+// testAuthServer is a local authoritative server of given zones. NS records of names
+// below its zones are delegations, served as referrals with glue records. RRSIG records
+// are served along with the records they cover if the query has the DO bit.
+type testAuthServer struct {
+	ip        string
+	zones     []string
+	records   []dns.RR
+	lowercase atomic.Bool
+
+	mu   sync.Mutex
+	seen []string
+	// extra are records added to answers of given names.
+	extra map[string][]dns.RR
+}
+
+func newTestAuthServer(t *testing.T, ip, port string, zones []string, records ...string) *testAuthServer {
+	t.Helper()
+	var rrs []dns.RR
+	for _, r := range records {
+		rrs = append(rrs, testRR(t, r))
+	}
+	return newTestAuthServerRRs(t, ip, port, zones, rrs)
+}
+
+func newTestAuthServerRRs(t *testing.T, ip, port string, zones []string, records []dns.RR) *testAuthServer {
+	t.Helper()
+	s := &testAuthServer{ip: ip, zones: zones, records: records}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Skipf("could not listen on %s: %v", ip, err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.serveDNS)}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return s
+}
+
+// addExtra adds rr to answers of name.
+func (s *testAuthServer) addExtra(name string, rr dns.RR) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.extra == nil {
+		s.extra = make(map[string][]dns.RR)
+	}
+	s.extra[name] = append(s.extra[name], rr)
+}
+
+func (s *testAuthServer) queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.seen...)
+}
+
+func (s *testAuthServer) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	s.mu.Lock()
+	s.seen = append(s.seen, q.Name)
+	s.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if s.lowercase.Load() {
+		resp.Question[0].Name = strings.ToLower(q.Name)
+	}
+	name := dns.CanonicalName(q.Name)
+	opt := req.IsEdns0()
+	do := opt != nil && opt.Do()
+
+	// Referral to the closest delegation enclosing name.
+	for _, rr := range s.records {
+		ns, ok := rr.(*dns.NS)
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !ok || containsString(s.zones, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		// DS records of the child are answered by the parent.
+		if q.Qtype == dns.TypeDS && owner == name {
+			continue
+		}
+		for _, rr := range s.records {
+			if rr.Header().Rrtype == dns.TypeNS && dns.CanonicalName(rr.Header().Name) == owner {
+				resp.Ns = append(resp.Ns, rr)
+			}
+			if rr.Header().Rrtype == dns.TypeA && strings.EqualFold(rr.Header().Name, ns.Ns) {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+		_ = w.WriteMsg(resp)
+		return
+	}
+
+	resp.Authoritative = true
+	exists := false
+	for _, rr := range s.records {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if dns.IsSubDomain(name, owner) {
+			exists = true
+		}
+		match := rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			match = do && (sig.TypeCovered == q.Qtype || sig.TypeCovered == dns.TypeCNAME)
+		}
+		if owner == name && match {
+			rr := dns.Copy(rr)
+			rr.Header().Name = q.Name
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	s.mu.Lock()
+	for _, rr := range s.extra[name] {
+		resp.Answer = append(resp.Answer, dns.Copy(rr))
+	}
+	s.mu.Unlock()
+	if !exists && !containsString(s.zones, name) {
+		resp.Rcode = dns.RcodeNameError
+	}
+	_ = w.WriteMsg(resp)
+}
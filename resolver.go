@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -24,18 +26,25 @@ const (
 	ResolverTypeOS = "os"
 	// ResolverTypeLegacy specifies legacy resolver.
 	ResolverTypeLegacy = "legacy"
+	// ResolverTypeDNSCrypt specifies DNSCrypt resolver.
+	ResolverTypeDNSCrypt = "dnscrypt"
+	// ResolverTypeODoH specifies Oblivious DoH resolver.
+	ResolverTypeODoH = "odoh"
+	// ResolverTypeRecursive specifies built-in recursive resolver.
+	ResolverTypeRecursive = "recursive"
 )
 
-var bootstrapDNS = "76.76.2.0"
+// Transport protocols of legacy and os upstreams.
+const (
+	protocolUDP = "udp"
+	protocolTCP = "tcp"
+)
 
 // or is the Resolver used for ResolverTypeOS.
-var or = &osResolver{nameservers: defaultNameservers()}
+var or atomic.Pointer[osResolver]
 
-// defaultNameservers returns OS nameservers plus ctrld bootstrap nameserver.
-func defaultNameservers() []string {
-	ns := nameservers()
-	ns = append(ns, net.JoinHostPort(bootstrapDNS, "53"))
-	return ns
+func init() {
+	or.Store(newOSResolver(defaultBootstrapServers))
 }
 
 // Resolver is the interface that wraps the basic DNS operations.
@@ -58,15 +67,30 @@ func NewResolver(uc *UpstreamConfig) (Resolver, error) {
 	case ResolverTypeDOQ:
 		return &doqResolver{uc: uc}, nil
 	case ResolverTypeOS:
-		return or, nil
+		if uc.Protocol == protocolTCP {
+			o := *or.Load()
+			o.tcp = true
+			return &o, nil
+		}
+		return or.Load(), nil
 	case ResolverTypeLegacy:
 		return &legacyResolver{uc: uc}, nil
+	case ResolverTypeDNSCrypt:
+		return &dnscryptResolver{uc: uc}, nil
+	case ResolverTypeODoH:
+		return &odohResolver{uc: uc}, nil
+	case ResolverTypeRecursive:
+		return &recursiveResolver{uc: uc}, nil
 	}
 	return nil, fmt.Errorf("%w: %s", errUnknownResolver, typ)
 }
 
 type osResolver struct {
 	nameservers []string
+	// resolvers are queried along with nameservers, e.g: encrypted bootstrap servers.
+	resolvers []Resolver
+	// tcp reports whether nameservers are queried over TCP instead of UDP.
+	tcp bool
 }
 
 type osResolverResult struct {
@@ -77,17 +101,23 @@ type osResolverResult struct {
 // Resolve performs DNS resolvers using OS default nameservers. Nameserver is chosen from
 // available nameservers with a roundrobin algorithm.
 func (o *osResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
-	numServers := len(o.nameservers)
+	numServers := len(o.nameservers) + len(o.resolvers)
 	if numServers == 0 {
 		return nil, errors.New("no nameservers available")
 	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	dnsClient := &dns.Client{Net: "udp"}
+	network := "udp"
+	if o.tcp {
+		network = "tcp"
+	}
+	newClient := func(network string) *dns.Client {
+		return &dns.Client{Net: network}
+	}
 	ch := make(chan *osResolverResult, numServers)
 	var wg sync.WaitGroup
-	wg.Add(len(o.nameservers))
+	wg.Add(numServers)
 	go func() {
 		wg.Wait()
 		close(ch)
@@ -95,10 +125,17 @@ func (o *osResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error
 	for _, server := range o.nameservers {
 		go func(server string) {
 			defer wg.Done()
-			answer, _, err := dnsClient.ExchangeContext(ctx, msg.Copy(), server)
+			answer, err := exchangeWithTCPFallback(ctx, msg.Copy(), server, network, newClient)
 			ch <- &osResolverResult{answer: answer, err: err}
 		}(server)
 	}
+	for _, r := range o.resolvers {
+		go func(r Resolver) {
+			defer wg.Done()
+			answer, err := r.Resolve(ctx, msg.Copy())
+			ch <- &osResolverResult{answer: answer, err: err}
+		}(r)
+	}
 
 	errs := make([]error, 0, numServers)
 	for res := range ch {
@@ -117,28 +154,56 @@ type legacyResolver struct {
 }
 
 func (r *legacyResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
-	// See comment in (*dotResolver).resolve method.
-	dialer := newDialer(net.JoinHostPort(bootstrapDNS, "53"))
+	// See comment in (*UpstreamConfig).dotConnPool method.
+	dialer := newDialer(r.uc.bootstrapServers())
 	dnsTyp := uint16(0)
 	if msg != nil && len(msg.Question) > 0 {
 		dnsTyp = msg.Question[0].Qtype
 	}
-	_, udpNet := r.uc.netForDNSType(dnsTyp)
-	dnsClient := &dns.Client{
-		Net:    udpNet,
-		Dialer: dialer,
-	}
+	_, network := r.uc.netForDNSType(dnsTyp)
 	endpoint := r.uc.Endpoint
 	if r.uc.BootstrapIP != "" {
-		dnsClient.Net = "udp"
+		network = "udp"
 		_, port, _ := net.SplitHostPort(endpoint)
 		endpoint = net.JoinHostPort(r.uc.BootstrapIP, port)
 	}
 
-	answer, _, err := dnsClient.ExchangeContext(ctx, msg, endpoint)
+	if r.uc.proxy != nil {
+		// Proxies only support TCP.
+		conn, err := r.uc.proxy.DialContext(ctx, "tcp", endpoint)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		dnsClient := &dns.Client{Net: "tcp"}
+		answer, _, err := dnsClient.ExchangeWithConnContext(ctx, msg, &dns.Conn{Conn: conn})
+		return answer, err
+	}
+
+	if r.uc.Protocol == protocolTCP {
+		network = tcpNetwork(network)
+	}
+	return exchangeWithTCPFallback(ctx, msg, endpoint, network, func(network string) *dns.Client {
+		return &dns.Client{Net: network, Dialer: r.uc.bindDialer(dialer, network)}
+	})
+}
+
+// exchangeWithTCPFallback sends msg to server using the client returned by newClient for given
+// network. If the network is UDP and the answer is truncated, the query is retried over TCP.
+func exchangeWithTCPFallback(ctx context.Context, msg *dns.Msg, server, network string, newClient func(network string) *dns.Client) (*dns.Msg, error) {
+	answer, _, err := newClient(network).ExchangeContext(ctx, msg, server)
+	if err == nil && answer.Truncated && strings.HasPrefix(network, "udp") {
+		Log(ctx, ProxyLogger.Load().Debug(), "truncated answer from %s, retrying over tcp", server)
+		answer, _, err = newClient(tcpNetwork(network)).ExchangeContext(ctx, msg, server)
+	}
 	return answer, err
 }
 
+// tcpNetwork returns the TCP network corresponding to the UDP network.
+func tcpNetwork(udpNet string) string {
+	return "tcp" + strings.TrimPrefix(udpNet, "udp")
+}
+
 type dummyResolver struct{}
 
 func (d dummyResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
@@ -147,16 +212,17 @@ func (d dummyResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, err
 	return ans, nil
 }
 
-// LookupIP looks up host using OS resolver.
+// LookupIP looks up host using OS resolver and bootstrap servers.
 // It returns a slice of that host's IPv4 and IPv6 addresses.
 func LookupIP(domain string) []string {
-	return lookupIP(domain, -1, true)
+	return lookupIP(domain, -1, currentBootstrapServers())
 }
 
-func lookupIP(domain string, timeout int, withBootstrapDNS bool) (ips []string) {
+// lookupIP looks up host using OS resolver, plus given bootstrap servers if not nil.
+func lookupIP(domain string, timeout int, bs *bootstrapServers) (ips []string) {
 	resolver := &osResolver{nameservers: nameservers()}
-	if withBootstrapDNS {
-		resolver.nameservers = append([]string{net.JoinHostPort(bootstrapDNS, "53")}, resolver.nameservers...)
+	if bs != nil {
+		resolver = newOSResolver(bs)
 	}
 	ProxyLogger.Load().Debug().Msgf("resolving %q using bootstrap DNS %q", domain, resolver.nameservers)
 	timeoutMs := 2000
@@ -229,10 +295,10 @@ func lookupIP(domain string, timeout int, withBootstrapDNS bool) (ips []string)
 // NewBootstrapResolver returns an OS resolver, which use following nameservers:
 //
 //   - Gateway IP address (depends on OS).
+//   - Bootstrap servers.
 //   - Input servers.
 func NewBootstrapResolver(servers ...string) Resolver {
-	resolver := &osResolver{nameservers: nameservers()}
-	resolver.nameservers = append([]string{net.JoinHostPort(bootstrapDNS, "53")}, resolver.nameservers...)
+	resolver := newOSResolver(currentBootstrapServers())
 	for _, ns := range servers {
 		resolver.nameservers = append([]string{net.JoinHostPort(ns, "53")}, resolver.nameservers...)
 	}
@@ -272,18 +338,6 @@ func NewPrivateResolver() Resolver {
 	return resolver
 }
 
-func newDialer(dnsAddress string) *net.Dialer {
-	return &net.Dialer{
-		Resolver: &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{}
-				return d.DialContext(ctx, network, dnsAddress)
-			},
-		},
-	}
-}
-
 // TODO(cuonglm): use slices.Contains once upgrading to go1.21
 // sliceContains reports whether v is present in s.
 func sliceContains[S ~[]E, E comparable](s S, v E) bool {
@@ -2,6 +2,8 @@ package ctrld
 
 import (
 	"context"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,6 +30,81 @@ func Test_osResolver_Resolve(t *testing.T) {
 	}
 }
 
+func Test_truncatedAnswerRetriedOverTCP(t *testing.T) {
+	srv := newTestTruncatingServer(t)
+	tests := []struct {
+		name     string
+		resolver Resolver
+		wantUDP  int64
+	}{
+		{"legacy", &legacyResolver{uc: &UpstreamConfig{Type: ResolverTypeLegacy, Endpoint: srv.addr}}, 1},
+		{"legacy over tcp", &legacyResolver{uc: &UpstreamConfig{Type: ResolverTypeLegacy, Endpoint: srv.addr, Protocol: protocolTCP}}, 0},
+		{"os", &osResolver{nameservers: []string{srv.addr}}, 1},
+		{"os over tcp", &osResolver{nameservers: []string{srv.addr}, tcp: true}, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.udp.Store(0)
+			srv.tcp.Store(0)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			answer, err := tc.resolver.Resolve(ctx, testQuery("example.com."))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer.Truncated || len(answer.Answer) != 1 {
+				t.Fatalf("unexpected answer: %v", answer)
+			}
+			if udp, tcp := srv.udp.Load(), srv.tcp.Load(); udp != tc.wantUDP || tcp != 1 {
+				t.Errorf("unexpected queries, udp: %d, tcp: %d", udp, tcp)
+			}
+		})
+	}
+}
+
+// testTruncatingServer is a local DNS server, which truncates all UDP answers.
+type testTruncatingServer struct {
+	addr string
+	udp  atomic.Int64
+	tcp  atomic.Int64
+}
+
+func newTestTruncatingServer(t *testing.T) *testTruncatingServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skipf("could not listen on tcp: %v", err)
+	}
+	s := &testTruncatingServer{addr: pc.LocalAddr().String()}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			s.udp.Add(1)
+			answer := new(dns.Msg)
+			answer.SetReply(msg)
+			answer.Truncated = true
+			_ = w.WriteMsg(answer)
+			return
+		}
+		s.tcp.Add(1)
+		answer, _ := staticResolver("127.0.0.2").Resolve(context.Background(), msg)
+		_ = w.WriteMsg(answer)
+	})
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: ln, Handler: handler}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	})
+	return s
+}
+
 func Test_upstreamTypeFromEndpoint(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -39,6 +116,9 @@ func Test_upstreamTypeFromEndpoint(t *testing.T) {
 		{"dot", "p2.freedns.controld.com", ResolverTypeDOT},
 		{"legacy", "8.8.8.8:53", ResolverTypeLegacy},
 		{"legacy ipv6", "[2404:6800:4005:809::200e]:53", ResolverTypeLegacy},
+		{"dnscrypt stamp", "sdns://AQAAAAAAAAAADzE5Mi4wLjIuNTM6ODQ0MyABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4fIBsyLmRuc2NyeXB0LWNlcnQuZXhhbXBsZS5jb20", ResolverTypeDNSCrypt},
+		{"doh stamp", "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5", ResolverTypeDOH},
+		{"dot stamp", "sdns://AwAAAAAAAAAACTE5Mi4wLjIuMQAPZG5zLmV4YW1wbGUuY29t", ResolverTypeDOT},
 	}
 
 	for _, tc := range tests {
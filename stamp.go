@@ -0,0 +1,246 @@
+package ctrld
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// stampPrefix is the scheme of DNS stamps, see https://dnscrypt.info/stamps-specifications.
+const stampPrefix = "sdns://"
+
+// Protocol identifiers of DNS stamps.
+const (
+	stampProtoPlain    = 0x00
+	stampProtoDNSCrypt = 0x01
+	stampProtoDoH      = 0x02
+	stampProtoDoT      = 0x03
+	stampProtoDoQ      = 0x04
+)
+
+var errInvalidStamp = errors.New("invalid DNS stamp")
+
+// serverStamp is a decoded DNS stamp.
+type serverStamp struct {
+	proto byte
+	// serverAddr is the server address in "ip:port" form, may be empty for DoH/DoT/DoQ stamps.
+	serverAddr string
+	// providerPK is the DNSCrypt provider public key.
+	providerPK []byte
+	// providerName is the DNSCrypt provider name, or the server hostname for DoH/DoT/DoQ stamps.
+	providerName string
+	// path is the DoH endpoint path.
+	path string
+	// hashes are the SHA-256 hashes of the TBS certificates, one of them must be found in
+	// the certificate chain of DoH/DoT/DoQ servers.
+	hashes [][]byte
+}
+
+// parseStamp decodes a DNS stamp in "sdns://..." form. Only plain DNS, DNSCrypt, DoH, DoT
+// and DoQ stamps are supported. The server certificate of DoH/DoT/DoQ stamps is verified
+// using the system cert pool, or upstream ca_file/spki_pins settings, then the stamp hashes.
+func parseStamp(s string) (*serverStamp, error) {
+	if !strings.HasPrefix(s, stampPrefix) {
+		return nil, fmt.Errorf("%w: missing %s prefix", errInvalidStamp, stampPrefix)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, stampPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidStamp, err)
+	}
+	// Protocol identifier, then 8 bytes of properties, which are not used.
+	if len(b) < 9 {
+		return nil, fmt.Errorf("%w: too short", errInvalidStamp)
+	}
+	st := &serverStamp{proto: b[0]}
+	r := &stampReader{b: b[9:]}
+	addr := string(r.lp())
+	switch st.proto {
+	case stampProtoPlain:
+		st.serverAddr, err = stampAddr(addr, "53")
+		if err == nil && st.serverAddr == "" {
+			err = fmt.Errorf("%w: missing server address", errInvalidStamp)
+		}
+	case stampProtoDNSCrypt:
+		st.serverAddr, err = stampAddr(addr, "443")
+		st.providerPK = r.lp()
+		st.providerName = strings.TrimSuffix(string(r.lp()), ".")
+		if r.err == nil && err == nil {
+			switch {
+			case st.serverAddr == "":
+				err = fmt.Errorf("%w: missing server address", errInvalidStamp)
+			case len(st.providerPK) != 32:
+				err = fmt.Errorf("%w: invalid provider public key", errInvalidStamp)
+			case st.providerName == "":
+				err = fmt.Errorf("%w: missing provider name", errInvalidStamp)
+			}
+		}
+	case stampProtoDoH, stampProtoDoT, stampProtoDoQ:
+		port := "853"
+		if st.proto == stampProtoDoH {
+			port = "443"
+		}
+		st.serverAddr, err = stampAddr(addr, port)
+		for _, h := range r.vlp() {
+			switch len(h) {
+			case 0:
+				// An empty hash means there's no hash.
+			case sha256.Size:
+				st.hashes = append(st.hashes, h)
+			default:
+				if err == nil {
+					err = fmt.Errorf("%w: invalid certificate hash", errInvalidStamp)
+				}
+			}
+		}
+		st.providerName = string(r.lp())
+		if st.proto == stampProtoDoH {
+			st.path = string(r.lp())
+		}
+		if r.err == nil && err == nil && st.providerName == "" {
+			err = fmt.Errorf("%w: missing hostname", errInvalidStamp)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported protocol: 0x%02x", errInvalidStamp, st.proto)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// resolverType returns the upstream type of the stamp.
+func (st *serverStamp) resolverType() string {
+	switch st.proto {
+	case stampProtoPlain:
+		return ResolverTypeLegacy
+	case stampProtoDNSCrypt:
+		return ResolverTypeDNSCrypt
+	case stampProtoDoH:
+		return ResolverTypeDOH
+	case stampProtoDoT:
+		return ResolverTypeDOT
+	case stampProtoDoQ:
+		return ResolverTypeDOQ
+	}
+	return ""
+}
+
+// supportsType reports whether the stamp could be used for the given upstream type.
+func (st *serverStamp) supportsType(typ string) bool {
+	if typ == ResolverTypeDOH3 {
+		return st.proto == stampProtoDoH
+	}
+	return st.resolverType() == typ
+}
+
+// endpoint returns the upstream endpoint and bootstrap IP described by a plain DNS,
+// DoH, DoT or DoQ stamp. The bootstrap IP is empty if the stamp has no server address.
+func (st *serverStamp) endpoint() (string, string) {
+	ip, _, _ := net.SplitHostPort(st.serverAddr)
+	switch st.proto {
+	case stampProtoPlain:
+		return st.serverAddr, ip
+	case stampProtoDoH:
+		return "https://" + st.providerName + st.path, ip
+	}
+	endpoint := st.providerName
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		_, port, _ := net.SplitHostPort(st.serverAddr)
+		if port == "" {
+			port = "853"
+		}
+		endpoint = net.JoinHostPort(endpoint, port)
+	}
+	return endpoint, ip
+}
+
+// stampAddr normalizes a stamp server address to "ip:port" form.
+func stampAddr(addr, defaultPort string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+		return net.JoinHostPort(ip.String(), defaultPort), nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%w: invalid server address: %q", errInvalidStamp, addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// stampReader reads length-prefixed fields of a DNS stamp.
+type stampReader struct {
+	b   []byte
+	err error
+}
+
+// lp reads a length-prefixed field.
+func (r *stampReader) lp() []byte {
+	if r.err != nil || !r.hasMore() {
+		return nil
+	}
+	return r.field(r.b[0])
+}
+
+// vlp reads a variable length-prefixed set of fields.
+func (r *stampReader) vlp() [][]byte {
+	var vs [][]byte
+	for r.err == nil && r.hasMore() {
+		// The high bit of the length is set if more fields follow.
+		more := r.b[0]&0x80 != 0
+		vs = append(vs, r.field(r.b[0]&^0x80))
+		if !more {
+			break
+		}
+	}
+	return vs
+}
+
+func (r *stampReader) hasMore() bool {
+	if len(r.b) == 0 {
+		r.err = fmt.Errorf("%w: truncated", errInvalidStamp)
+		return false
+	}
+	return true
+}
+
+// field reads a field of length n, after the length byte.
+func (r *stampReader) field(n byte) []byte {
+	if len(r.b) < 1+int(n) {
+		r.err = fmt.Errorf("%w: truncated", errInvalidStamp)
+		return nil
+	}
+	v := r.b[1 : 1+int(n)]
+	r.b = r.b[1+int(n):]
+	return v
+}
+
+// initStamp initializes upstream using a DNS stamp endpoint. DNSCrypt stamps are kept
+// for the DNSCrypt client, other stamps are converted to the equivalent endpoint.
+func (uc *UpstreamConfig) initStamp() {
+	st, err := parseStamp(uc.Endpoint)
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("invalid endpoint for upstream: %s", uc.Name)
+		return
+	}
+	if st.proto == stampProtoDNSCrypt {
+		host, _, _ := net.SplitHostPort(st.serverAddr)
+		uc.Domain = host
+		uc.BootstrapIP = host
+		uc.dnscrypt = newDNSCryptClient(uc, st)
+		return
+	}
+	endpoint, ip := st.endpoint()
+	uc.Endpoint = endpoint
+	uc.stampHashes = st.hashes
+	if uc.BootstrapIP == "" {
+		uc.BootstrapIP = ip
+	}
+}
@@ -0,0 +1,100 @@
+package ctrld
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func Test_parseStamp(t *testing.T) {
+	pk := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		name         string
+		stamp        string
+		resolverType string
+		serverAddr   string
+		endpoint     string
+		bootstrapIP  string
+		wantErr      bool
+	}{
+		{"plain", encodeTestStamp(stampProtoPlain, "9.9.9.9"), ResolverTypeLegacy, "9.9.9.9:53", "9.9.9.9:53", "9.9.9.9", false},
+		{"plain ipv6 with port", encodeTestStamp(stampProtoPlain, "[2620:fe::fe]:5353"), ResolverTypeLegacy, "[2620:fe::fe]:5353", "[2620:fe::fe]:5353", "2620:fe::fe", false},
+		{"dnscrypt", encodeTestStamp(stampProtoDNSCrypt, "192.0.2.1", string(pk), "2.dnscrypt-cert.example.com."), ResolverTypeDNSCrypt, "192.0.2.1:443", "", "", false},
+		{"doh", "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5", ResolverTypeDOH, "1.0.0.1:443", "https://dns.cloudflare.com/dns-query", "1.0.0.1", false},
+		{"doh without address", encodeTestStamp(stampProtoDoH, "", "", "dns.example.com:8443", "/dns-query"), ResolverTypeDOH, "", "https://dns.example.com:8443/dns-query", "", false},
+		{"dot", encodeTestStamp(stampProtoDoT, "192.0.2.1:8853", "", "dns.example.com"), ResolverTypeDOT, "192.0.2.1:8853", "dns.example.com:8853", "192.0.2.1", false},
+		{"doq", encodeTestStamp(stampProtoDoQ, "", "", "dns.example.com"), ResolverTypeDOQ, "", "dns.example.com:853", "", false},
+		{"dot with hash", encodeTestStamp(stampProtoDoT, "192.0.2.1", string(pk), "dns.example.com"), ResolverTypeDOT, "192.0.2.1:853", "dns.example.com:853", "192.0.2.1", false},
+		{"dot invalid hash", encodeTestStamp(stampProtoDoT, "192.0.2.1", "hash", "dns.example.com"), "", "", "", "", true},
+		{"unsupported protocol", encodeTestStamp(0x05, "", "", "odoh.example.com", "/dns-query"), "", "", "", "", true},
+		{"dnscrypt invalid public key", encodeTestStamp(stampProtoDNSCrypt, "192.0.2.1", "key", "2.dnscrypt-cert.example.com"), "", "", "", "", true},
+		{"dnscrypt without address", encodeTestStamp(stampProtoDNSCrypt, "", string(pk), "2.dnscrypt-cert.example.com"), "", "", "", "", true},
+		{"invalid address", encodeTestStamp(stampProtoPlain, "dns.example.com"), "", "", "", "", true},
+		{"truncated", encodeTestStamp(stampProtoDoT, "192.0.2.1"), "", "", "", "", true},
+		{"invalid base64", "sdns://!!!", "", "", "", "", true},
+		{"missing prefix", "https://dns.example.com/dns-query", "", "", "", "", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			st, err := parseStamp(tc.stamp)
+			if tc.wantErr {
+				if !errors.Is(err, errInvalidStamp) {
+					t.Fatalf("expected invalid stamp error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := st.resolverType(); got != tc.resolverType {
+				t.Errorf("unexpected resolver type, want: %s, got: %s", tc.resolverType, got)
+			}
+			if st.serverAddr != tc.serverAddr {
+				t.Errorf("unexpected server address, want: %s, got: %s", tc.serverAddr, st.serverAddr)
+			}
+			if st.proto == stampProtoDNSCrypt {
+				if !bytes.Equal(st.providerPK, pk) || st.providerName != "2.dnscrypt-cert.example.com" {
+					t.Errorf("unexpected provider: %x, %s", st.providerPK, st.providerName)
+				}
+				return
+			}
+			endpoint, ip := st.endpoint()
+			if endpoint != tc.endpoint || ip != tc.bootstrapIP {
+				t.Errorf("unexpected endpoint, want: %s, %s, got: %s, %s", tc.endpoint, tc.bootstrapIP, endpoint, ip)
+			}
+		})
+	}
+}
+
+func TestUpstreamConfig_initStamp(t *testing.T) {
+	uc := &UpstreamConfig{
+		Name:     "test",
+		Type:     ResolverTypeDOH,
+		Endpoint: "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5",
+	}
+	uc.Init()
+	if uc.Endpoint != "https://dns.cloudflare.com/dns-query" || uc.Domain != "dns.cloudflare.com" || uc.BootstrapIP != "1.0.0.1" {
+		t.Errorf("unexpected doh upstream: %s, %s, %s", uc.Endpoint, uc.Domain, uc.BootstrapIP)
+	}
+
+	stamp := encodeTestStamp(stampProtoDNSCrypt, "[2001:db8::1]:8443", string(bytes.Repeat([]byte{1}, 32)), "2.dnscrypt-cert.example.com")
+	uc = &UpstreamConfig{Name: "test", Type: ResolverTypeDNSCrypt, Endpoint: stamp}
+	uc.Init()
+	if uc.Endpoint != stamp || uc.Domain != "2001:db8::1" || uc.BootstrapIP != "2001:db8::1" || uc.dnscrypt == nil {
+		t.Errorf("unexpected dnscrypt upstream: %s, %s, %s", uc.Endpoint, uc.Domain, uc.BootstrapIP)
+	}
+}
+
+// encodeTestStamp encodes a DNS stamp with given fields, each is encoded as a length-prefixed
+// field, so an empty field could be used as an empty set of hashes.
+func encodeTestStamp(proto byte, fields ...string) string {
+	b := []byte{proto, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, f := range fields {
+		b = append(b, byte(len(f)))
+		b = append(b, f...)
+	}
+	return stampPrefix + base64.RawURLEncoding.EncodeToString(b)
+}